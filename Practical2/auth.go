@@ -0,0 +1,201 @@
+// auth.go
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// RoleAdmin may read and write every user. Any other role may only read
+// and update the user whose ID is the token subject.
+const RoleAdmin = "admin"
+
+// Claims are the JWT claims the users API understands. The subject is the
+// caller's user ID.
+type Claims struct {
+	Role string `json:"role,omitempty"`
+	jwt.RegisteredClaims
+}
+
+// IsAdmin reports whether the claims grant the admin role.
+func (c *Claims) IsAdmin() bool {
+	return c.Role == RoleAdmin
+}
+
+// KeySet holds the locally configured keys used to verify tokens, by key
+// ID. The empty key ID is used for tokens without a kid header.
+type KeySet struct {
+	HMAC map[string][]byte
+	RSA  map[string]*rsa.PublicKey
+}
+
+// authKeys verifies bearer tokens. When it is nil authentication is
+// disabled and every route is open.
+var authKeys *KeySet
+
+// loadKeySet builds a KeySet from an HS256 secret and an RS256 public key
+// PEM file, either of which may be empty. It returns nil when both are.
+func loadKeySet(hmacSecret, rsaPublicKeyFile string) (*KeySet, error) {
+	if hmacSecret == "" && rsaPublicKeyFile == "" {
+		return nil, nil
+	}
+
+	keys := &KeySet{HMAC: map[string][]byte{}, RSA: map[string]*rsa.PublicKey{}}
+	if hmacSecret != "" {
+		keys.HMAC[""] = []byte(hmacSecret)
+	}
+	if rsaPublicKeyFile != "" {
+		data, err := os.ReadFile(rsaPublicKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read RSA public key: %w", err)
+		}
+		pub, err := jwt.ParseRSAPublicKeyFromPEM(data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse RSA public key: %w", err)
+		}
+		keys.RSA[""] = pub
+	}
+	return keys, nil
+}
+
+// keyFunc picks the verification key for token. The key type must match
+// the signing method so an RSA public key is never used as an HMAC secret.
+func (k *KeySet) keyFunc(token *jwt.Token) (any, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	switch token.Method.(type) {
+	case *jwt.SigningMethodHMAC:
+		if key, ok := k.HMAC[kid]; ok {
+			return key, nil
+		}
+	case *jwt.SigningMethodRSA:
+		if key, ok := k.RSA[kid]; ok {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("no %s key with id %q", token.Method.Alg(), kid)
+}
+
+// parse verifies tokenString and returns its claims.
+func (k *KeySet) parse(tokenString string) (*Claims, error) {
+	claims := &Claims{}
+	_, err := jwt.ParseWithClaims(tokenString, claims, k.keyFunc,
+		jwt.WithValidMethods([]string{"HS256", "RS256"}),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("token has no subject")
+	}
+	return claims, nil
+}
+
+type claimsKey struct{}
+
+// claimsFrom returns the claims authenticate stored in ctx, if any.
+func claimsFrom(ctx context.Context) (*Claims, bool) {
+	claims, ok := ctx.Value(claimsKey{}).(*Claims)
+	return claims, ok
+}
+
+// authenticate requires a valid bearer token and stores its claims in the
+// request context.
+func authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if authKeys == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		tokenString, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || tokenString == "" {
+			writeUnauthorized(w, r, `Bearer realm="users"`, "A bearer token is required.")
+			return
+		}
+
+		claims, err := authKeys.parse(tokenString)
+		if err != nil {
+			writeUnauthorized(w, r, `Bearer realm="users", error="invalid_token"`, "The bearer token is invalid: "+err.Error())
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), claimsKey{}, claims)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// requireAdmin only lets admins through.
+func requireAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if authKeys == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if claims, ok := claimsFrom(r.Context()); !ok || !claims.IsAdmin() {
+			writeForbidden(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requireSelfOrAdmin lets admins through, and other callers only when the
+// {id} in the path is their own.
+func requireSelfOrAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if authKeys == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		claims, ok := claimsFrom(r.Context())
+		if !ok {
+			writeForbidden(w, r)
+			return
+		}
+		if !claims.IsAdmin() && !isSubject(claims, chi.URLParam(r, "id")) {
+			writeForbidden(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isSubject compares numerically so that "01" and "1" are the same user.
+func isSubject(claims *Claims, id string) bool {
+	want, err := strconv.Atoi(id)
+	if err != nil {
+		return false
+	}
+	got, err := strconv.Atoi(claims.Subject)
+	return err == nil && got == want
+}
+
+func writeUnauthorized(w http.ResponseWriter, r *http.Request, challenge, detail string) {
+	w.Header().Set("WWW-Authenticate", challenge)
+	writeProblem(w, r, Problem{
+		Type:   problemUnauthorized,
+		Status: http.StatusUnauthorized,
+		Detail: detail,
+	})
+}
+
+func writeForbidden(w http.ResponseWriter, r *http.Request) {
+	writeProblem(w, r, Problem{
+		Type:   problemForbidden,
+		Status: http.StatusForbidden,
+		Detail: "Only admins may access other users.",
+	})
+}
@@ -0,0 +1,149 @@
+// auth_test.go
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var testHMACSecret = []byte("test-secret")
+
+// mintToken signs a token for subject with role using HS256.
+func mintToken(t *testing.T, subject, role string, ttl time.Duration) string {
+	t.Helper()
+
+	claims := Claims{
+		Role: role,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   subject,
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(ttl)),
+		},
+	}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(testHMACSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// enableAuth turns authentication on with the test secret for one test.
+func enableAuth(t *testing.T) {
+	t.Helper()
+
+	authKeys = &KeySet{HMAC: map[string][]byte{"": testHMACSecret}}
+	t.Cleanup(func() { authKeys = nil })
+}
+
+func bearer(token string) map[string]string {
+	return map[string]string{"Authorization": "Bearer " + token}
+}
+
+func TestAuthorization(t *testing.T) {
+	enableAuth(t)
+
+	admin := mintToken(t, "100", RoleAdmin, time.Hour)
+	alice := mintToken(t, "1", "user", time.Hour)
+	expired := mintToken(t, "1", "user", -time.Hour)
+
+	testCases := []struct {
+		name       string
+		method     string
+		url        string
+		body       string
+		headers    map[string]string
+		wantStatus int
+	}{
+		{"No token", "GET", "/v1/users/1", "", nil, http.StatusUnauthorized},
+		{"Malformed header", "GET", "/v1/users/1", "", map[string]string{"Authorization": "Basic abc"}, http.StatusUnauthorized},
+		{"Expired token", "GET", "/v1/users/1", "", bearer(expired), http.StatusUnauthorized},
+		{"Wrong secret", "GET", "/v1/users/1", "", bearer(alice[:len(alice)-2] + "xx"), http.StatusUnauthorized},
+		{"User reads self", "GET", "/v1/users/1", "", bearer(alice), http.StatusOK},
+		{"User reads other", "GET", "/v1/users/2", "", bearer(alice), http.StatusForbidden},
+		{"User updates self", "PUT", "/v1/users/1", `{"name": "Alicia"}`, bearer(alice), http.StatusOK},
+		{"User updates other", "PUT", "/v1/users/2", `{"name": "Mallory"}`, bearer(alice), http.StatusForbidden},
+		{"User lists users", "GET", "/v1/users", "", bearer(alice), http.StatusForbidden},
+		{"User creates user", "POST", "/v1/users", `{"name": "Eve"}`, bearer(alice), http.StatusForbidden},
+		{"User deletes self", "DELETE", "/v1/users/1", "", bearer(alice), http.StatusForbidden},
+		{"Admin lists users", "GET", "/v1/users", "", bearer(admin), http.StatusOK},
+		{"Admin updates other", "PUT", "/v1/users/2", `{"name": "Robert"}`, bearer(admin), http.StatusOK},
+		{"Admin creates user", "POST", "/v1/users", `{"name": "Carol"}`, bearer(admin), http.StatusCreated},
+		{"Admin deletes other", "DELETE", "/v1/users/2", "", bearer(admin), http.StatusNoContent},
+		{"Probes stay open", "GET", "/healthz", "", nil, http.StatusOK},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resetState()
+			setUser(User{ID: 1, Name: "Alice"})
+			setUser(User{ID: 2, Name: "Bob"})
+			memStore.nextID = 3
+
+			rr := serve(t, tc.method, tc.url, tc.body, tc.headers)
+			if status := rr.Code; status != tc.wantStatus {
+				t.Errorf("handler returned wrong status code: got %v want %v", status, tc.wantStatus)
+			}
+			if rr.Code == http.StatusUnauthorized && rr.Header().Get("WWW-Authenticate") == "" {
+				t.Error("401 response has no WWW-Authenticate challenge")
+			}
+		})
+	}
+}
+
+func TestKeySet_RS256(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "public.pem")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := loadKeySet("", keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims := Claims{RegisteredClaims: jwt.RegisteredClaims{
+		Subject:   "7",
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	}}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := keys.parse(token)
+	if err != nil {
+		t.Fatalf("valid RS256 token rejected: %v", err)
+	}
+	if parsed.Subject != "7" {
+		t.Errorf("wrong subject: got %v want %v", parsed.Subject, "7")
+	}
+
+	// An HS256 token must not verify against the RSA-only key set
+	hs, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(der)
+	if _, err := keys.parse(hs); err == nil {
+		t.Error("HS256 token accepted by an RS256 key set")
+	}
+}
+
+func TestLoadKeySet_Disabled(t *testing.T) {
+	keys, err := loadKeySet("", "")
+	if err != nil || keys != nil {
+		t.Errorf("loadKeySet with no keys: got %v, %v want nil, nil", keys, err)
+	}
+}
@@ -0,0 +1,262 @@
+// batch.go
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+)
+
+// Batch modes. In atomic mode either every operation is applied or none
+// is; in best-effort mode each operation succeeds or fails on its own.
+const (
+	batchAtomic     = "atomic"
+	batchBestEffort = "best-effort"
+)
+
+const maxBatchOperations = 1000
+
+// batchRequest is the body of POST /users:batch.
+type batchRequest struct {
+	Mode       string           `json:"mode"`
+	Operations []batchOperation `json:"operations"`
+}
+
+type batchOperation struct {
+	Op      string          `json:"op"`
+	ID      int             `json:"id,omitempty"`
+	User    json.RawMessage `json:"user,omitempty"`
+	IfMatch string          `json:"if_match,omitempty"`
+}
+
+// batchItem is the outcome of one operation, in request order. User holds
+// the user as the API version of the request shows it.
+type batchItem struct {
+	Status int      `json:"status"`
+	User   any      `json:"user,omitempty"`
+	ETag   string   `json:"etag,omitempty"`
+	Error  *Problem `json:"error,omitempty"`
+}
+
+type batchResponse struct {
+	Mode    string      `json:"mode"`
+	Results []batchItem `json:"results"`
+}
+
+// batchUsersHandler handles POST /users:batch
+//
+// Every operation is checked with the same rules as the single-user
+// routes before the valid ones are handed to the store in one call. The
+// response lists a status per operation; a failed atomic batch answers
+// 422 and marks the operations it did not apply with 424.
+func batchUsersHandler(w http.ResponseWriter, r *http.Request) {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+
+	var req batchRequest
+	if err := dec.Decode(&req); err != nil {
+		writeDecodeError(w, r, decodeError(err))
+		return
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		writeDecodeError(w, r, errors.New("request body must contain a single JSON object"))
+		return
+	}
+
+	var fields []FieldError
+	if req.Mode == "" {
+		req.Mode = batchAtomic
+	}
+	if req.Mode != batchAtomic && req.Mode != batchBestEffort {
+		fields = append(fields, FieldError{Field: "mode", Message: "must be atomic or best-effort"})
+	}
+	if n := len(req.Operations); n == 0 || n > maxBatchOperations {
+		fields = append(fields, FieldError{Field: "operations", Message: fmt.Sprintf("must contain between 1 and %d operations", maxBatchOperations)})
+	}
+	if len(fields) > 0 {
+		writeDecodeError(w, r, &ValidationError{Fields: fields})
+		return
+	}
+	atomic := req.Mode == batchAtomic
+
+	// Validate every operation first; only the valid ones reach the store
+	v := versionFrom(r.Context())
+	results := make([]batchItem, len(req.Operations))
+	var ops []BatchOp
+	var opIndex []int
+	invalid := false
+	for i, raw := range req.Operations {
+		op, err := parseBatchOperation(raw, v)
+		if err != nil {
+			results[i] = batchItem{Status: http.StatusUnprocessableEntity, Error: batchProblem(r, i, err)}
+			invalid = true
+			continue
+		}
+		ops = append(ops, op)
+		opIndex = append(opIndex, i)
+	}
+
+	if invalid && atomic {
+		for i := range results {
+			if results[i].Status == 0 {
+				results[i] = batchItem{Status: http.StatusFailedDependency, Error: batchProblem(r, i, ErrBatchAborted)}
+			}
+		}
+		writeBatchResponse(w, http.StatusUnprocessableEntity, req.Mode, results)
+		return
+	}
+
+	stored, err := store.Batch(ops, atomic)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+
+	failed := false
+	for j, res := range stored {
+		i := opIndex[j]
+		if res.Err != nil {
+			failed = failed || !errors.Is(res.Err, ErrBatchAborted)
+			results[i] = batchItem{Status: batchErrorStatus(res.Err), Error: batchProblem(r, i, res.Err)}
+			continue
+		}
+
+		switch ops[j].Op {
+		case BatchCreate:
+			user := res.User
+			results[i] = batchItem{Status: http.StatusCreated, User: v.user(user), ETag: userETag(user)}
+		case BatchUpdate:
+			user := res.User
+			results[i] = batchItem{Status: http.StatusOK, User: v.user(user), ETag: userETag(user)}
+		case BatchDelete:
+			results[i] = batchItem{Status: http.StatusNoContent}
+		}
+	}
+
+	status := http.StatusOK
+	if atomic && failed {
+		status = http.StatusUnprocessableEntity
+	}
+	writeBatchResponse(w, status, req.Mode, results)
+}
+
+// parseBatchOperation checks one operation of a batch sent through v and
+// converts it for the store.
+// Field names in validation errors are relative to the operation.
+func parseBatchOperation(raw batchOperation, v *apiVersion) (BatchOp, error) {
+	op := BatchOp{Op: raw.Op, ID: raw.ID}
+
+	switch raw.Op {
+	case BatchCreate:
+		if raw.ID != 0 {
+			return op, &ValidationError{Fields: []FieldError{{Field: "id", Message: "must not be set for create"}}}
+		}
+		if raw.IfMatch != "" {
+			return op, &ValidationError{Fields: []FieldError{{Field: "if_match", Message: "must not be set for create"}}}
+		}
+	case BatchUpdate, BatchDelete:
+		if raw.ID <= 0 {
+			return op, &ValidationError{Fields: []FieldError{{Field: "id", Message: "is required"}}}
+		}
+		version, err := parseIfMatch(raw.IfMatch)
+		if err != nil {
+			return op, err
+		}
+		op.ExpectVersion = version
+	default:
+		return op, &ValidationError{Fields: []FieldError{{Field: "op", Message: "must be create, update or delete"}}}
+	}
+
+	if raw.Op == BatchDelete {
+		if len(raw.User) > 0 {
+			return op, &ValidationError{Fields: []FieldError{{Field: "user", Message: "must not be set for delete"}}}
+		}
+		return op, nil
+	}
+
+	if len(raw.User) == 0 {
+		return op, &ValidationError{Fields: []FieldError{{Field: "user", Message: "is required"}}}
+	}
+	user, err := decodeUserJSON(bytes.NewReader(raw.User), op.ID, v)
+	if err != nil {
+		var verr *ValidationError
+		if errors.As(err, &verr) {
+			for k := range verr.Fields {
+				verr.Fields[k].Field = "user." + verr.Fields[k].Field
+			}
+		}
+		return op, err
+	}
+	op.User = user
+	return op, nil
+}
+
+// parseIfMatch turns the if_match of an operation into the version the
+// write expects. Only a single strong tag or "*" is accepted.
+func parseIfMatch(tag string) (int, error) {
+	if tag == "" || tag == "*" {
+		return 0, nil
+	}
+	if len(tag) > 2 && tag[0] == '"' && tag[len(tag)-1] == '"' {
+		if version, err := strconv.Atoi(tag[1 : len(tag)-1]); err == nil && version > 0 {
+			return version, nil
+		}
+	}
+	return 0, &ValidationError{Fields: []FieldError{{Field: "if_match", Message: "must be an entity tag returned by the API"}}}
+}
+
+func batchErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrUserNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, ErrVersionMismatch):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, ErrEmailTaken):
+		return http.StatusConflict
+	case errors.Is(err, ErrBatchAborted):
+		return http.StatusFailedDependency
+	}
+	return http.StatusInternalServerError
+}
+
+// batchProblem describes why operation i failed. Its instance points at
+// the operation within the request.
+func batchProblem(r *http.Request, i int, err error) *Problem {
+	p := &Problem{Instance: fmt.Sprintf("%s#/operations/%d", r.URL.RequestURI(), i)}
+
+	var verr *ValidationError
+	switch {
+	case errors.As(err, &verr):
+		p.Type, p.Title, p.Status = problemValidationFailed, "Validation failed", http.StatusUnprocessableEntity
+		p.Errors = verr.Fields
+	case errors.Is(err, ErrUserNotFound):
+		p.Type, p.Title, p.Status = problemUserNotFound, "User not found", http.StatusNotFound
+	case errors.Is(err, ErrVersionMismatch):
+		p.Type, p.Status = problemPrecondition, http.StatusPreconditionFailed
+		p.Detail = "The user has changed since the entity tag in if_match was issued."
+	case errors.Is(err, ErrEmailTaken):
+		p.Type, p.Title, p.Status = problemEmailTaken, "Email taken", http.StatusConflict
+		p.Detail = "Another user already has this email address."
+	case errors.Is(err, ErrBatchAborted):
+		p.Type, p.Status = problemBatchAborted, http.StatusFailedDependency
+		p.Detail = "Not applied because another operation in the atomic batch failed."
+	default:
+		loggerFrom(r.Context()).Error("batch operation failed", slog.Int("index", i), slog.Any("error", err))
+		p.Type, p.Status = problemInternal, http.StatusInternalServerError
+	}
+	if p.Title == "" {
+		p.Title = http.StatusText(p.Status)
+	}
+	return p
+}
+
+func writeBatchResponse(w http.ResponseWriter, status int, mode string, results []batchItem) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(batchResponse{Mode: mode, Results: results})
+}
@@ -0,0 +1,193 @@
+// batch_test.go
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+// seedBatchUsers stores Alice (1) and Bob (2) at version 1.
+func seedBatchUsers() {
+	resetState()
+	setUser(User{ID: 1, Name: "Alice", Version: 1})
+	setUser(User{ID: 2, Name: "Bob", Version: 1})
+	memStore.nextID = 3
+}
+
+func decodeBatch(t *testing.T, body []byte) batchResponse {
+	t.Helper()
+
+	var resp batchResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		t.Fatalf("invalid batch response: %v (%s)", err, body)
+	}
+	return resp
+}
+
+func batchStatuses(resp batchResponse) []int {
+	statuses := make([]int, len(resp.Results))
+	for i, res := range resp.Results {
+		statuses[i] = res.Status
+	}
+	return statuses
+}
+
+func TestBatchUsersHandler(t *testing.T) {
+	testCases := []struct {
+		name         string
+		payload      string
+		wantStatus   int
+		wantStatuses []int
+		wantUsers    map[int]string
+	}{
+		{
+			name: "Atomic success",
+			payload: `{"mode": "atomic", "operations": [
+				{"op": "create", "user": {"name": "Carol"}},
+				{"op": "update", "id": 1, "user": {"name": "Alicia"}, "if_match": "\"1\""},
+				{"op": "delete", "id": 2}
+			]}`,
+			wantStatus:   http.StatusOK,
+			wantStatuses: []int{201, 200, 204},
+			wantUsers:    map[int]string{1: "Alicia", 3: "Carol"},
+		},
+		{
+			name: "Atomic failure rolls back",
+			payload: `{"operations": [
+				{"op": "create", "user": {"name": "Carol"}},
+				{"op": "delete", "id": 1},
+				{"op": "update", "id": 99, "user": {"name": "Ghost"}},
+				{"op": "delete", "id": 2}
+			]}`,
+			wantStatus:   http.StatusUnprocessableEntity,
+			wantStatuses: []int{424, 424, 404, 424},
+			wantUsers:    map[int]string{1: "Alice", 2: "Bob"},
+		},
+		{
+			name: "Atomic validation failure applies nothing",
+			payload: `{"mode": "atomic", "operations": [
+				{"op": "delete", "id": 1},
+				{"op": "create", "user": {"name": ""}}
+			]}`,
+			wantStatus:   http.StatusUnprocessableEntity,
+			wantStatuses: []int{424, 422},
+			wantUsers:    map[int]string{1: "Alice", 2: "Bob"},
+		},
+		{
+			name: "Best effort applies what it can",
+			payload: `{"mode": "best-effort", "operations": [
+				{"op": "create", "user": {"name": "Carol"}},
+				{"op": "update", "id": 1, "user": {"name": "Alicia"}, "if_match": "\"7\""},
+				{"op": "create", "user": {"name": "R2D2"}},
+				{"op": "delete", "id": 99},
+				{"op": "delete", "id": 2}
+			]}`,
+			wantStatus:   http.StatusOK,
+			wantStatuses: []int{201, 412, 422, 404, 204},
+			wantUsers:    map[int]string{1: "Alice", 3: "Carol"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			seedBatchUsers()
+
+			rr := serve(t, "POST", "/v1/users:batch", tc.payload, nil)
+			if status := rr.Code; status != tc.wantStatus {
+				t.Fatalf("handler returned wrong status code: got %v want %v (%s)", status, tc.wantStatus, rr.Body)
+			}
+
+			resp := decodeBatch(t, rr.Body.Bytes())
+			got := batchStatuses(resp)
+			if len(got) != len(tc.wantStatuses) {
+				t.Fatalf("wrong number of results: got %v want %v", got, tc.wantStatuses)
+			}
+			for i := range got {
+				if got[i] != tc.wantStatuses[i] {
+					t.Errorf("result %d: got status %v want %v", i, got[i], tc.wantStatuses[i])
+				}
+			}
+
+			if n, _ := memStore.Count(); n != len(tc.wantUsers) {
+				t.Errorf("wrong users stored: got %v want %v", storedUsers(), tc.wantUsers)
+			}
+			for id, name := range tc.wantUsers {
+				if peekUser(id).Name != name {
+					t.Errorf("user %d: got name %q want %q", id, peekUser(id).Name, name)
+				}
+			}
+		})
+	}
+}
+
+func TestBatchUsersHandler_ItemDetails(t *testing.T) {
+	seedBatchUsers()
+
+	rr := serve(t, "POST", "/v1/users:batch", `{"mode": "best-effort", "operations": [
+		{"op": "create", "user": {"name": "Carol"}},
+		{"op": "create", "user": {"name": "Dave", "role": "admin"}}
+	]}`, nil)
+
+	resp := decodeBatch(t, rr.Body.Bytes())
+	created := resp.Results[0]
+	user, _ := created.User.(map[string]any)
+	if user == nil || user["id"] != 3.0 || created.ETag != `"1"` {
+		t.Errorf("create result is missing the user or ETag: %+v", created)
+	}
+
+	failed := resp.Results[1].Error
+	if failed == nil || len(failed.Errors) != 1 || failed.Errors[0].Field != "user.role" {
+		t.Fatalf("validation result does not name the field: %+v", failed)
+	}
+	if failed.Instance != "/v1/users:batch#/operations/1" {
+		t.Errorf("wrong problem instance: got %v", failed.Instance)
+	}
+}
+
+func TestBatchUsersHandler_InvalidRequest(t *testing.T) {
+	testCases := []struct {
+		name    string
+		payload string
+	}{
+		{"No operations", `{"operations": []}`},
+		{"Unknown mode", `{"mode": "yolo", "operations": [{"op": "delete", "id": 1}]}`},
+		{"Unknown field", `{"operations": [{"op": "delete", "id": 1}], "dry_run": true}`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			seedBatchUsers()
+
+			rr := serve(t, "POST", "/v1/users:batch", tc.payload, nil)
+			if status := rr.Code; status != http.StatusUnprocessableEntity {
+				t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusUnprocessableEntity)
+			}
+			if len(storedUsers()) != 2 {
+				t.Error("invalid batch changed the store")
+			}
+		})
+	}
+}
+
+func TestMemoryStore_BatchRollback(t *testing.T) {
+	s := NewMemoryStore()
+	s.Create(User{Name: "Alice"})
+
+	results, err := s.Batch([]BatchOp{
+		{Op: BatchCreate, User: User{Name: "Bob"}},
+		{Op: BatchDelete, ID: 42},
+	}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[0].Err != ErrBatchAborted || results[1].Err != ErrUserNotFound {
+		t.Errorf("unexpected results: %+v", results)
+	}
+
+	// The rolled back create must not have used up an ID
+	created, _ := s.Create(User{Name: "Carol"})
+	if created.ID != 2 {
+		t.Errorf("rollback leaked an ID: got %v want %v", created.ID, 2)
+	}
+}
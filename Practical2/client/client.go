@@ -0,0 +1,442 @@
+// client.go
+
+// Package client is a typed Go client for the users API.
+//
+// Every call takes a context. Reads, updates and deletes are retried with
+// exponential backoff when the server is unavailable or rate limits the
+// client; creates are retried too, under an Idempotency-Key so a retry
+// cannot create a second user. Error responses are returned as *Error,
+// which errors.Is matches against ErrNotFound and the other sentinels.
+//
+// The client speaks version 2 of the API, under /v2, in which every user
+// has an email address.
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	mathrand "math/rand/v2"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// User is a user as returned by the API. ETag identifies the version that
+// was read; pass it to IfMatch to make a write conditional on it.
+// Email is empty, and the timestamps nil, for users created through v1
+// that have not been given an email since.
+type User struct {
+	ID        int        `json:"id"`
+	Name      string     `json:"name"`
+	Email     string     `json:"email,omitempty"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	ETag      string     `json:"-"`
+}
+
+// UserInput holds the fields a client can set on a user. Both are
+// required on every write.
+type UserInput struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+// ListOptions select and order the users returned by List. Zero values
+// leave the server defaults in place.
+type ListOptions struct {
+	Limit          int
+	Offset         int
+	Sort           string // id, -id, name or -name
+	Name           string // case-insensitive substring of the name
+	IncludeDeleted bool
+}
+
+// Page is one page of a user listing. Total counts every match, not only
+// the users on the page.
+type Page struct {
+	Users []User
+	Total int
+}
+
+// Client calls the users API. It is safe for concurrent use.
+type Client struct {
+	base       *url.URL
+	httpClient *http.Client
+	token      string
+	maxRetries int
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithHTTPClient sets the HTTP client used for requests.
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.httpClient = hc }
+}
+
+// WithToken sends token as a bearer token with every request.
+func WithToken(token string) Option {
+	return func(c *Client) { c.token = token }
+}
+
+// WithRetries retries a failed call up to maxRetries times, waiting about
+// backoff before the first retry and twice as long before each later one.
+// Zero retries turns retrying off.
+func WithRetries(maxRetries int, backoff time.Duration) Option {
+	return func(c *Client) { c.maxRetries, c.backoff = maxRetries, backoff }
+}
+
+// New returns a client for the API at baseURL, such as
+// "http://localhost:3000". By default a call is retried up to three times,
+// starting 200ms apart.
+func New(baseURL string, opts ...Option) (*Client, error) {
+	base, err := url.Parse(strings.TrimSuffix(baseURL, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid base URL: %w", err)
+	}
+	if base.Scheme != "http" && base.Scheme != "https" {
+		return nil, fmt.Errorf("invalid base URL %q: scheme must be http or https", baseURL)
+	}
+
+	c := &Client{
+		base:       base,
+		httpClient: http.DefaultClient,
+		maxRetries: 3,
+		backoff:    200 * time.Millisecond,
+		maxBackoff: 10 * time.Second,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
+}
+
+// CallOption adjusts a single call.
+type CallOption func(*http.Request)
+
+// IfMatch makes a write conditional on the user still having the version
+// identified by etag. If it has changed, the call fails with
+// ErrPreconditionFailed.
+func IfMatch(etag string) CallOption {
+	return func(r *http.Request) { r.Header.Set("If-Match", etag) }
+}
+
+// Get returns the user with the given ID.
+func (c *Client) Get(ctx context.Context, id int) (*User, error) {
+	var user User
+	resp, err := c.do(ctx, "GET", userPath(id), nil, nil, &user)
+	if err != nil {
+		return nil, err
+	}
+	user.ETag = resp.Header.Get("ETag")
+	return &user, nil
+}
+
+// ListPage returns one page of users.
+func (c *Client) ListPage(ctx context.Context, opts ListOptions) (*Page, error) {
+	page, _, err := c.listPage(ctx, opts.query())
+	return page, err
+}
+
+// List returns an iterator over the pages of users matching opts, from
+// opts.Offset onwards. It follows the server's next links and stops after
+// the last page or the first error.
+func (c *Client) List(ctx context.Context, opts ListOptions) iter.Seq2[*Page, error] {
+	return func(yield func(*Page, error) bool) {
+		query := opts.query()
+		for query != nil {
+			page, next, err := c.listPage(ctx, query)
+			if !yield(page, err) || err != nil {
+				return
+			}
+			query = next
+		}
+	}
+}
+
+// Create creates a user. Retries reuse one Idempotency-Key, so the user is
+// created at most once.
+func (c *Client) Create(ctx context.Context, in UserInput) (*User, error) {
+	key, err := idempotencyKey()
+	if err != nil {
+		return nil, err
+	}
+
+	var user User
+	resp, err := c.do(ctx, "POST", usersPath, in, []CallOption{key}, &user)
+	if err != nil {
+		return nil, err
+	}
+	user.ETag = resp.Header.Get("ETag")
+	return &user, nil
+}
+
+// Import creates several users at once. They are created together or, if
+// any is invalid, not at all; field errors name the row as
+// "rows.<index>.<field>", counting from 0.
+func (c *Client) Import(ctx context.Context, in []UserInput) ([]User, error) {
+	key, err := idempotencyKey()
+	if err != nil {
+		return nil, err
+	}
+
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, user := range in {
+		if err := enc.Encode(user); err != nil {
+			return nil, err
+		}
+	}
+
+	var users []User
+	_, err = c.send(ctx, "POST", usersPath, body.Bytes(), []CallOption{key, func(r *http.Request) {
+		r.Header.Set("Content-Type", "application/x-ndjson")
+	}}, &users)
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// Update replaces the user with the given ID.
+func (c *Client) Update(ctx context.Context, id int, in UserInput, opts ...CallOption) (*User, error) {
+	var user User
+	resp, err := c.do(ctx, "PUT", userPath(id), in, opts, &user)
+	if err != nil {
+		return nil, err
+	}
+	user.ETag = resp.Header.Get("ETag")
+	return &user, nil
+}
+
+// Patch applies a JSON Merge Patch (RFC 7396) to the user with the given
+// ID: fields set in patch are replaced and fields set to nil are removed.
+// Without IfMatch the call is not retried, since the patch may already
+// have been applied.
+func (c *Client) Patch(ctx context.Context, id int, patch map[string]any, opts ...CallOption) (*User, error) {
+	opts = append(opts, func(r *http.Request) { r.Header.Set("Content-Type", "application/merge-patch+json") })
+
+	var user User
+	resp, err := c.do(ctx, "PATCH", userPath(id), patch, opts, &user)
+	if err != nil {
+		return nil, err
+	}
+	user.ETag = resp.Header.Get("ETag")
+	return &user, nil
+}
+
+// Delete deletes the user with the given ID.
+func (c *Client) Delete(ctx context.Context, id int, opts ...CallOption) error {
+	_, err := c.do(ctx, "DELETE", userPath(id), nil, opts, nil)
+	return err
+}
+
+func (c *Client) listPage(ctx context.Context, query url.Values) (*Page, url.Values, error) {
+	var users []User
+	resp, err := c.do(ctx, "GET", usersPath+"?"+query.Encode(), nil, nil, &users)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	total, _ := strconv.Atoi(resp.Header.Get("X-Total-Count"))
+	return &Page{Users: users, Total: total}, nextQuery(resp.Header.Get("Link")), nil
+}
+
+func (o ListOptions) query() url.Values {
+	q := url.Values{}
+	if o.Limit > 0 {
+		q.Set("limit", strconv.Itoa(o.Limit))
+	}
+	if o.Offset > 0 {
+		q.Set("offset", strconv.Itoa(o.Offset))
+	}
+	if o.Sort != "" {
+		q.Set("sort", o.Sort)
+	}
+	if o.Name != "" {
+		q.Set("name", o.Name)
+	}
+	if o.IncludeDeleted {
+		q.Set("include_deleted", "true")
+	}
+	return q
+}
+
+// nextQuery returns the query string of the rel="next" link in an RFC 8288
+// Link header, or nil if there is none. Only the query is kept, so paging
+// works behind proxies that mount the API under a prefix.
+func nextQuery(header string) url.Values {
+	for _, link := range strings.Split(header, ",") {
+		target, params, ok := strings.Cut(strings.TrimSpace(link), ";")
+		if !ok || !strings.Contains(params, `rel="next"`) {
+			continue
+		}
+		u, err := url.Parse(strings.Trim(strings.TrimSpace(target), "<>"))
+		if err != nil {
+			return nil
+		}
+		return u.Query()
+	}
+	return nil
+}
+
+// do sends body as JSON with send.
+func (c *Client) do(ctx context.Context, method, path string, body any, opts []CallOption, out any) (*http.Response, error) {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return nil, err
+		}
+	}
+	return c.send(ctx, method, path, payload, opts, out)
+}
+
+// send sends a request, retrying it while that is safe, and decodes a
+// successful JSON response into out. A payload is sent as JSON unless opts
+// set another Content-Type.
+func (c *Client) send(ctx context.Context, method, path string, payload []byte, opts []CallOption, out any) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, c.base.String()+path, bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", "application/json")
+		if payload != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		if c.token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		for _, opt := range opts {
+			opt(req)
+		}
+
+		resp, err := c.httpClient.Do(req)
+		var retryAfter time.Duration
+		if err == nil {
+			err = decodeResponse(resp, out)
+			retryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+		}
+		if err == nil {
+			return resp, nil
+		}
+
+		if attempt >= c.maxRetries || !retryable(req, err) || ctx.Err() != nil {
+			return nil, err
+		}
+		timer := time.NewTimer(max(c.retryDelay(attempt), retryAfter))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// decodeResponse reads resp into out, or into an *Error if it failed.
+func decodeResponse(resp *http.Response, out any) error {
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= 300 {
+		apiErr := &Error{StatusCode: resp.StatusCode}
+		if json.Unmarshal(data, apiErr) != nil || apiErr.Title == "" {
+			apiErr.Title = http.StatusText(resp.StatusCode)
+		}
+		return apiErr
+	}
+	if out == nil || len(data) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("invalid response body: %w", err)
+	}
+	return nil
+}
+
+// retryable reports whether a failed request may be sent again: the
+// method must be safe to repeat and the failure temporary.
+func retryable(req *http.Request, err error) bool {
+	switch req.Method {
+	case "GET", "PUT", "DELETE":
+	case "POST":
+		if req.Header.Get("Idempotency-Key") == "" {
+			return false
+		}
+	case "PATCH":
+		if req.Header.Get("If-Match") == "" {
+			return false
+		}
+	default:
+		return false
+	}
+
+	var apiErr *Error
+	if !errors.As(err, &apiErr) {
+		// The request never got a response
+		return true
+	}
+	switch apiErr.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	case http.StatusConflict:
+		// The first request with this Idempotency-Key is still running
+		return apiErr.Type == problemIdempotencyInFlight
+	}
+	return false
+}
+
+// retryDelay returns the wait before retry attempt+1: the backoff doubled
+// per attempt, capped, with up to half of it taken off at random so that
+// clients do not retry in lockstep.
+func (c *Client) retryDelay(attempt int) time.Duration {
+	delay := c.backoff
+	for i := 0; i < attempt && delay < c.maxBackoff; i++ {
+		delay *= 2
+	}
+	delay = min(delay, c.maxBackoff)
+	return delay - time.Duration(mathrand.Int64N(int64(delay)/2+1))
+}
+
+func parseRetryAfter(v string) time.Duration {
+	if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	return 0
+}
+
+// usersPath is the collection of users in the API version the client
+// speaks.
+const usersPath = "/v2/users"
+
+func userPath(id int) string {
+	return usersPath + "/" + strconv.Itoa(id)
+}
+
+// idempotencyKey returns a CallOption that sends a new random
+// Idempotency-Key, which stays the same across retries.
+func idempotencyKey() (CallOption, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, fmt.Errorf("failed to generate idempotency key: %w", err)
+	}
+	key := hex.EncodeToString(b)
+	return func(r *http.Request) { r.Header.Set("Idempotency-Key", key) }, nil
+}
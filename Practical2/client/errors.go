@@ -0,0 +1,89 @@
+// errors.go
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Sentinel errors that an *Error matches with errors.Is, by status code.
+var (
+	ErrInvalidRequest     = errors.New("invalid request")     // 400
+	ErrUnauthorized       = errors.New("unauthorized")        // 401
+	ErrForbidden          = errors.New("forbidden")           // 403
+	ErrNotFound           = errors.New("not found")           // 404
+	ErrConflict           = errors.New("conflict")            // 409
+	ErrPreconditionFailed = errors.New("precondition failed") // 412
+	ErrValidation         = errors.New("validation failed")   // 422
+	ErrRateLimited        = errors.New("rate limited")        // 429
+	ErrServer             = errors.New("server error")        // 5xx
+)
+
+// problemIdempotencyInFlight is the problem type of a request whose
+// Idempotency-Key is still in use by an earlier request.
+const problemIdempotencyInFlight = "/problems/idempotency-key-in-flight"
+
+// FieldError is one invalid field reported by the server.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Error is an error response from the API, decoded from its RFC 7807
+// problem details.
+type Error struct {
+	StatusCode int          `json:"-"`
+	Type       string       `json:"type"`
+	Title      string       `json:"title"`
+	Detail     string       `json:"detail"`
+	Instance   string       `json:"instance"`
+	Fields     []FieldError `json:"errors"`
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("users API: %d %s", e.StatusCode, e.Title)
+	if e.Detail != "" {
+		msg += ": " + e.Detail
+	}
+	if len(e.Fields) > 0 {
+		fields := make([]string, len(e.Fields))
+		for i, f := range e.Fields {
+			fields[i] = f.Field + " " + f.Message
+		}
+		msg += " (" + strings.Join(fields, "; ") + ")"
+	}
+	return msg
+}
+
+// Is matches e against the sentinel for its status code.
+func (e *Error) Is(target error) bool {
+	sentinel := statusError(e.StatusCode)
+	return sentinel != nil && sentinel == target
+}
+
+func statusError(status int) error {
+	switch status {
+	case http.StatusBadRequest:
+		return ErrInvalidRequest
+	case http.StatusUnauthorized:
+		return ErrUnauthorized
+	case http.StatusForbidden:
+		return ErrForbidden
+	case http.StatusNotFound:
+		return ErrNotFound
+	case http.StatusConflict:
+		return ErrConflict
+	case http.StatusPreconditionFailed:
+		return ErrPreconditionFailed
+	case http.StatusUnprocessableEntity:
+		return ErrValidation
+	case http.StatusTooManyRequests:
+		return ErrRateLimited
+	}
+	if status >= 500 {
+		return ErrServer
+	}
+	return nil
+}
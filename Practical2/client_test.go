@@ -0,0 +1,228 @@
+// client_test.go
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"crud-testing/client"
+)
+
+// newTestClient serves h and returns a client for it that retries quickly.
+func newTestClient(t *testing.T, h http.Handler, opts ...client.Option) *client.Client {
+	t.Helper()
+
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	c, err := client.New(srv.URL, append([]client.Option{client.WithRetries(3, time.Millisecond)}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestClient_CRUD(t *testing.T) {
+	resetState()
+	c := newTestClient(t, newRouter())
+	ctx := context.Background()
+
+	created, err := c.Create(ctx, client.UserInput{Name: "Alice", Email: "alice@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.ID != 1 || created.Name != "Alice" || created.Email != "alice@example.com" || created.CreatedAt == nil || created.ETag != `"1"` {
+		t.Errorf("wrong user created: %+v", created)
+	}
+
+	user, err := c.Get(ctx, created.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Name != "Alice" || user.ETag != `"1"` {
+		t.Errorf("wrong user returned: %+v", user)
+	}
+
+	user, err = c.Update(ctx, user.ID, client.UserInput{Name: "Alicia", Email: "alicia@example.com"}, client.IfMatch(user.ETag))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Name != "Alicia" || user.Email != "alicia@example.com" || user.ETag != `"2"` {
+		t.Errorf("wrong user after update: %+v", user)
+	}
+
+	user, err = c.Patch(ctx, user.ID, map[string]any{"name": "Ali"}, client.IfMatch(user.ETag))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Name != "Ali" || user.Email != "alicia@example.com" || user.ETag != `"3"` {
+		t.Errorf("wrong user after patch: %+v", user)
+	}
+
+	if err := c.Delete(ctx, user.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Get(ctx, user.ID); !errors.Is(err, client.ErrNotFound) {
+		t.Errorf("wrong error after delete: got %v want %v", err, client.ErrNotFound)
+	}
+}
+
+func TestClient_Errors(t *testing.T) {
+	resetState()
+	c := newTestClient(t, newRouter())
+	ctx := context.Background()
+	c.Create(ctx, client.UserInput{Name: "Alice", Email: "alice@example.com"})
+
+	t.Run("Not found", func(t *testing.T) {
+		_, err := c.Get(ctx, 99)
+		var apiErr *client.Error
+		if !errors.As(err, &apiErr) {
+			t.Fatalf("wrong error type: %T", err)
+		}
+		if apiErr.StatusCode != http.StatusNotFound || apiErr.Type != "/problems/user-not-found" {
+			t.Errorf("wrong problem decoded: %+v", apiErr)
+		}
+		if !errors.Is(err, client.ErrNotFound) {
+			t.Errorf("error does not match %v: %v", client.ErrNotFound, err)
+		}
+	})
+
+	t.Run("Validation", func(t *testing.T) {
+		_, err := c.Create(ctx, client.UserInput{Name: "", Email: "nobody@example.com"})
+		var apiErr *client.Error
+		if !errors.As(err, &apiErr) || !errors.Is(err, client.ErrValidation) {
+			t.Fatalf("wrong error: got %v want %v", err, client.ErrValidation)
+		}
+		if len(apiErr.Fields) != 1 || apiErr.Fields[0].Field != "name" {
+			t.Errorf("wrong field errors: %+v", apiErr.Fields)
+		}
+	})
+
+	t.Run("Stale ETag", func(t *testing.T) {
+		_, err := c.Update(ctx, 1, client.UserInput{Name: "Alicia", Email: "alice@example.com"}, client.IfMatch(`"7"`))
+		if !errors.Is(err, client.ErrPreconditionFailed) {
+			t.Errorf("wrong error: got %v want %v", err, client.ErrPreconditionFailed)
+		}
+	})
+}
+
+func TestClient_List(t *testing.T) {
+	resetState()
+	c := newTestClient(t, newRouter())
+	ctx := context.Background()
+	for _, name := range []string{"Alice", "Bob", "Carol", "Dave", "Erin"} {
+		c.Create(ctx, client.UserInput{Name: name, Email: strings.ToLower(name) + "@example.com"})
+	}
+
+	var pages, users int
+	for page, err := range c.List(ctx, client.ListOptions{Limit: 2}) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if page.Total != 5 {
+			t.Errorf("wrong total: got %v want %v", page.Total, 5)
+		}
+		pages++
+		users += len(page.Users)
+	}
+	if pages != 3 || users != 5 {
+		t.Errorf("wrong pages listed: got %v pages of %v users, want 3 pages of 5", pages, users)
+	}
+
+	page, err := c.ListPage(ctx, client.ListOptions{Sort: "-name", Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Users) != 3 || page.Users[0].Name != "Dave" {
+		t.Errorf("wrong page returned: %+v", page)
+	}
+}
+
+func TestClient_Retries(t *testing.T) {
+	resetState()
+	router := newRouter()
+	ctx := context.Background()
+
+	t.Run("Unavailable server", func(t *testing.T) {
+		var failures atomic.Int32
+		failures.Store(2)
+		c := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if failures.Add(-1) >= 0 {
+				http.Error(w, "unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			router.ServeHTTP(w, r)
+		}))
+
+		if _, err := c.ListPage(ctx, client.ListOptions{}); err != nil {
+			t.Errorf("call was not retried: %v", err)
+		}
+	})
+
+	t.Run("Lost create response", func(t *testing.T) {
+		// The first create succeeds but its response is replaced by a
+		// gateway error, as if the connection had dropped
+		var lost atomic.Bool
+		c := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "POST" && lost.CompareAndSwap(false, true) {
+				router.ServeHTTP(httptest.NewRecorder(), r)
+				http.Error(w, "bad gateway", http.StatusBadGateway)
+				return
+			}
+			router.ServeHTTP(w, r)
+		}))
+
+		user, err := c.Create(ctx, client.UserInput{Name: "Alice", Email: "alice@example.com"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count, _ := memStore.Count(); count != 1 || user.ID != 1 {
+			t.Errorf("create was not idempotent: %v users stored, got ID %v", count, user.ID)
+		}
+	})
+
+	t.Run("Client errors are final", func(t *testing.T) {
+		var calls atomic.Int32
+		c := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			router.ServeHTTP(w, r)
+		}))
+
+		c.Get(ctx, 99)
+		if got := calls.Load(); got != 1 {
+			t.Errorf("wrong number of attempts: got %v want %v", got, 1)
+		}
+	})
+
+	t.Run("Retries give up", func(t *testing.T) {
+		c := newTestClient(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		}))
+
+		if _, err := c.Get(ctx, 1); !errors.Is(err, client.ErrServer) {
+			t.Errorf("wrong error: got %v want %v", err, client.ErrServer)
+		}
+	})
+}
+
+func TestClient_Auth(t *testing.T) {
+	resetState()
+	enableAuth(t)
+	ctx := context.Background()
+
+	anonymous := newTestClient(t, newRouter())
+	if _, err := anonymous.ListPage(ctx, client.ListOptions{}); !errors.Is(err, client.ErrUnauthorized) {
+		t.Errorf("wrong error: got %v want %v", err, client.ErrUnauthorized)
+	}
+
+	admin := newTestClient(t, newRouter(), client.WithToken(mintToken(t, "1", "admin", time.Hour)))
+	if _, err := admin.Create(ctx, client.UserInput{Name: "Alice", Email: "alice@example.com"}); err != nil {
+		t.Errorf("authenticated call failed: %v", err)
+	}
+}
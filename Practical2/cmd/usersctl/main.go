@@ -0,0 +1,26 @@
+// main.go
+
+// Command usersctl manages the users of a running users API. Run
+// "usersctl -h" for its commands and flags.
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"crud-testing/usersctl"
+)
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	code := usersctl.Run(ctx, os.Args[1:], usersctl.Env{
+		Getenv: os.Getenv,
+		Stdin:  os.Stdin,
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	})
+	stop()
+	os.Exit(code)
+}
@@ -0,0 +1,199 @@
+// config.go
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// Config holds the settings of the users API binary. Each one can be set
+// with a flag or, when the flag is absent, an environment variable.
+type Config struct {
+	Addr            string
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	IdleTimeout     time.Duration
+	ShutdownTimeout time.Duration
+	MaxHeaderBytes  int
+	DatabaseURL     string
+	// JWTHMACSecret and JWTRSAPublicKeyFile configure bearer token
+	// verification. Authentication is off when both are empty.
+	JWTHMACSecret       string
+	JWTRSAPublicKeyFile string
+	// RateLimit is the sustained number of requests per second allowed
+	// per client, with bursts up to RateBurst. Zero disables limiting.
+	RateLimit float64
+	RateBurst int
+	// IPRateLimit and IPRateBurst limit requests per remote IP before
+	// they are authenticated, so bad tokens cannot be sent without
+	// limit. Zero disables it.
+	IPRateLimit  float64
+	IPRateBurst  int
+	RedisURL     string
+	MaxBodyBytes int64
+	// IdempotencyTTL is how long responses are kept for replay to
+	// requests that repeat an Idempotency-Key.
+	IdempotencyTTL time.Duration
+	// OpenAPIValidation is off, warn or strict; see NewOpenAPIValidator.
+	OpenAPIValidation string
+	// Webhook deliveries are attempted up to WebhookMaxAttempts times,
+	// starting WebhookBackoff apart and doubling after each failure.
+	WebhookMaxAttempts int
+	WebhookBackoff     time.Duration
+	WebhookTimeout     time.Duration
+	// WebhookAllowPrivate lets webhooks reach loopback, private and
+	// link-local addresses, for receivers on the same network.
+	WebhookAllowPrivate bool
+	// DataDir keeps the in-memory store across restarts in a WAL and
+	// snapshots; empty keeps nothing. WALSync is always, interval or
+	// never; see the walSync constants.
+	DataDir          string
+	WALSync          string
+	WALSyncInterval  time.Duration
+	SnapshotInterval time.Duration
+	// Deleted users are purged DeletedRetention after deletion, checked
+	// every PurgeInterval.
+	DeletedRetention time.Duration
+	PurgeInterval    time.Duration
+	// GRPCAddr is where the gRPC user service listens; empty disables it.
+	GRPCAddr string
+	// V1Sunset is the date announced in the Sunset header of /v1, after
+	// which v1 may be removed.
+	V1Sunset time.Time
+}
+
+// loadConfig parses args, falling back to getenv and then to defaults.
+func loadConfig(args []string, getenv func(string) string) (Config, error) {
+	fs := flag.NewFlagSet("users-api", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+
+	var cfg Config
+	var errs []error
+	str := func(p *string, name, env, def, usage string) {
+		if v := getenv(env); v != "" {
+			def = v
+		}
+		fs.StringVar(p, name, def, usage+" (env "+env+")")
+	}
+	dur := func(p *time.Duration, name, env string, def time.Duration, usage string) {
+		def, err := envOr(getenv, env, def, time.ParseDuration)
+		errs = append(errs, err)
+		fs.DurationVar(p, name, def, usage+" (env "+env+")")
+	}
+	num := func(p *int, name, env string, def int, usage string) {
+		def, err := envOr(getenv, env, def, strconv.Atoi)
+		errs = append(errs, err)
+		fs.IntVar(p, name, def, usage+" (env "+env+")")
+	}
+	num64 := func(p *int64, name, env string, def int64, usage string) {
+		def, err := envOr(getenv, env, def, func(v string) (int64, error) { return strconv.ParseInt(v, 10, 64) })
+		errs = append(errs, err)
+		fs.Int64Var(p, name, def, usage+" (env "+env+")")
+	}
+	float := func(p *float64, name, env string, def float64, usage string) {
+		def, err := envOr(getenv, env, def, func(v string) (float64, error) { return strconv.ParseFloat(v, 64) })
+		errs = append(errs, err)
+		fs.Float64Var(p, name, def, usage+" (env "+env+")")
+	}
+	boolean := func(p *bool, name, env string, def bool, usage string) {
+		def, err := envOr(getenv, env, def, strconv.ParseBool)
+		errs = append(errs, err)
+		fs.BoolVar(p, name, def, usage+" (env "+env+")")
+	}
+	parseDate := func(v string) (time.Time, error) { return time.Parse(time.DateOnly, v) }
+	date := func(p *time.Time, name, env string, def time.Time, usage string) {
+		def, err := envOr(getenv, env, def, parseDate)
+		errs = append(errs, err)
+		*p = def
+		fs.Func(name, usage+" (env "+env+")", func(v string) (err error) {
+			*p, err = parseDate(v)
+			return err
+		})
+	}
+
+	str(&cfg.Addr, "addr", "USERS_ADDR", ":3000", "address to listen on")
+	dur(&cfg.ReadTimeout, "read-timeout", "USERS_READ_TIMEOUT", 10*time.Second, "maximum duration for reading a request")
+	dur(&cfg.WriteTimeout, "write-timeout", "USERS_WRITE_TIMEOUT", 30*time.Second, "maximum duration for writing a response")
+	dur(&cfg.IdleTimeout, "idle-timeout", "USERS_IDLE_TIMEOUT", 120*time.Second, "how long keep-alive connections stay open")
+	dur(&cfg.ShutdownTimeout, "shutdown-timeout", "USERS_SHUTDOWN_TIMEOUT", 15*time.Second, "how long to drain requests on shutdown")
+	num(&cfg.MaxHeaderBytes, "max-header-bytes", "USERS_MAX_HEADER_BYTES", 1<<20, "maximum size of request headers")
+	str(&cfg.DatabaseURL, "database-url", "DATABASE_URL", "", "Postgres connection string; empty keeps users in memory")
+	str(&cfg.JWTHMACSecret, "jwt-hmac-secret", "USERS_JWT_HMAC_SECRET", "", "secret for HS256 bearer tokens")
+	str(&cfg.JWTRSAPublicKeyFile, "jwt-rsa-public-key", "USERS_JWT_RSA_PUBLIC_KEY", "", "PEM file with the public key for RS256 bearer tokens")
+	float(&cfg.RateLimit, "rate-limit", "USERS_RATE_LIMIT", 0, "requests per second allowed per client; 0 disables rate limiting")
+	num(&cfg.RateBurst, "rate-burst", "USERS_RATE_BURST", 20, "largest burst of requests allowed per client")
+	float(&cfg.IPRateLimit, "ip-rate-limit", "USERS_IP_RATE_LIMIT", 0, "requests per second allowed per remote IP before authentication; 0 disables it")
+	num(&cfg.IPRateBurst, "ip-rate-burst", "USERS_IP_RATE_BURST", 100, "largest burst of requests allowed per remote IP before authentication")
+	str(&cfg.RedisURL, "redis-url", "USERS_REDIS_URL", "", "Redis URL for shared rate limits; empty keeps them in memory")
+	dur(&cfg.IdempotencyTTL, "idempotency-ttl", "USERS_IDEMPOTENCY_TTL", 24*time.Hour, "how long responses are replayed for a repeated Idempotency-Key")
+	str(&cfg.OpenAPIValidation, "openapi-validation", "USERS_OPENAPI_VALIDATION", openAPIOff, "check traffic against the OpenAPI document: off, warn or strict")
+	num(&cfg.WebhookMaxAttempts, "webhook-max-attempts", "USERS_WEBHOOK_MAX_ATTEMPTS", 8, "attempts per webhook delivery before it is dead-lettered")
+	dur(&cfg.WebhookBackoff, "webhook-backoff", "USERS_WEBHOOK_BACKOFF", time.Second, "delay before the first webhook retry, doubled for each later one")
+	dur(&cfg.WebhookTimeout, "webhook-timeout", "USERS_WEBHOOK_TIMEOUT", 10*time.Second, "timeout of a single webhook delivery attempt")
+	boolean(&cfg.WebhookAllowPrivate, "webhook-allow-private", "USERS_WEBHOOK_ALLOW_PRIVATE", false, "let webhooks reach loopback, private and link-local addresses")
+	str(&cfg.DataDir, "data-dir", "USERS_DATA_DIR", "", "directory for the WAL and snapshots of the in-memory store; empty keeps users only in memory")
+	str(&cfg.WALSync, "wal-sync", "USERS_WAL_SYNC", walSyncAlways, "when to fsync the WAL: always, interval or never")
+	dur(&cfg.WALSyncInterval, "wal-sync-interval", "USERS_WAL_SYNC_INTERVAL", time.Second, "how often to fsync the WAL with -wal-sync=interval")
+	dur(&cfg.SnapshotInterval, "snapshot-interval", "USERS_SNAPSHOT_INTERVAL", 5*time.Minute, "how often to snapshot the in-memory store and trim the WAL")
+	dur(&cfg.DeletedRetention, "deleted-retention", "USERS_DELETED_RETENTION", 30*24*time.Hour, "how long deleted users can be restored before they are purged")
+	dur(&cfg.PurgeInterval, "purge-interval", "USERS_PURGE_INTERVAL", time.Hour, "how often to purge deleted users")
+	str(&cfg.GRPCAddr, "grpc-addr", "USERS_GRPC_ADDR", "", "address for the gRPC user service, e.g. :9090; empty disables it")
+	date(&cfg.V1Sunset, "v1-sunset", "USERS_V1_SUNSET", time.Date(2027, time.April, 17, 0, 0, 0, 0, time.UTC), "date after which /v1 may be removed, as YYYY-MM-DD")
+	num64(&cfg.MaxBodyBytes, "max-body-bytes", "USERS_MAX_BODY_BYTES", 1<<20, "maximum size of request bodies; 0 disables the limit")
+
+	if err := errors.Join(errs...); err != nil {
+		return Config{}, err
+	}
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+	if cfg.MaxHeaderBytes <= 0 {
+		return Config{}, fmt.Errorf("max header bytes must be positive")
+	}
+	if cfg.RateLimit < 0 || cfg.RateBurst < 1 || cfg.IPRateLimit < 0 || cfg.IPRateBurst < 1 {
+		return Config{}, fmt.Errorf("rate limits must not be negative and bursts must be positive")
+	}
+	if cfg.IdempotencyTTL <= 0 {
+		return Config{}, fmt.Errorf("idempotency TTL must be positive")
+	}
+	if cfg.MaxBodyBytes < 0 {
+		return Config{}, fmt.Errorf("max body bytes must not be negative")
+	}
+	if cfg.WebhookMaxAttempts < 1 || cfg.WebhookBackoff <= 0 || cfg.WebhookTimeout <= 0 {
+		return Config{}, fmt.Errorf("webhook attempts, backoff and timeout must be positive")
+	}
+	if cfg.DeletedRetention <= 0 || cfg.PurgeInterval <= 0 {
+		return Config{}, fmt.Errorf("deleted retention and purge interval must be positive")
+	}
+	switch cfg.WALSync {
+	case walSyncAlways, walSyncInterval, walSyncNever:
+	default:
+		return Config{}, fmt.Errorf("WAL sync must be always, interval or never")
+	}
+	if cfg.WALSyncInterval <= 0 || cfg.SnapshotInterval <= 0 {
+		return Config{}, fmt.Errorf("WAL sync and snapshot intervals must be positive")
+	}
+	switch cfg.OpenAPIValidation {
+	case openAPIOff, openAPIWarn, openAPIStrict:
+	default:
+		return Config{}, fmt.Errorf("OpenAPI validation must be off, warn or strict")
+	}
+	return cfg, nil
+}
+
+// envOr parses the environment variable env, returning def when it is unset.
+func envOr[T any](getenv func(string) string, env string, def T, parse func(string) (T, error)) (T, error) {
+	v := getenv(env)
+	if v == "" {
+		return def, nil
+	}
+	parsed, err := parse(v)
+	if err != nil {
+		return def, fmt.Errorf("%s: %w", env, err)
+	}
+	return parsed, nil
+}
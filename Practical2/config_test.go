@@ -0,0 +1,113 @@
+// config_test.go
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	env := func(vars map[string]string) func(string) string {
+		return func(key string) string { return vars[key] }
+	}
+
+	t.Run("Defaults", func(t *testing.T) {
+		cfg, err := loadConfig(nil, env(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Addr != ":3000" {
+			t.Errorf("wrong default addr: got %v want %v", cfg.Addr, ":3000")
+		}
+		if cfg.ShutdownTimeout != 15*time.Second {
+			t.Errorf("wrong default shutdown timeout: got %v want %v", cfg.ShutdownTimeout, 15*time.Second)
+		}
+		if cfg.MaxHeaderBytes != 1<<20 {
+			t.Errorf("wrong default max header bytes: got %v want %v", cfg.MaxHeaderBytes, 1<<20)
+		}
+		if cfg.GRPCAddr != "" {
+			t.Errorf("gRPC is enabled by default: got addr %v", cfg.GRPCAddr)
+		}
+		if cfg.WebhookAllowPrivate {
+			t.Error("webhooks may reach private addresses by default")
+		}
+	})
+
+	t.Run("Environment", func(t *testing.T) {
+		cfg, err := loadConfig(nil, env(map[string]string{
+			"USERS_ADDR":                  ":8080",
+			"USERS_READ_TIMEOUT":          "2s",
+			"USERS_MAX_HEADER_BYTES":      "4096",
+			"DATABASE_URL":                "postgres://localhost/users",
+			"USERS_V1_SUNSET":             "2027-01-31",
+			"USERS_WEBHOOK_ALLOW_PRIVATE": "true",
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Addr != ":8080" || cfg.ReadTimeout != 2*time.Second || cfg.MaxHeaderBytes != 4096 {
+			t.Errorf("environment was not applied: %+v", cfg)
+		}
+		if cfg.DatabaseURL != "postgres://localhost/users" {
+			t.Errorf("wrong database URL: got %v", cfg.DatabaseURL)
+		}
+		if want := time.Date(2027, time.January, 31, 0, 0, 0, 0, time.UTC); !cfg.V1Sunset.Equal(want) {
+			t.Errorf("wrong v1 sunset: got %v want %v", cfg.V1Sunset, want)
+		}
+		if !cfg.WebhookAllowPrivate {
+			t.Error("USERS_WEBHOOK_ALLOW_PRIVATE was not applied")
+		}
+	})
+
+	t.Run("Limits", func(t *testing.T) {
+		cfg, err := loadConfig(
+			[]string{"-rate-burst", "5", "-ip-rate-limit", "50"},
+			env(map[string]string{"USERS_RATE_LIMIT": "2.5", "USERS_MAX_BODY_BYTES": "512"}),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.RateLimit != 2.5 || cfg.RateBurst != 5 || cfg.IPRateLimit != 50 || cfg.IPRateBurst != 100 || cfg.MaxBodyBytes != 512 {
+			t.Errorf("limits were not applied: %+v", cfg)
+		}
+	})
+
+	t.Run("Flags override environment", func(t *testing.T) {
+		cfg, err := loadConfig(
+			[]string{"-addr", ":9090", "-write-timeout", "5s"},
+			env(map[string]string{"USERS_ADDR": ":8080"}),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.Addr != ":9090" || cfg.WriteTimeout != 5*time.Second {
+			t.Errorf("flags were not applied: %+v", cfg)
+		}
+	})
+
+	t.Run("Invalid values", func(t *testing.T) {
+		invalid := []struct {
+			args []string
+			env  map[string]string
+		}{
+			{nil, map[string]string{"USERS_IDLE_TIMEOUT": "forever"}},
+			{nil, map[string]string{"USERS_MAX_HEADER_BYTES": "lots"}},
+			{[]string{"-max-header-bytes", "0"}, nil},
+			{[]string{"-unknown"}, nil},
+			{nil, map[string]string{"USERS_RATE_LIMIT": "-1"}},
+			{nil, map[string]string{"USERS_RATE_BURST": "0"}},
+			{nil, map[string]string{"USERS_IP_RATE_LIMIT": "-1"}},
+			{[]string{"-max-body-bytes", "-5"}, nil},
+			{nil, map[string]string{"USERS_OPENAPI_VALIDATION": "loose"}},
+			{[]string{"-webhook-max-attempts", "0"}, nil},
+			{[]string{"-wal-sync", "sometimes"}, nil},
+			{[]string{"-v1-sunset", "next year"}, nil},
+			{nil, map[string]string{"USERS_WEBHOOK_ALLOW_PRIVATE": "sometimes"}},
+		}
+		for _, tc := range invalid {
+			if _, err := loadConfig(tc.args, env(tc.env)); err == nil {
+				t.Errorf("loadConfig(%v, %v) succeeded, want error", tc.args, tc.env)
+			}
+		}
+	})
+}
@@ -0,0 +1,349 @@
+// dispatcher.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Headers sent with every webhook delivery.
+const (
+	webhookIDHeader        = "X-Webhook-ID"
+	webhookDeliveryHeader  = "X-Webhook-Delivery"
+	webhookEventHeader     = "X-Webhook-Event"
+	webhookTimestampHeader = "X-Webhook-Timestamp"
+	webhookSignatureHeader = "X-Webhook-Signature"
+)
+
+const (
+	// maxWebhookBackoff caps the delay between delivery attempts.
+	maxWebhookBackoff = 10 * time.Minute
+	// webhookWorkers is how many deliveries run at once.
+	webhookWorkers = 8
+)
+
+// WebhookPayload is the JSON body of a delivery. Data is the user as the
+// API version of the webhook shows it.
+type WebhookPayload struct {
+	ID        uint64    `json:"id"`
+	Type      string    `json:"type"`
+	CreatedAt time.Time `json:"created_at"`
+	Data      any       `json:"data"`
+}
+
+// SignWebhook returns the signature of a delivery: the hex HMAC-SHA256 of
+// the timestamp, a dot and the body, keyed with the webhook's secret.
+// Receivers should recompute it and reject stale timestamps.
+func SignWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Dispatcher delivers events from a feed to the webhooks that subscribe
+// to them. Failed deliveries are retried with exponential backoff and end
+// up on the dead-letter list once the attempts run out.
+type Dispatcher struct {
+	store       *WebhookStore
+	feed        *EventFeed
+	client      *http.Client
+	maxAttempts int
+	backoff     time.Duration
+	workers     chan struct{}
+	cursor      uint64
+	now         func() time.Time
+}
+
+// NewDispatcher returns a dispatcher that makes up to maxAttempts attempts
+// per delivery, waiting backoff before the first retry and twice as long
+// before each one after it. At most workers attempts run at once;
+// deliveries waiting to retry do not count. Only events published after
+// the dispatcher is created are delivered. Unless allowPrivate is set,
+// deliveries to internal addresses fail.
+func NewDispatcher(store *WebhookStore, feed *EventFeed, maxAttempts int, backoff, timeout time.Duration, workers int, allowPrivate bool) *Dispatcher {
+	return &Dispatcher{
+		store:       store,
+		feed:        feed,
+		client:      newWebhookClient(timeout, allowPrivate),
+		maxAttempts: maxAttempts,
+		backoff:     backoff,
+		workers:     make(chan struct{}, workers),
+		cursor:      feed.LastID(),
+		now:         time.Now,
+	}
+}
+
+// errInternalAddress is returned when a webhook URL resolves to an address
+// webhooks must not reach.
+var errInternalAddress = errors.New("webhook address is loopback, private or link-local")
+
+// newWebhookClient returns the client deliveries are sent with. Unless
+// allowPrivate is set it checks every address it connects to rather than
+// the URL, so a name that resolves to an internal address is refused too.
+// It does not follow redirects, which could lead anywhere; a redirect
+// fails the attempt like any other 3xx response. Proxies are not used, as
+// the checked address would be the proxy's.
+func newWebhookClient(timeout time.Duration, allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout}
+	if !allowPrivate {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			addr, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			if internalAddr(addr.Addr()) {
+				return errInternalAddress
+			}
+			return nil
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// Run dispatches events until ctx is done or the feed is closed, then
+// waits for deliveries in progress to stop.
+func (d *Dispatcher) Run(ctx context.Context) {
+	wake, stop := d.feed.Subscribe()
+	defer stop()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-d.feed.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		events, next, complete := d.feed.Since(d.cursor)
+		if !complete {
+			d.deadLetterSkipped(d.cursor, next-uint64(len(events)))
+		}
+		for _, event := range events {
+			eventType := webhookEventTypes[event.Type]
+			for _, hook := range d.store.subscribers(eventType) {
+				select {
+				case d.workers <- struct{}{}:
+				case <-ctx.Done():
+					return
+				}
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					d.deliver(ctx, hook, eventType, event)
+				}()
+			}
+		}
+		d.cursor = next
+
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// deadLetterSkipped records the events after cursor up to and including
+// last, which dropped out of the feed before the dispatcher read them.
+// Their types are lost with them, so every active webhook gets a dead
+// letter for each.
+func (d *Dispatcher) deadLetterSkipped(cursor, last uint64) {
+	logger.Error("webhook dispatcher fell behind the event feed, events were dead-lettered",
+		slog.Uint64("first_event", cursor+1),
+		slog.Uint64("last_event", last),
+	)
+	for _, hook := range d.store.List() {
+		if !hook.Active {
+			continue
+		}
+		for id := cursor + 1; id <= last; id++ {
+			d.store.addDeadLetter(DeadLetter{
+				WebhookID: hook.ID,
+				EventID:   id,
+				LastError: "event dropped from the feed before it could be delivered",
+				FailedAt:  d.now().UTC(),
+			})
+		}
+	}
+}
+
+// deliver sends one event to one webhook, retrying until it succeeds, the
+// receiver rejects it, or the attempts run out. It is called holding a
+// worker slot, which it gives up while it waits to retry and releases when
+// it returns, so failing receivers do not hold up other deliveries.
+func (d *Dispatcher) deliver(ctx context.Context, hook Webhook, eventType string, event UserEvent) {
+	held := true
+	defer func() {
+		if held {
+			<-d.workers
+		}
+	}()
+
+	body, err := json.Marshal(WebhookPayload{
+		ID:        event.ID,
+		Type:      eventType,
+		CreatedAt: event.Time,
+		Data:      versionNamed(hook.APIVersion).user(event.User),
+	})
+	if err != nil {
+		logger.Error("could not encode webhook payload", slog.Any("error", err))
+		return
+	}
+
+	deliveryID := newRequestID()
+	for attempt := 1; ; attempt++ {
+		// Pick up secret and URL changes, and stop if the webhook is gone
+		current, err := d.store.Get(hook.ID)
+		if err != nil {
+			return
+		}
+		hook = current
+
+		start := d.now()
+		status, err := d.post(ctx, hook, deliveryID, eventType, body)
+		entry := Delivery{
+			DeliveryID: deliveryID,
+			WebhookID:  hook.ID,
+			EventID:    event.ID,
+			Event:      eventType,
+			Attempt:    attempt,
+			StatusCode: status,
+			DurationMS: d.now().Sub(start).Milliseconds(),
+			At:         start.UTC(),
+		}
+		if err == nil && status >= 300 {
+			err = fmt.Errorf("receiver responded with %d %s", status, http.StatusText(status))
+		}
+		if err != nil {
+			entry.Error = err.Error()
+		}
+		d.store.logDelivery(entry)
+
+		if err == nil {
+			return
+		}
+		if ctx.Err() != nil {
+			// Shutting down; the delivery is neither done nor dead
+			return
+		}
+		if !retryable(status) || attempt >= d.maxAttempts {
+			d.store.addDeadLetter(DeadLetter{
+				DeliveryID: deliveryID,
+				WebhookID:  hook.ID,
+				EventID:    event.ID,
+				Event:      eventType,
+				Payload:    body,
+				Attempts:   attempt,
+				LastError:  err.Error(),
+				FailedAt:   d.now().UTC(),
+			})
+			logger.Warn("webhook delivery failed",
+				slog.Int("webhook_id", hook.ID),
+				slog.String("delivery_id", deliveryID),
+				slog.Int("attempts", attempt),
+				slog.Any("error", err),
+			)
+			return
+		}
+
+		if held = d.pause(ctx, d.retryDelay(attempt)); !held {
+			return
+		}
+	}
+}
+
+// pause releases the caller's worker slot for delay and then takes one
+// again. It reports false, holding no slot, if ctx is done first.
+func (d *Dispatcher) pause(ctx context.Context, delay time.Duration) bool {
+	<-d.workers
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		return false
+	}
+
+	select {
+	case d.workers <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// post makes one delivery attempt. It returns the response status, which
+// is 0 when no response was received.
+func (d *Dispatcher) post(ctx context.Context, hook Webhook, deliveryID, eventType string, body []byte) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(d.now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "users-api-webhooks")
+	req.Header.Set(webhookIDHeader, strconv.Itoa(hook.ID))
+	req.Header.Set(webhookDeliveryHeader, deliveryID)
+	req.Header.Set(webhookEventHeader, eventType)
+	req.Header.Set(webhookTimestampHeader, timestamp)
+	req.Header.Set(webhookSignatureHeader, SignWebhook(hook.Secret, timestamp, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	return resp.StatusCode, nil
+}
+
+// retryable reports whether a failed attempt is worth repeating. Client
+// errors other than timeouts and rate limiting mean the receiver rejected
+// the delivery.
+func retryable(status int) bool {
+	if status < 400 || status >= 500 {
+		return true
+	}
+	return status == http.StatusRequestTimeout || status == http.StatusTooManyRequests
+}
+
+// retryDelay returns how long to wait after the given attempt.
+func (d *Dispatcher) retryDelay(attempt int) time.Duration {
+	delay := d.backoff
+	for i := 1; i < attempt && delay < maxWebhookBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, maxWebhookBackoff)
+}
@@ -0,0 +1,59 @@
+// etag.go
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// userETag returns the strong entity tag for the stored version of user.
+func userETag(user User) string {
+	return `"` + strconv.Itoa(user.Version) + `"`
+}
+
+// etagMatches reports whether header, an If-Match or If-None-Match value,
+// lists etag or is "*". Weak comparison ignores the W/ prefix, as
+// If-None-Match requires; strong comparison never matches a weak tag.
+func etagMatches(header, etag string, weak bool) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			return true
+		}
+		if weak {
+			tag = strings.TrimPrefix(tag, "W/")
+			etag = strings.TrimPrefix(etag, "W/")
+		}
+		if tag == etag && !strings.HasPrefix(tag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// ifMatchVersion evaluates the If-Match header of r for the user with the
+// given ID. It returns the version a write must still find when it
+// happens, 0 when the header is absent, or ErrVersionMismatch when the
+// condition is false.
+func ifMatchVersion(r *http.Request, id int) (int, error) {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return 0, nil
+	}
+
+	current, err := store.Get(id)
+	if errors.Is(err, ErrUserNotFound) {
+		// If-Match is false when there is no current representation
+		return 0, ErrVersionMismatch
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if !etagMatches(header, userETag(current), false) {
+		return 0, ErrVersionMismatch
+	}
+	return current.Version, nil
+}
@@ -0,0 +1,143 @@
+// etag_test.go
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// serve sends a request with the given headers through the full router.
+func serve(t *testing.T, method, url, body string, headers map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	req, err := http.NewRequest(method, url, bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	rr := httptest.NewRecorder()
+	newRouter().ServeHTTP(rr, req)
+	return rr
+}
+
+func TestUserETags(t *testing.T) {
+	resetState()
+
+	created := serve(t, "POST", "/v1/users", `{"name": "Alice"}`, nil)
+	etag := created.Header().Get("ETag")
+	if etag != `"1"` {
+		t.Fatalf("create returned wrong ETag: got %v want %v", etag, `"1"`)
+	}
+
+	t.Run("GET returns the ETag", func(t *testing.T) {
+		rr := serve(t, "GET", "/v1/users/1", "", nil)
+		if got := rr.Header().Get("ETag"); got != etag {
+			t.Errorf("handler returned wrong ETag: got %v want %v", got, etag)
+		}
+	})
+
+	t.Run("If-None-Match returns 304", func(t *testing.T) {
+		rr := serve(t, "GET", "/v1/users/1", "", map[string]string{"If-None-Match": "W/" + etag})
+		if status := rr.Code; status != http.StatusNotModified {
+			t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusNotModified)
+		}
+		if rr.Body.Len() != 0 {
+			t.Errorf("304 response had a body: %q", rr.Body)
+		}
+	})
+
+	t.Run("Stale If-None-Match returns the user", func(t *testing.T) {
+		rr := serve(t, "GET", "/v1/users/1", "", map[string]string{"If-None-Match": `"0"`})
+		if status := rr.Code; status != http.StatusOK {
+			t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+		}
+	})
+
+	t.Run("PUT with matching If-Match", func(t *testing.T) {
+		rr := serve(t, "PUT", "/v1/users/1", `{"name": "Alicia"}`, map[string]string{"If-Match": etag})
+		if status := rr.Code; status != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+		}
+		if got := rr.Header().Get("ETag"); got != `"2"` {
+			t.Errorf("handler returned wrong ETag: got %v want %v", got, `"2"`)
+		}
+	})
+
+	t.Run("PUT with stale If-Match", func(t *testing.T) {
+		rr := serve(t, "PUT", "/v1/users/1", `{"name": "Lost Update"}`, map[string]string{"If-Match": etag})
+		if status := rr.Code; status != http.StatusPreconditionFailed {
+			t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusPreconditionFailed)
+		}
+		if peekUser(1).Name != "Alicia" {
+			t.Errorf("stale PUT modified the user: got %v", peekUser(1).Name)
+		}
+	})
+
+	t.Run("PATCH with stale If-Match", func(t *testing.T) {
+		rr := serve(t, "PATCH", "/v1/users/1", `{"name": "Lost Update"}`, map[string]string{
+			"Content-Type": mediaTypeMergePatch,
+			"If-Match":     etag,
+		})
+		if status := rr.Code; status != http.StatusPreconditionFailed {
+			t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusPreconditionFailed)
+		}
+	})
+
+	t.Run("PATCH with matching If-Match", func(t *testing.T) {
+		rr := serve(t, "PATCH", "/v1/users/1", `{"name": "Ali"}`, map[string]string{
+			"Content-Type": mediaTypeMergePatch,
+			"If-Match":     `"1", "2"`,
+		})
+		if status := rr.Code; status != http.StatusOK {
+			t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+		}
+	})
+
+	t.Run("DELETE with stale If-Match", func(t *testing.T) {
+		rr := serve(t, "DELETE", "/v1/users/1", "", map[string]string{"If-Match": etag})
+		if status := rr.Code; status != http.StatusPreconditionFailed {
+			t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusPreconditionFailed)
+		}
+	})
+
+	t.Run("DELETE with wildcard If-Match", func(t *testing.T) {
+		rr := serve(t, "DELETE", "/v1/users/1", "", map[string]string{"If-Match": "*"})
+		if status := rr.Code; status != http.StatusNoContent {
+			t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusNoContent)
+		}
+	})
+
+	t.Run("If-Match on a missing user", func(t *testing.T) {
+		rr := serve(t, "PUT", "/v1/users/1", `{"name": "Ghost"}`, map[string]string{"If-Match": "*"})
+		if status := rr.Code; status != http.StatusPreconditionFailed {
+			t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusPreconditionFailed)
+		}
+	})
+}
+
+func TestETagMatches(t *testing.T) {
+	testCases := []struct {
+		header string
+		etag   string
+		weak   bool
+		want   bool
+	}{
+		{`"1"`, `"1"`, false, true},
+		{`"1"`, `"2"`, false, false},
+		{`"1", "2"`, `"2"`, false, true},
+		{`*`, `"2"`, false, true},
+		{`W/"1"`, `"1"`, false, false},
+		{`W/"1"`, `"1"`, true, true},
+	}
+
+	for _, tc := range testCases {
+		if got := etagMatches(tc.header, tc.etag, tc.weak); got != tc.want {
+			t.Errorf("etagMatches(%s, %s, %v) = %v want %v", tc.header, tc.etag, tc.weak, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,232 @@
+// events.go
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Types of the events published to the change feed.
+const (
+	EventCreated  = "created"
+	EventUpdated  = "updated"
+	EventDeleted  = "deleted"
+	EventRestored = "restored"
+)
+
+// defaultEventHistory is how many events the feed keeps for clients that
+// reconnect with Last-Event-ID.
+const defaultEventHistory = 1024
+
+// eventHeartbeat is how often an idle stream sends a comment line, so
+// proxies do not close it.
+var eventHeartbeat = 15 * time.Second
+
+// userEvents is the change feed that user handlers publish to.
+var userEvents = NewEventFeed(defaultEventHistory)
+
+// UserEvent is a change to a user. IDs increase by one with each event.
+type UserEvent struct {
+	ID   uint64
+	Type string
+	User User
+	Time time.Time
+}
+
+// EventFeed keeps the most recent events in a ring buffer and wakes up
+// subscribers when a new one is published.
+type EventFeed struct {
+	mu      sync.Mutex
+	ring    []UserEvent
+	lastID  uint64
+	waiters map[chan struct{}]struct{}
+	done    chan struct{}
+	closed  bool
+}
+
+// NewEventFeed returns a feed that remembers the last size events.
+func NewEventFeed(size int) *EventFeed {
+	return &EventFeed{
+		ring:    make([]UserEvent, size),
+		waiters: make(map[chan struct{}]struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// Publish assigns the next ID to an event and stores it.
+func (f *EventFeed) Publish(eventType string, user User) UserEvent {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.lastID++
+	event := UserEvent{ID: f.lastID, Type: eventType, User: user, Time: time.Now().UTC()}
+	f.ring[int((f.lastID-1)%uint64(len(f.ring)))] = event
+
+	for ch := range f.waiters {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+	return event
+}
+
+// Since returns the buffered events after id and the ID to resume from
+// next time. It reports false when the events after id are not all in the
+// buffer: they were dropped, or id is from before a restart.
+func (f *EventFeed) Since(id uint64) ([]UserEvent, uint64, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if id > f.lastID {
+		return nil, f.lastID, false
+	}
+	oldest := uint64(1)
+	if f.lastID > uint64(len(f.ring)) {
+		oldest = f.lastID - uint64(len(f.ring)) + 1
+	}
+	complete := id+1 >= oldest
+	if !complete {
+		id = oldest - 1
+	}
+
+	var events []UserEvent
+	for next := id + 1; next <= f.lastID; next++ {
+		events = append(events, f.ring[int((next-1)%uint64(len(f.ring)))])
+	}
+	return events, f.lastID, complete
+}
+
+// LastID returns the ID of the most recent event, or 0 if there is none.
+func (f *EventFeed) LastID() uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.lastID
+}
+
+// Subscribe returns a channel that receives a value after each publish,
+// and a function that stops the subscription. Several publishes may be
+// collapsed into one wake-up, so subscribers read events with Since.
+func (f *EventFeed) Subscribe() (<-chan struct{}, func()) {
+	ch := make(chan struct{}, 1)
+	f.mu.Lock()
+	f.waiters[ch] = struct{}{}
+	f.mu.Unlock()
+
+	return ch, func() {
+		f.mu.Lock()
+		delete(f.waiters, ch)
+		f.mu.Unlock()
+	}
+}
+
+// Done is closed when the feed is closed.
+func (f *EventFeed) Done() <-chan struct{} {
+	return f.done
+}
+
+// Close ends every subscriber's stream. It is registered to run when the
+// server shuts down, which would otherwise wait for streams to finish.
+func (f *EventFeed) Close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.closed {
+		f.closed = true
+		close(f.done)
+	}
+}
+
+// publishUser adds a change to the feed. Stores call it as they commit;
+// see UserStore.
+func publishUser(eventType string, user User) {
+	userEvents.Publish(eventType, user)
+}
+
+// userEventsHandler handles GET /users/events. It streams changes as
+// Server-Sent Events, starting after Last-Event-ID when the client sends
+// one. If events since then are no longer buffered, a "reset" event tells
+// the client to reload the full list before the stream continues.
+func userEventsHandler(w http.ResponseWriter, r *http.Request) {
+	lastID := userEvents.LastID()
+	if v := r.Header.Get("Last-Event-ID"); v != "" {
+		id, err := strconv.ParseUint(strings.TrimSpace(v), 10, 64)
+		if err != nil {
+			writeProblem(w, r, Problem{
+				Type:   problemInvalidEventID,
+				Title:  "Invalid Last-Event-ID",
+				Status: http.StatusBadRequest,
+				Detail: "Last-Event-ID must be the ID of a previous event.",
+			})
+			return
+		}
+		lastID = id
+	}
+
+	v := versionFrom(r.Context())
+	wake, stop := userEvents.Subscribe()
+	defer stop()
+
+	rc := http.NewResponseController(w)
+	// Streams outlive the server's write timeout.
+	rc.SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(eventHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		events, next, complete := userEvents.Since(lastID)
+		if !complete {
+			resumeID := next - uint64(len(events))
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: reset\ndata: {}\n\n", resumeID); err != nil {
+				return
+			}
+		}
+		for _, event := range events {
+			if err := writeUserEvent(w, v, event); err != nil {
+				return
+			}
+		}
+		lastID = next
+		if err := rc.Flush(); err != nil {
+			return
+		}
+
+		select {
+		case <-wake:
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		case <-userEvents.Done():
+			return
+		}
+	}
+}
+
+// writeUserEvent sends event with the user as v shows it.
+func writeUserEvent(w http.ResponseWriter, v *apiVersion, event UserEvent) error {
+	data, err := json.Marshal(v.user(event.User))
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+	return err
+}
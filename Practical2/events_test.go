@@ -0,0 +1,277 @@
+// events_test.go
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type sseEvent struct {
+	id, event, data string
+}
+
+// readEvent reads the next event from an SSE stream, skipping comments.
+func readEvent(t *testing.T, r *bufio.Reader) sseEvent {
+	t.Helper()
+
+	var ev sseEvent
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading event stream: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			if ev != (sseEvent{}) {
+				return ev
+			}
+		case strings.HasPrefix(line, ":"):
+		case strings.HasPrefix(line, "id: "):
+			ev.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			ev.event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			ev.data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
+
+// newEventServer starts the router on a real listener, since streams need
+// flushing. It is closed after the streams opened on it.
+func newEventServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	srv := httptest.NewServer(newRouter())
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// openEvents connects to the change feed of srv.
+func openEvents(t *testing.T, srv *httptest.Server, lastEventID string) *bufio.Reader {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", srv.URL+"/v1/users/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", resp.StatusCode, http.StatusOK)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("handler returned wrong content type: got %v want %v", ct, "text/event-stream")
+	}
+	return bufio.NewReader(resp.Body)
+}
+
+func TestEventFeed(t *testing.T) {
+	feed := NewEventFeed(3)
+	for _, name := range []string{"A", "B", "C", "D"} {
+		feed.Publish(EventCreated, User{Name: name})
+	}
+
+	tests := []struct {
+		since    uint64
+		ids      []uint64
+		next     uint64
+		complete bool
+	}{
+		{since: 4, ids: nil, next: 4, complete: true},
+		{since: 2, ids: []uint64{3, 4}, next: 4, complete: true},
+		{since: 1, ids: []uint64{2, 3, 4}, next: 4, complete: true},
+		{since: 0, ids: []uint64{2, 3, 4}, next: 4, complete: false},
+		{since: 9, ids: nil, next: 4, complete: false},
+	}
+	for _, tt := range tests {
+		events, next, complete := feed.Since(tt.since)
+		var ids []uint64
+		for _, e := range events {
+			ids = append(ids, e.ID)
+		}
+		if len(ids) != len(tt.ids) || next != tt.next || complete != tt.complete {
+			t.Errorf("Since(%d) = %v, %v, %v; want %v, %v, %v", tt.since, ids, next, complete, tt.ids, tt.next, tt.complete)
+			continue
+		}
+		for i := range ids {
+			if ids[i] != tt.ids[i] {
+				t.Errorf("Since(%d) returned IDs %v, want %v", tt.since, ids, tt.ids)
+				break
+			}
+		}
+	}
+}
+
+func TestUserEventsStream(t *testing.T) {
+	resetState()
+	memStore.now = (&fakeClock{t: time.Unix(1700000000, 0)}).now
+	srv := newEventServer(t)
+
+	stream := openEvents(t, srv, "")
+
+	serve(t, "POST", "/v1/users", `{"name": "Alice"}`, nil)
+	serve(t, "PUT", "/v1/users/1", `{"name": "Alicia"}`, nil)
+	serve(t, "PATCH", "/v1/users/1", `{"name": "Ali"}`, map[string]string{"Content-Type": "application/merge-patch+json"})
+	serve(t, "DELETE", "/v1/users/1", "", nil)
+	serve(t, "DELETE", "/v1/users/1", "", nil)
+
+	want := []sseEvent{
+		{"1", EventCreated, `{"id":1,"name":"Alice"}`},
+		{"2", EventUpdated, `{"id":1,"name":"Alicia"}`},
+		{"3", EventUpdated, `{"id":1,"name":"Ali"}`},
+		{"4", EventDeleted, `{"id":1,"name":"Ali","deleted_at":"2023-11-14T22:13:20Z"}`},
+	}
+	for _, w := range want {
+		if got := readEvent(t, stream); got != w {
+			t.Errorf("wrong event: got %+v want %+v", got, w)
+		}
+	}
+}
+
+func TestUserEventsBatch(t *testing.T) {
+	resetState()
+	setUser(User{ID: 1, Name: "Alice", Version: 1})
+	memStore.nextID = 2
+	memStore.now = (&fakeClock{t: time.Unix(1700000000, 0)}).now
+	srv := newEventServer(t)
+
+	stream := openEvents(t, srv, "")
+	serve(t, "POST", "/v1/users:batch", `{"operations": [
+		{"op": "create", "user": {"name": "Bob"}},
+		{"op": "delete", "id": 1}
+	]}`, nil)
+
+	// A failed atomic batch publishes nothing
+	serve(t, "POST", "/v1/users:batch", `{"operations": [
+		{"op": "create", "user": {"name": "Carol"}},
+		{"op": "delete", "id": 1}
+	]}`, nil)
+	serve(t, "POST", "/v1/users", `{"name": "Dave"}`, nil)
+
+	want := []sseEvent{
+		{"1", EventCreated, `{"id":2,"name":"Bob"}`},
+		{"2", EventDeleted, `{"id":1,"name":"Alice","deleted_at":"2023-11-14T22:13:20Z"}`},
+		{"3", EventCreated, `{"id":3,"name":"Dave"}`},
+	}
+	for _, w := range want {
+		if got := readEvent(t, stream); got != w {
+			t.Errorf("wrong event: got %+v want %+v", got, w)
+		}
+	}
+}
+
+func TestUserEventsCommitOrder(t *testing.T) {
+	resetState()
+	created, _ := store.Create(User{Name: "Alice"})
+
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			store.Update(created.ID, User{Name: fmt.Sprintf("Alice %d", i)}, 0)
+		}()
+	}
+	wg.Wait()
+
+	// Each event must show a newer user than the one before it
+	events, _, _ := userEvents.Since(0)
+	for i := 1; i < len(events); i++ {
+		if events[i].User.Version <= events[i-1].User.Version {
+			t.Fatalf("event %d has version %d after version %d", events[i].ID, events[i].User.Version, events[i-1].User.Version)
+		}
+	}
+	if len(events) != 21 {
+		t.Errorf("wrong number of events: got %d want 21", len(events))
+	}
+}
+
+func TestUserEventsResume(t *testing.T) {
+	resetState()
+	userEvents = NewEventFeed(2)
+	srv := newEventServer(t)
+
+	for _, name := range []string{"Alice", "Bob", "Carol"} {
+		serve(t, "POST", "/v1/users", `{"name": "`+name+`"}`, nil)
+	}
+
+	t.Run("from a buffered event", func(t *testing.T) {
+		stream := openEvents(t, srv, "2")
+		if got := readEvent(t, stream); got.id != "3" || got.event != EventCreated {
+			t.Errorf("wrong event: got %+v want id 3", got)
+		}
+	})
+
+	t.Run("from a dropped event", func(t *testing.T) {
+		stream := openEvents(t, srv, "0")
+		want := []sseEvent{
+			{"1", "reset", "{}"},
+			{"2", EventCreated, `{"id":2,"name":"Bob"}`},
+			{"3", EventCreated, `{"id":3,"name":"Carol"}`},
+		}
+		for _, w := range want {
+			if got := readEvent(t, stream); got != w {
+				t.Errorf("wrong event: got %+v want %+v", got, w)
+			}
+		}
+	})
+
+	t.Run("from before a restart", func(t *testing.T) {
+		stream := openEvents(t, srv, "40")
+		if got := readEvent(t, stream); got.event != "reset" || got.id != "3" {
+			t.Errorf("wrong event: got %+v want reset with id 3", got)
+		}
+	})
+}
+
+func TestUserEventsInvalidLastEventID(t *testing.T) {
+	resetState()
+
+	rr := serve(t, "GET", "/v1/users/events", "", map[string]string{"Last-Event-ID": "abc"})
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestUserEventsClose(t *testing.T) {
+	resetState()
+	srv := newEventServer(t)
+
+	stream := openEvents(t, srv, "")
+	userEvents.Close()
+
+	if _, err := stream.ReadString('\n'); err == nil {
+		t.Error("stream stayed open after the feed was closed")
+	}
+}
+
+func TestUserEventsWithSpecValidation(t *testing.T) {
+	resetState()
+	enableSpecValidation(t)
+	srv := newEventServer(t)
+
+	stream := openEvents(t, srv, "")
+	serve(t, "POST", "/v1/users", `{"name": "Alice"}`, nil)
+
+	if got := readEvent(t, stream); got.event != EventCreated {
+		t.Errorf("wrong event: got %+v want %v", got, EventCreated)
+	}
+}
@@ -0,0 +1,337 @@
+// formats.go
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Media types for user lists, in order of preference.
+const (
+	mediaTypeJSON    = "application/json"
+	mediaTypeCSV     = "text/csv"
+	mediaTypeNDJSON  = "application/x-ndjson"
+	mediaTypeMsgpack = "application/msgpack"
+)
+
+var userListTypes = []string{mediaTypeJSON, mediaTypeCSV, mediaTypeNDJSON, mediaTypeMsgpack}
+
+// negotiate picks the offer the Accept header rates highest, preferring
+// earlier offers on ties. It returns "" when the header rules out every
+// offer, and the first offer when there is no header.
+func negotiate(accept string, offers []string) string {
+	if strings.TrimSpace(accept) == "" {
+		return offers[0]
+	}
+
+	best, bestQ := "", 0.0
+	for _, offer := range offers {
+		if q := acceptQuality(accept, offer); q > bestQ {
+			best, bestQ = offer, q
+		}
+	}
+	return best
+}
+
+// acceptQuality returns the q-value that the most specific matching range
+// in accept gives to mediaType, or 0 if no range matches.
+func acceptQuality(accept, mediaType string) float64 {
+	typ, _, _ := strings.Cut(mediaType, "/")
+	q, specificity := 0.0, -1
+	for _, part := range strings.Split(accept, ",") {
+		rng, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+
+		s := -1
+		switch {
+		case rng == mediaType:
+			s = 2
+		case rng == typ+"/*":
+			s = 1
+		case rng == "*/*":
+			s = 0
+		}
+		if s <= specificity {
+			continue
+		}
+
+		specificity, q = s, 1
+		if v, ok := params["q"]; ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil && parsed >= 0 && parsed <= 1 {
+				q = parsed
+			}
+		}
+	}
+	return q
+}
+
+// negotiateUsers picks the format for a list of users, responding with 406
+// when the client accepts none of them.
+func negotiateUsers(w http.ResponseWriter, r *http.Request) (string, bool) {
+	w.Header().Add("Vary", "Accept")
+	mediaType := negotiate(r.Header.Get("Accept"), userListTypes)
+	if mediaType == "" {
+		writeProblem(w, r, Problem{
+			Type:   problemNotAcceptable,
+			Status: http.StatusNotAcceptable,
+			Detail: "User lists are available as " + strings.Join(userListTypes, ", ") + ".",
+		})
+		return "", false
+	}
+	return mediaType, true
+}
+
+// writeUsers encodes users in the negotiated format, as the API version of
+// r shows them. NDJSON is flushed row by row, so large exports reach the
+// client as they are written.
+func writeUsers(w http.ResponseWriter, r *http.Request, status int, mediaType string, users []User) {
+	v := versionFrom(r.Context())
+	w.Header().Set("Content-Type", mediaType)
+	if mediaType == mediaTypeCSV {
+		w.Header().Set("Content-Type", mediaTypeCSV+"; charset=utf-8")
+	}
+	w.WriteHeader(status)
+
+	switch mediaType {
+	case mediaTypeCSV:
+		cw := csv.NewWriter(w)
+		cw.Write(v.csvHeader())
+		for _, user := range users {
+			cw.Write(v.csvRecord(user))
+		}
+		cw.Flush()
+	case mediaTypeNDJSON:
+		rc := http.NewResponseController(w)
+		enc := json.NewEncoder(w)
+		for _, user := range users {
+			if err := enc.Encode(v.user(user)); err != nil {
+				return
+			}
+			rc.Flush()
+		}
+	case mediaTypeMsgpack:
+		enc := msgpack.NewEncoder(w)
+		enc.SetCustomStructTag("json")
+		enc.Encode(v.users(users))
+	default:
+		json.NewEncoder(w).Encode(v.users(users))
+	}
+}
+
+// isImportType reports whether a POST /users body of this media type holds
+// several users to import rather than a single JSON user.
+func isImportType(mediaType string) bool {
+	return mediaType == mediaTypeCSV || mediaType == mediaTypeNDJSON || mediaType == mediaTypeMsgpack
+}
+
+// decodeUserImport reads the users in an import body. Each user is
+// validated like a single create through v; field errors are reported as
+// "rows.<index>.<field>", counting from 0.
+func decodeUserImport(body io.Reader, mediaType string, v *apiVersion) ([]User, error) {
+	var users []User
+	var fields []FieldError
+	row := func(i int, user User, errs []FieldError) {
+		fields = append(fields, rowFields(i, errs)...)
+		users = append(users, user)
+	}
+
+	switch mediaType {
+	case mediaTypeCSV:
+		if err := decodeCSVUsers(body, v, row); err != nil {
+			return nil, err
+		}
+	case mediaTypeNDJSON:
+		if err := decodeNDJSONUsers(body, v, row); err != nil {
+			return nil, err
+		}
+	case mediaTypeMsgpack:
+		if err := decodeMsgpackUsers(body, v, row); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("cannot import %s", mediaType)
+	}
+
+	if n := len(users); n == 0 || n > maxBatchOperations {
+		fields = append(fields, FieldError{Field: "rows", Message: fmt.Sprintf("must contain between 1 and %d users", maxBatchOperations)})
+	}
+	if len(fields) > 0 {
+		return nil, &ValidationError{Fields: fields}
+	}
+	return users, nil
+}
+
+// importedUser validates one imported user. As with JSON, IDs are assigned
+// by the server.
+func importedUser(v *apiVersion, req userRequest, hasID bool) (User, []FieldError) {
+	req.ID = nil
+	user, fields := v.requestUser(req, 0)
+	if hasID {
+		fields = append([]FieldError{{Field: "id", Message: "must not be set by the client"}}, fields...)
+	}
+	return user, fields
+}
+
+// decodeCSVUsers reads a CSV body whose header row names a "name" column
+// and optionally an "id" column, which must be empty. v2 bodies also need
+// an "email" column.
+func decodeCSVUsers(body io.Reader, v *apiVersion, row func(int, User, []FieldError)) error {
+	cr := csv.NewReader(body)
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	nameCol, idCol, emailCol := -1, -1, -1
+	for i, col := range header {
+		switch name := strings.TrimSpace(col); {
+		case name == "name":
+			nameCol = i
+		case name == "id":
+			idCol = i
+		case name == "email" && v.emails:
+			emailCol = i
+		default:
+			return &ValidationError{Fields: []FieldError{{Field: "columns." + strconv.Itoa(i), Message: "unknown column " + strconv.Quote(col)}}}
+		}
+	}
+	if nameCol < 0 {
+		return &ValidationError{Fields: []FieldError{{Field: "columns", Message: `must include "name"`}}}
+	}
+
+	for i := 0; ; i++ {
+		rec, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		req := userRequest{Name: rec[nameCol]}
+		if emailCol >= 0 {
+			req.Email = &rec[emailCol]
+		}
+		user, fields := importedUser(v, req, idCol >= 0 && rec[idCol] != "")
+		row(i, user, fields)
+	}
+}
+
+// decodeNDJSONUsers reads one JSON user per line, skipping blank lines.
+func decodeNDJSONUsers(body io.Reader, v *apiVersion, row func(int, User, []FieldError)) error {
+	sc := bufio.NewScanner(body)
+	sc.Buffer(nil, 1<<20)
+	for i := 0; sc.Scan(); {
+		line := bytes.TrimSpace(sc.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		user, err := decodeUserJSON(bytes.NewReader(line), 0, v)
+		var verr *ValidationError
+		switch {
+		case errors.As(err, &verr):
+			row(i, User{}, verr.Fields)
+		case err != nil:
+			return fmt.Errorf("line %d: %w", i+1, err)
+		default:
+			row(i, user, nil)
+		}
+		i++
+	}
+	return sc.Err()
+}
+
+// decodeMsgpackUsers reads a MessagePack array of users.
+func decodeMsgpackUsers(body io.Reader, v *apiVersion, row func(int, User, []FieldError)) error {
+	dec := msgpack.NewDecoder(body)
+	dec.SetCustomStructTag("json")
+	dec.DisallowUnknownFields(true)
+
+	var reqs []userRequest
+	if err := dec.Decode(&reqs); err != nil {
+		return err
+	}
+	for i, req := range reqs {
+		user, fields := importedUser(v, req, req.ID != nil)
+		row(i, user, fields)
+	}
+	return nil
+}
+
+// importUsers handles POST /users with a CSV, NDJSON or MessagePack body.
+// The users are created together or not at all, and returned in the
+// format the client accepts.
+func importUsers(w http.ResponseWriter, r *http.Request, mediaType string) {
+	respType, ok := negotiateUsers(w, r)
+	if !ok {
+		return
+	}
+
+	users, err := decodeUserImport(r.Body, mediaType, versionFrom(r.Context()))
+	if err != nil {
+		writeDecodeError(w, r, err)
+		return
+	}
+
+	ops := make([]BatchOp, len(users))
+	for i, user := range users {
+		ops[i] = BatchOp{Op: BatchCreate, User: user}
+	}
+	results, err := store.Batch(ops, true)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+
+	// The other rows of a failed import only report ErrBatchAborted
+	created := make([]User, len(results))
+	for i, res := range results {
+		if res.Err != nil && !errors.Is(res.Err, ErrBatchAborted) {
+			writeImportError(w, r, i, res.Err)
+			return
+		}
+		created[i] = res.User
+	}
+	writeUsers(w, r, http.StatusCreated, respType, created)
+}
+
+// writeImportError reports why the store rejected row i of an import, with
+// field errors named after the row like those of decodeUserImport.
+func writeImportError(w http.ResponseWriter, r *http.Request, i int, err error) {
+	var verr *ValidationError
+	if errors.As(err, &verr) {
+		writeDecodeError(w, r, &ValidationError{Fields: rowFields(i, verr.Fields)})
+		return
+	}
+	if errors.Is(err, ErrEmailTaken) {
+		p := emailTakenProblem()
+		p.Errors = rowFields(i, []FieldError{{Field: "email", Message: "is already taken"}})
+		writeProblem(w, r, p)
+		return
+	}
+	writeStoreError(w, r, err)
+}
+
+// rowFields names field errors of row i of an import "rows.<i>.<field>".
+func rowFields(i int, errs []FieldError) []FieldError {
+	fields := make([]FieldError, len(errs))
+	for j, f := range errs {
+		fields[j] = FieldError{Field: "rows." + strconv.Itoa(i) + "." + f.Field, Message: f.Message}
+	}
+	return fields
+}
@@ -0,0 +1,240 @@
+// formats_test.go
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", mediaTypeJSON},
+		{"*/*", mediaTypeJSON},
+		{"text/csv", mediaTypeCSV},
+		{"text/*", mediaTypeCSV},
+		{"application/x-ndjson, application/json;q=0.5", mediaTypeNDJSON},
+		{"application/json;q=0.1, application/msgpack", mediaTypeMsgpack},
+		{"*/*;q=0.1, text/csv;q=0", mediaTypeJSON},
+		{"application/xml", ""},
+		{"application/*;q=0", ""},
+	}
+	for _, tt := range tests {
+		if got := negotiate(tt.accept, userListTypes); got != tt.want {
+			t.Errorf("negotiate(%q) = %q, want %q", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func seedUsers() {
+	resetState()
+	setUser(User{ID: 1, Name: "Alice", Version: 1})
+	setUser(User{ID: 2, Name: "Bob, Jr.", Version: 1})
+	memStore.nextID = 3
+}
+
+func TestListUsersFormats(t *testing.T) {
+	seedUsers()
+	want := []User{{ID: 1, Name: "Alice"}, {ID: 2, Name: "Bob, Jr."}}
+
+	t.Run("CSV", func(t *testing.T) {
+		rr := serve(t, "GET", "/v1/users", "", map[string]string{"Accept": "text/csv"})
+		if ct := rr.Header().Get("Content-Type"); ct != "text/csv; charset=utf-8" {
+			t.Errorf("handler returned wrong content type: got %v", ct)
+		}
+		records, err := csv.NewReader(rr.Body).ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := [][]string{{"id", "name"}, {"1", "Alice"}, {"2", "Bob, Jr."}}
+		if !reflect.DeepEqual(records, expected) {
+			t.Errorf("handler returned wrong rows: got %v want %v", records, expected)
+		}
+	})
+
+	t.Run("NDJSON", func(t *testing.T) {
+		rr := serve(t, "GET", "/v1/users", "", map[string]string{"Accept": "application/x-ndjson"})
+		if ct := rr.Header().Get("Content-Type"); ct != mediaTypeNDJSON {
+			t.Errorf("handler returned wrong content type: got %v", ct)
+		}
+		var got []User
+		sc := bufio.NewScanner(rr.Body)
+		for sc.Scan() {
+			var u User
+			if err := json.Unmarshal(sc.Bytes(), &u); err != nil {
+				t.Fatalf("line %q is not a JSON user: %v", sc.Text(), err)
+			}
+			got = append(got, u)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("handler returned wrong users: got %v want %v", got, want)
+		}
+	})
+
+	t.Run("MessagePack", func(t *testing.T) {
+		rr := serve(t, "GET", "/v1/users", "", map[string]string{"Accept": "application/msgpack"})
+		if ct := rr.Header().Get("Content-Type"); ct != mediaTypeMsgpack {
+			t.Errorf("handler returned wrong content type: got %v", ct)
+		}
+		var got []map[string]any
+		if err := msgpack.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 2 || got[1]["name"] != "Bob, Jr." {
+			t.Errorf("handler returned wrong users: got %v", got)
+		}
+	})
+
+	t.Run("headers are kept", func(t *testing.T) {
+		rr := serve(t, "GET", "/v1/users?limit=1", "", map[string]string{"Accept": "text/csv"})
+		if rr.Header().Get("X-Total-Count") != "2" || rr.Header().Get("Link") == "" {
+			t.Errorf("pagination headers missing: %v", rr.Header())
+		}
+		if rr.Header().Get("Vary") != "Accept" {
+			t.Errorf("wrong Vary header: got %v want %v", rr.Header().Get("Vary"), "Accept")
+		}
+	})
+
+	t.Run("unsupported type", func(t *testing.T) {
+		rr := serve(t, "GET", "/v1/users", "", map[string]string{"Accept": "application/xml"})
+		if rr.Code != http.StatusNotAcceptable {
+			t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusNotAcceptable)
+		}
+	})
+}
+
+func TestImportUsers(t *testing.T) {
+	packed, err := msgpack.Marshal([]map[string]any{{"name": "Alice"}, {"name": "Bob"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+	}{
+		{"CSV", "text/csv", "name\nAlice\nBob\n"},
+		{"CSV with empty IDs", "text/csv; charset=utf-8", "id,name\n,Alice\n,Bob\n"},
+		{"NDJSON", "application/x-ndjson", "{\"name\": \"Alice\"}\n\n{\"name\": \"Bob\"}\n"},
+		{"MessagePack", "application/msgpack", string(packed)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetState()
+
+			rr := serve(t, "POST", "/v1/users", tt.body, map[string]string{"Content-Type": tt.contentType})
+			if rr.Code != http.StatusCreated {
+				t.Fatalf("handler returned wrong status code: got %v want %v (%s)", rr.Code, http.StatusCreated, rr.Body)
+			}
+			var got []User
+			if err := json.NewDecoder(rr.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			want := []User{{ID: 1, Name: "Alice"}, {ID: 2, Name: "Bob"}}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("handler returned wrong users: got %v want %v", got, want)
+			}
+			if len(storedUsers()) != 2 {
+				t.Errorf("wrong number of stored users: got %v want %v", len(storedUsers()), 2)
+			}
+		})
+	}
+
+	t.Run("response follows Accept", func(t *testing.T) {
+		resetState()
+		rr := serve(t, "POST", "/v1/users", "name\nAlice\n", map[string]string{"Content-Type": "text/csv", "Accept": "text/csv"})
+		if rr.Code != http.StatusCreated || rr.Body.String() != "id,name\n1,Alice\n" {
+			t.Errorf("wrong response: %v %q", rr.Code, rr.Body)
+		}
+	})
+}
+
+func TestImportUsersInvalid(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		status      int
+		fields      []string
+	}{
+		{"invalid rows", "text/csv", "name\nAlice\n\" Bob\"\n\n", 422, []string{"rows.1.name"}},
+		{"IDs set", "text/csv", "id,name\n7,Alice\n", 422, []string{"rows.0.id"}},
+		{"unknown column", "text/csv", "name,email\nAlice,a@example.com\n", 422, []string{"columns.1"}},
+		{"missing name column", "text/csv", "id\n1\n", 422, []string{"columns"}},
+		{"no rows", "text/csv", "name\n", 422, []string{"rows"}},
+		{"ragged CSV", "text/csv", "name\nAlice,extra\n", 400, nil},
+		{"NDJSON field errors", "application/x-ndjson", "{\"name\": \"Alice\"}\n{\"name\": \"\", \"role\": \"x\"}\n", 422, []string{"rows.1.role"}},
+		{"malformed NDJSON", "application/x-ndjson", "{\"name\": \"Alice\"}\n{\n", 400, nil},
+		{"malformed MessagePack", "application/msgpack", "\xc1", 400, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetState()
+
+			rr := serve(t, "POST", "/v1/users", tt.body, map[string]string{"Content-Type": tt.contentType})
+			if rr.Code != tt.status {
+				t.Fatalf("handler returned wrong status code: got %v want %v (%s)", rr.Code, tt.status, rr.Body)
+			}
+			var p Problem
+			json.NewDecoder(rr.Body).Decode(&p)
+			var fields []string
+			for _, f := range p.Errors {
+				fields = append(fields, f.Field)
+			}
+			if !reflect.DeepEqual(fields, tt.fields) {
+				t.Errorf("wrong field errors: got %v want %v", fields, tt.fields)
+			}
+			if len(storedUsers()) != 0 {
+				t.Errorf("users were created from an invalid import: %v", storedUsers())
+			}
+		})
+	}
+
+	t.Run("unacceptable response type", func(t *testing.T) {
+		resetState()
+		rr := serve(t, "POST", "/v1/users", "name\nAlice\n", map[string]string{"Content-Type": "text/csv", "Accept": "application/xml"})
+		if rr.Code != http.StatusNotAcceptable || len(storedUsers()) != 0 {
+			t.Errorf("wrong response: %v, %d users created", rr.Code, len(storedUsers()))
+		}
+	})
+}
+
+// rejectingStore fails the atomic batch of an import at one row, as a
+// backend with its own constraints would.
+type rejectingStore struct {
+	UserStore
+	row int
+	err error
+}
+
+func (s rejectingStore) Batch(ops []BatchOp, atomic bool) ([]BatchResult, error) {
+	results := make([]BatchResult, len(ops))
+	abortBatch(results, s.row)
+	results[s.row].Err = s.err
+	return results, nil
+}
+
+func TestImportUsersRejectedRow(t *testing.T) {
+	resetState()
+	store = rejectingStore{UserStore: memStore, row: 1, err: &ValidationError{Fields: []FieldError{{Field: "name", Message: "is taken"}}}}
+	defer func() { store = memStore }()
+
+	rr := serve(t, "POST", "/v1/users", "name\nAlice\nBob\n", map[string]string{"Content-Type": "text/csv"})
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("handler returned wrong status code: got %v want %v (%s)", rr.Code, http.StatusUnprocessableEntity, rr.Body)
+	}
+	var p Problem
+	json.NewDecoder(rr.Body).Decode(&p)
+	if len(p.Errors) != 1 || p.Errors[0].Field != "rows.1.name" {
+		t.Errorf("problem does not name the failing row: %+v", p)
+	}
+}
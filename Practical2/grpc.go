@@ -0,0 +1,445 @@
+// grpc.go
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"crud-testing/userspb"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// userService implements userspb.UserServiceServer on top of the same store
+// and change feed as the HTTP handlers.
+type userService struct {
+	userspb.UnimplementedUserServiceServer
+}
+
+// newGRPCServer returns a gRPC server with the user service registered,
+// behind the same limits, authentication, logging and metrics as HTTP.
+func newGRPCServer() *grpc.Server {
+	opts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(grpcUnary),
+		grpc.ChainStreamInterceptor(grpcStream),
+	}
+	if maxBodyBytes > 0 {
+		opts = append(opts, grpc.MaxRecvMsgSize(int(maxBodyBytes)))
+	}
+	srv := grpc.NewServer(opts...)
+	userspb.RegisterUserServiceServer(srv, userService{})
+	return srv
+}
+
+// serveGRPC serves until ctx is done, then stops gracefully, cutting off
+// calls still running after shutdownTimeout.
+func serveGRPC(ctx context.Context, srv *grpc.Server, ln net.Listener, shutdownTimeout time.Duration) error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- srv.Serve(ln)
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		srv.GracefulStop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(shutdownTimeout):
+		srv.Stop()
+	}
+	return nil
+}
+
+func (userService) Get(ctx context.Context, req *userspb.GetUserRequest) (*userspb.User, error) {
+	id, err := grpcUserID(req.GetId())
+	if err != nil {
+		return nil, err
+	}
+	if err := grpcRequireSelfOrAdmin(ctx, id); err != nil {
+		return nil, err
+	}
+
+	user, err := store.Get(id)
+	if err != nil {
+		return nil, grpcStoreError(ctx, err)
+	}
+	return toProto(user), nil
+}
+
+func (userService) List(req *userspb.ListUsersRequest, stream grpc.ServerStreamingServer[userspb.User]) error {
+	if err := grpcRequireAdmin(stream.Context()); err != nil {
+		return err
+	}
+
+	// Share the REST validation by reading the request as query parameters
+	values := url.Values{}
+	if req.GetLimit() != 0 {
+		values.Set("limit", strconv.Itoa(int(req.GetLimit())))
+	}
+	if req.GetOffset() != 0 {
+		values.Set("offset", strconv.Itoa(int(req.GetOffset())))
+	}
+	values.Set("sort", req.GetSort())
+	values.Set("name", req.GetName())
+	q, err := parseListQuery(values)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	page, _, err := listPage(q)
+	if err != nil {
+		return grpcStoreError(stream.Context(), err)
+	}
+	for _, user := range page {
+		if err := stream.Send(toProto(user)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (userService) Create(ctx context.Context, req *userspb.CreateUserRequest) (*userspb.User, error) {
+	if err := grpcRequireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	user := User{Name: req.GetName()}
+	if fields := validateUser(user); len(fields) > 0 {
+		return nil, grpcValidationError(fields)
+	}
+
+	user, err := store.Create(user)
+	if err != nil {
+		return nil, grpcStoreError(ctx, err)
+	}
+	return toProto(user), nil
+}
+
+func (userService) Update(ctx context.Context, req *userspb.UpdateUserRequest) (*userspb.User, error) {
+	id, err := grpcUserID(req.GetId())
+	if err != nil {
+		return nil, err
+	}
+	if err := grpcRequireSelfOrAdmin(ctx, id); err != nil {
+		return nil, err
+	}
+
+	user := User{ID: id, Name: req.GetName()}
+	if fields := validateUser(user); len(fields) > 0 {
+		return nil, grpcValidationError(fields)
+	}
+
+	user, err = store.Update(id, user, int(req.GetExpectVersion()))
+	if err != nil {
+		return nil, grpcStoreError(ctx, err)
+	}
+	return toProto(user), nil
+}
+
+func (userService) Delete(ctx context.Context, req *userspb.DeleteUserRequest) (*emptypb.Empty, error) {
+	id, err := grpcUserID(req.GetId())
+	if err != nil {
+		return nil, err
+	}
+	if err := grpcRequireAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	if err := store.Delete(id, int(req.GetExpectVersion())); err != nil {
+		return nil, grpcStoreError(ctx, err)
+	}
+	return &emptypb.Empty{}, nil
+}
+
+// Watch streams the change feed like GET /users/events, ending with
+// UNAVAILABLE when the server shuts down.
+func (userService) Watch(req *userspb.WatchUsersRequest, stream grpc.ServerStreamingServer[userspb.UserEvent]) error {
+	ctx := stream.Context()
+	if err := grpcRequireAdmin(ctx); err != nil {
+		return err
+	}
+
+	feed := userEvents
+	wake, stop := feed.Subscribe()
+	defer stop()
+
+	// Send headers now, so clients know the stream is subscribed
+	if err := stream.SendHeader(metadata.MD{}); err != nil {
+		return err
+	}
+
+	lastID := feed.LastID()
+	if req.LastEventId != nil {
+		lastID = req.GetLastEventId()
+	}
+
+	for {
+		events, next, complete := feed.Since(lastID)
+		if !complete {
+			reset := &userspb.UserEvent{Id: next - uint64(len(events)), Type: userspb.UserEvent_RESET}
+			if err := stream.Send(reset); err != nil {
+				return err
+			}
+		}
+		for _, event := range events {
+			if err := stream.Send(toProtoEvent(event)); err != nil {
+				return err
+			}
+		}
+		lastID = next
+
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return nil
+		case <-feed.Done():
+			return status.Error(codes.Unavailable, "the server is shutting down")
+		}
+	}
+}
+
+func toProto(user User) *userspb.User {
+	return &userspb.User{Id: int64(user.ID), Name: user.Name, Version: int64(user.Version)}
+}
+
+var protoEventTypes = map[string]userspb.UserEvent_Type{
+	EventCreated:  userspb.UserEvent_CREATED,
+	EventUpdated:  userspb.UserEvent_UPDATED,
+	EventDeleted:  userspb.UserEvent_DELETED,
+	EventRestored: userspb.UserEvent_RESTORED,
+}
+
+func toProtoEvent(event UserEvent) *userspb.UserEvent {
+	return &userspb.UserEvent{
+		Id:   event.ID,
+		Type: protoEventTypes[event.Type],
+		User: toProto(event.User),
+		Time: timestamppb.New(event.Time),
+	}
+}
+
+// grpcUserID checks a user ID from a request.
+func grpcUserID(id int64) (int, error) {
+	if id <= 0 {
+		return 0, grpcValidationError([]FieldError{{Field: "id", Message: "must be a positive integer"}})
+	}
+	return int(id), nil
+}
+
+// grpcValidationError returns INVALID_ARGUMENT with the failing fields as
+// BadRequest details.
+func grpcValidationError(fields []FieldError) error {
+	st := status.New(codes.InvalidArgument, "one or more fields are invalid")
+	details := &errdetails.BadRequest{}
+	for _, f := range fields {
+		details.FieldViolations = append(details.FieldViolations, &errdetails.BadRequest_FieldViolation{
+			Field:       f.Field,
+			Description: f.Message,
+		})
+	}
+	if withDetails, err := st.WithDetails(details); err == nil {
+		st = withDetails
+	}
+	return st.Err()
+}
+
+// grpcStoreError maps store errors to status codes the way writeStoreError
+// maps them to HTTP statuses.
+func grpcStoreError(ctx context.Context, err error) error {
+	switch {
+	case errors.Is(err, ErrUserNotFound):
+		return status.Error(codes.NotFound, "user not found")
+	case errors.Is(err, ErrVersionMismatch):
+		return status.Error(codes.FailedPrecondition, "the user has changed since the expected version")
+	case errors.Is(err, ErrEmailTaken):
+		return status.Error(codes.AlreadyExists, "another user already has this email address")
+	}
+	loggerFrom(ctx).Error("internal error", slog.Any("error", err))
+	return status.Error(codes.Internal, "an unexpected error occurred")
+}
+
+// grpcAuthenticate checks the bearer token in the authorization metadata
+// and stores its claims in the context. It does nothing while
+// authentication is disabled.
+func grpcAuthenticate(ctx context.Context) (context.Context, error) {
+	if authKeys == nil {
+		return ctx, nil
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	var tokenString string
+	if values := md.Get("authorization"); len(values) > 0 {
+		tokenString, _ = strings.CutPrefix(values[0], "Bearer ")
+	}
+	if tokenString == "" {
+		return nil, status.Error(codes.Unauthenticated, "a bearer token is required")
+	}
+
+	claims, err := authKeys.parse(tokenString)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, "the bearer token is invalid: "+err.Error())
+	}
+	return context.WithValue(ctx, claimsKey{}, claims), nil
+}
+
+// grpcAdmit is the gRPC counterpart of the HTTP middleware in apiRoutes:
+// it limits the peer by address, authenticates it, and then limits it by
+// subject.
+func grpcAdmit(ctx context.Context) (context.Context, error) {
+	ip := grpcPeerIP(ctx)
+	if err := grpcRateLimit(ctx, ipRateLimiter, "preauth:"+ip); err != nil {
+		return nil, err
+	}
+	ctx, err := grpcAuthenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	key := "ip:" + ip
+	if claims, ok := claimsFrom(ctx); ok && claims.Subject != "" {
+		key = "sub:" + claims.Subject
+	}
+	if err := grpcRateLimit(ctx, rateLimiter, key); err != nil {
+		return nil, err
+	}
+	return ctx, nil
+}
+
+// grpcRateLimit returns RESOURCE_EXHAUSTED once key is over limiter. Like
+// limitWith it lets the call through if the limiter fails.
+func grpcRateLimit(ctx context.Context, limiter RateLimiter, key string) error {
+	if limiter == nil {
+		return nil
+	}
+	res, err := limiter.Allow(ctx, key)
+	if err != nil {
+		rateLimiterErrors.Inc()
+		loggerFrom(ctx).Error("rate limiter failed", slog.Any("error", err))
+		return nil
+	}
+	if !res.Allowed {
+		return status.Errorf(codes.ResourceExhausted, "rate limit exceeded; retry after %d seconds", ceilSeconds(res.RetryAfter))
+	}
+	return nil
+}
+
+func grpcPeerIP(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
+
+// grpcObserve gives the call a request-scoped logger and returns a func
+// that logs the call and records it in the gRPC metrics once it is done.
+func grpcObserve(ctx context.Context, method string) (context.Context, func(error)) {
+	id := ""
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(requestIDHeader); len(values) > 0 {
+			id = values[0]
+		}
+	}
+	if !validRequestID(id) {
+		id = newRequestID()
+	}
+	grpc.SetHeader(ctx, metadata.Pairs(requestIDHeader, id))
+
+	l := logger.With(slog.String("request_id", id))
+	ctx = context.WithValue(ctx, loggerKey{}, l)
+	grpcRequestsInFlight.Inc()
+	start := time.Now()
+
+	return ctx, func(err error) {
+		grpcRequestsInFlight.Dec()
+		code := status.Code(err)
+		grpcRequestsTotal.WithLabelValues(method, code.String()).Inc()
+		grpcRequestDuration.WithLabelValues(method, code.String()).Observe(time.Since(start).Seconds())
+
+		level := slog.LevelInfo
+		if code == codes.Internal || code == codes.Unknown {
+			level = slog.LevelError
+		}
+		l.LogAttrs(ctx, level, "grpc request",
+			slog.String("method", method),
+			slog.String("code", code.String()),
+			slog.Duration("duration", time.Since(start)),
+			slog.String("peer", grpcPeerIP(ctx)),
+		)
+	}
+}
+
+func grpcUnary(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp any, err error) {
+	ctx, done := grpcObserve(ctx, info.FullMethod)
+	defer func() { done(err) }()
+
+	if ctx, err = grpcAdmit(ctx); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func grpcStream(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	ctx, done := grpcObserve(ss.Context(), info.FullMethod)
+	defer func() { done(err) }()
+
+	if ctx, err = grpcAdmit(ctx); err != nil {
+		return err
+	}
+	return handler(srv, &contextStream{ServerStream: ss, ctx: ctx})
+}
+
+// contextStream carries the call's context into stream handlers.
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextStream) Context() context.Context { return s.ctx }
+
+// grpcRequireAdmin is the gRPC counterpart of requireAdmin.
+func grpcRequireAdmin(ctx context.Context) error {
+	if authKeys == nil {
+		return nil
+	}
+	if claims, ok := claimsFrom(ctx); !ok || !claims.IsAdmin() {
+		return status.Error(codes.PermissionDenied, "you are not allowed to access this resource")
+	}
+	return nil
+}
+
+// grpcRequireSelfOrAdmin is the gRPC counterpart of requireSelfOrAdmin.
+func grpcRequireSelfOrAdmin(ctx context.Context, id int) error {
+	if authKeys == nil {
+		return nil
+	}
+	claims, ok := claimsFrom(ctx)
+	if !ok || (!claims.IsAdmin() && !isSubject(claims, strconv.Itoa(id))) {
+		return status.Error(codes.PermissionDenied, "you are not allowed to access this resource")
+	}
+	return nil
+}
@@ -0,0 +1,392 @@
+// grpc_test.go
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"crud-testing/userspb"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+)
+
+// newGRPCClient serves the user service over an in-memory listener for one
+// test and returns a client connected to it.
+func newGRPCClient(t *testing.T) userspb.UserServiceClient {
+	t.Helper()
+
+	ln := bufconn.Listen(1 << 20)
+	srv := newGRPCServer()
+	go srv.Serve(ln)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return ln.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		srv.Stop()
+	})
+	return userspb.NewUserServiceClient(conn)
+}
+
+// listGRPCUsers collects a List stream.
+func listGRPCUsers(t *testing.T, client userspb.UserServiceClient, req *userspb.ListUsersRequest) ([]*userspb.User, error) {
+	t.Helper()
+
+	stream, err := client.List(context.Background(), req)
+	if err != nil {
+		return nil, err
+	}
+	var users []*userspb.User
+	for {
+		user, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return users, nil
+		}
+		if err != nil {
+			return users, err
+		}
+		users = append(users, user)
+	}
+}
+
+func TestGRPCUserService(t *testing.T) {
+	resetState()
+	client := newGRPCClient(t)
+	ctx := context.Background()
+
+	created, err := client.Create(ctx, &userspb.CreateUserRequest{Name: "Alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.GetId() != 1 || created.GetName() != "Alice" || created.GetVersion() != 1 {
+		t.Errorf("wrong created user: %v", created)
+	}
+
+	got, err := client.Get(ctx, &userspb.GetUserRequest{Id: created.GetId()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.GetName() != "Alice" {
+		t.Errorf("wrong user: got %v want %v", got.GetName(), "Alice")
+	}
+
+	updated, err := client.Update(ctx, &userspb.UpdateUserRequest{Id: 1, Name: "Alicia", ExpectVersion: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.GetName() != "Alicia" || updated.GetVersion() != 2 {
+		t.Errorf("wrong updated user: %v", updated)
+	}
+
+	// The REST API sees the same store
+	rr := serve(t, "GET", "/v1/users/1", "", nil)
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	_, err = client.Update(ctx, &userspb.UpdateUserRequest{Id: 1, Name: "Al", ExpectVersion: 1})
+	if code := status.Code(err); code != codes.FailedPrecondition {
+		t.Errorf("stale update returned wrong code: got %v want %v", code, codes.FailedPrecondition)
+	}
+
+	if _, err := client.Delete(ctx, &userspb.DeleteUserRequest{Id: 1}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Get(ctx, &userspb.GetUserRequest{Id: 1})
+	if code := status.Code(err); code != codes.NotFound {
+		t.Errorf("deleted user returned wrong code: got %v want %v", code, codes.NotFound)
+	}
+}
+
+func TestGRPCErrors(t *testing.T) {
+	resetState()
+	client := newGRPCClient(t)
+	ctx := context.Background()
+
+	testCases := []struct {
+		name  string
+		call  func() error
+		code  codes.Code
+		field string
+	}{
+		{"Get missing user", func() error {
+			_, err := client.Get(ctx, &userspb.GetUserRequest{Id: 42})
+			return err
+		}, codes.NotFound, ""},
+		{"Get invalid ID", func() error {
+			_, err := client.Get(ctx, &userspb.GetUserRequest{Id: 0})
+			return err
+		}, codes.InvalidArgument, "id"},
+		{"Create empty name", func() error {
+			_, err := client.Create(ctx, &userspb.CreateUserRequest{Name: "  "})
+			return err
+		}, codes.InvalidArgument, "name"},
+		{"Update missing user", func() error {
+			_, err := client.Update(ctx, &userspb.UpdateUserRequest{Id: 42, Name: "Bob"})
+			return err
+		}, codes.NotFound, ""},
+		{"Delete missing user", func() error {
+			_, err := client.Delete(ctx, &userspb.DeleteUserRequest{Id: 42})
+			return err
+		}, codes.NotFound, ""},
+		{"List invalid sort", func() error {
+			_, err := listGRPCUsers(t, client, &userspb.ListUsersRequest{Sort: "email"})
+			return err
+		}, codes.InvalidArgument, ""},
+		{"List negative limit", func() error {
+			_, err := listGRPCUsers(t, client, &userspb.ListUsersRequest{Limit: -1})
+			return err
+		}, codes.InvalidArgument, ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.call()
+			st := status.Convert(err)
+			if st.Code() != tc.code {
+				t.Fatalf("wrong code: got %v want %v (%v)", st.Code(), tc.code, err)
+			}
+			if tc.field == "" {
+				return
+			}
+			for _, d := range st.Details() {
+				if br, ok := d.(*errdetails.BadRequest); ok {
+					for _, v := range br.GetFieldViolations() {
+						if v.GetField() == tc.field {
+							return
+						}
+					}
+				}
+			}
+			t.Errorf("no violation reported for field %q: %v", tc.field, st.Details())
+		})
+	}
+}
+
+func TestGRPCList(t *testing.T) {
+	resetState()
+	client := newGRPCClient(t)
+	for _, name := range []string{"Carol", "alice", "Bob", "Dave"} {
+		store.Create(User{Name: name})
+	}
+
+	users, err := listGRPCUsers(t, client, &userspb.ListUsersRequest{Sort: "name", Limit: 2, Offset: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, user := range users {
+		names = append(names, user.GetName())
+	}
+	if len(names) != 2 || names[0] != "Bob" || names[1] != "Carol" {
+		t.Errorf("wrong page: got %v want %v", names, []string{"Bob", "Carol"})
+	}
+
+	users, err = listGRPCUsers(t, client, &userspb.ListUsersRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 4 {
+		t.Errorf("wrong number of users: got %v want %v", len(users), 4)
+	}
+}
+
+func TestGRPCWatch(t *testing.T) {
+	resetState()
+	client := newGRPCClient(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := client.Watch(ctx, &userspb.WatchUsersRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Wait for the server to subscribe before publishing
+	if _, err := stream.Header(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Changes made over REST and gRPC both reach the stream
+	serve(t, "POST", "/v1/users", `{"name":"Alice"}`, nil)
+	if _, err := client.Update(ctx, &userspb.UpdateUserRequest{Id: 1, Name: "Alicia"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Delete(ctx, &userspb.DeleteUserRequest{Id: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		typ  userspb.UserEvent_Type
+		name string
+	}{
+		{userspb.UserEvent_CREATED, "Alice"},
+		{userspb.UserEvent_UPDATED, "Alicia"},
+		{userspb.UserEvent_DELETED, "Alicia"},
+	}
+	for i, w := range want {
+		event, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if event.GetId() != uint64(i+1) || event.GetType() != w.typ || event.GetUser().GetName() != w.name {
+			t.Errorf("wrong event %d: got %v", i, event)
+		}
+	}
+
+	// Resuming replays the events after the given ID
+	resumed, err := client.Watch(ctx, &userspb.WatchUsersRequest{LastEventId: proto.Uint64(2)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	event, err := resumed.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.GetId() != 3 || event.GetType() != userspb.UserEvent_DELETED {
+		t.Errorf("wrong resumed event: got %v", event)
+	}
+
+	// An ID from before a restart asks the client to reload
+	reset, err := client.Watch(ctx, &userspb.WatchUsersRequest{LastEventId: proto.Uint64(99)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	event, err = reset.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.GetType() != userspb.UserEvent_RESET || event.GetId() != 3 {
+		t.Errorf("wrong reset event: got %v", event)
+	}
+
+	userEvents.Close()
+	if _, err := stream.Recv(); status.Code(err) != codes.Unavailable {
+		t.Errorf("closed feed returned wrong error: got %v want %v", err, codes.Unavailable)
+	}
+}
+
+func TestGRPCAuthorization(t *testing.T) {
+	resetState()
+	enableAuth(t)
+	client := newGRPCClient(t)
+	store.Create(User{Name: "Alice"})
+
+	withToken := func(token string) context.Context {
+		return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+token)
+	}
+	admin := withToken(mintToken(t, "100", RoleAdmin, time.Hour))
+	alice := withToken(mintToken(t, "1", "user", time.Hour))
+	expired := withToken(mintToken(t, "1", "user", -time.Hour))
+
+	testCases := []struct {
+		name string
+		call func() error
+		code codes.Code
+	}{
+		{"No token", func() error {
+			_, err := client.Get(context.Background(), &userspb.GetUserRequest{Id: 1})
+			return err
+		}, codes.Unauthenticated},
+		{"Expired token", func() error {
+			_, err := client.Get(expired, &userspb.GetUserRequest{Id: 1})
+			return err
+		}, codes.Unauthenticated},
+		{"Self can get", func() error {
+			_, err := client.Get(alice, &userspb.GetUserRequest{Id: 1})
+			return err
+		}, codes.OK},
+		{"Other user is denied", func() error {
+			_, err := client.Get(alice, &userspb.GetUserRequest{Id: 2})
+			return err
+		}, codes.PermissionDenied},
+		{"User cannot create", func() error {
+			_, err := client.Create(alice, &userspb.CreateUserRequest{Name: "Mallory"})
+			return err
+		}, codes.PermissionDenied},
+		{"Admin can create", func() error {
+			_, err := client.Create(admin, &userspb.CreateUserRequest{Name: "Bob"})
+			return err
+		}, codes.OK},
+		{"User cannot list", func() error {
+			stream, err := client.List(alice, &userspb.ListUsersRequest{})
+			if err != nil {
+				return err
+			}
+			_, err = stream.Recv()
+			return err
+		}, codes.PermissionDenied},
+		{"Stream without token", func() error {
+			stream, err := client.List(context.Background(), &userspb.ListUsersRequest{})
+			if err != nil {
+				return err
+			}
+			_, err = stream.Recv()
+			return err
+		}, codes.Unauthenticated},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if code := status.Code(tc.call()); code != tc.code {
+				t.Errorf("wrong code: got %v want %v", code, tc.code)
+			}
+		})
+	}
+}
+
+func TestGRPCRateLimit(t *testing.T) {
+	resetState()
+	enableAuth(t)
+	ipRateLimiter = NewMemoryRateLimiter(1, 2)
+	defer func() { ipRateLimiter = nil }()
+	client := newGRPCClient(t)
+
+	// Bad tokens use up the peer's bucket as they do over HTTP
+	bad := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer not-a-token")
+	for i := 0; i < 2; i++ {
+		if _, err := client.Get(bad, &userspb.GetUserRequest{Id: 1}); status.Code(err) != codes.Unauthenticated {
+			t.Fatalf("call %d: wrong code: got %v want %v", i, status.Code(err), codes.Unauthenticated)
+		}
+	}
+	admin := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+mintToken(t, "100", RoleAdmin, time.Hour))
+	if _, err := client.Get(admin, &userspb.GetUserRequest{Id: 1}); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("wrong code: got %v want %v", status.Code(err), codes.ResourceExhausted)
+	}
+}
+
+func TestGRPCMetrics(t *testing.T) {
+	resetState()
+	client := newGRPCClient(t)
+
+	counter := grpcRequestsTotal.WithLabelValues(userspb.UserService_Get_FullMethodName, codes.NotFound.String())
+	before := testutil.ToFloat64(counter)
+
+	var header metadata.MD
+	client.Get(context.Background(), &userspb.GetUserRequest{Id: 1}, grpc.Header(&header))
+	if got := testutil.ToFloat64(counter) - before; got != 1 {
+		t.Errorf("wrong grpc_requests_total increase: got %v want %v", got, 1)
+	}
+	if ids := header.Get(requestIDHeader); len(ids) != 1 || !validRequestID(ids[0]) {
+		t.Errorf("missing request ID header: %v", header)
+	}
+}
@@ -2,130 +2,287 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"io"
+	"mime"
 	"net/http"
 	"strconv"
-	"sync"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 )
 
-// User defines the structure for a user.
+// User defines the structure for a user. Each API version shows a subset
+// of it; see versions.go.
 type User struct {
 	ID   int    `json:"id"`
 	Name string `json:"name"`
+	// Email is empty for users created through v1 and not updated since.
+	Email     string    `json:"email,omitempty"`
+	CreatedAt time.Time `json:"created_at,omitzero"`
+	UpdatedAt time.Time `json:"updated_at,omitzero"`
+	// DeletedAt is set while the user is soft-deleted.
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	// Version changes on every write and is exposed only through the ETag.
+	Version int `json:"-"`
 }
 
-// In-memory "database"
-var (
-	users  = make(map[int]User)
-	nextID = 1
-	mu     sync.Mutex // To safely handle concurrent requests
-)
+// store is the backend used by every handler. main may replace it at startup.
+var store UserStore = NewMemoryStore()
 
 // --- HANDLERS ---
 
 // getAllUsersHandler handles GET /users
+//
+// It supports ?limit=, ?offset=, ?sort=id|-id|name|-name, a ?name=
+// substring filter and ?include_deleted=true to show deleted users. The
+// total match count is sent in X-Total-Count and links to neighbouring
+// pages in the Link header. The page is encoded as JSON, CSV, NDJSON or
+// MessagePack depending on the Accept header.
 func getAllUsersHandler(w http.ResponseWriter, r *http.Request) {
-	mu.Lock()
-	defer mu.Unlock()
+	mediaType, ok := negotiateUsers(w, r)
+	if !ok {
+		return
+	}
 
-	var userList []User
-	for _, user := range users {
-		userList = append(userList, user)
+	q, err := parseListQuery(r.URL.Query())
+	if err != nil {
+		writeProblem(w, r, Problem{
+			Type:   problemInvalidQuery,
+			Title:  "Invalid query parameter",
+			Status: http.StatusBadRequest,
+			Detail: err.Error(),
+		})
+		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(userList)
+	page, total, err := listPage(q)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	if links := pageLinks(r, q, total); links != "" {
+		w.Header().Set("Link", links)
+	}
+	writeUsers(w, r, http.StatusOK, mediaType, page)
 }
 
 // createUserHandler handles POST /users
+//
+// A JSON body creates one user; CSV, NDJSON and MessagePack bodies import
+// several at once.
 func createUserHandler(w http.ResponseWriter, r *http.Request) {
-	var user User
-	if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); isImportType(mediaType) {
+		importUsers(w, r, mediaType)
 		return
 	}
 
-	mu.Lock()
-	defer mu.Unlock()
+	user, err := decodeUser(r, 0)
+	if err != nil {
+		writeDecodeError(w, r, err)
+		return
+	}
 
-	user.ID = nextID
-	nextID++
-	users[user.ID] = user
+	user, err = store.Create(user)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", userETag(user))
 	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(user)
+	json.NewEncoder(w).Encode(versionFrom(r.Context()).user(user))
 }
 
 // getUserHandler handles GET /users/{id}
+//
+// The response carries an ETag, and a matching If-None-Match gets 304.
 func getUserHandler(w http.ResponseWriter, r *http.Request) {
 	id, err := strconv.Atoi(chi.URLParam(r, "id"))
 	if err != nil {
-		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		writeInvalidUserID(w, r)
 		return
 	}
 
-	mu.Lock()
-	defer mu.Unlock()
+	user, err := store.Get(id)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
 
-	user, ok := users[id]
-	if !ok {
-		http.Error(w, "User not found", http.StatusNotFound)
+	etag := userETag(user)
+	w.Header().Set("ETag", etag)
+	if inm := r.Header.Get("If-None-Match"); inm != "" && etagMatches(inm, etag, true) {
+		w.WriteHeader(http.StatusNotModified)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(user)
+	json.NewEncoder(w).Encode(versionFrom(r.Context()).user(user))
 }
 
 // updateUserHandler handles PUT /users/{id}
+//
+// A stale If-Match gets 412 Precondition Failed.
 func updateUserHandler(w http.ResponseWriter, r *http.Request) {
 	id, err := strconv.Atoi(chi.URLParam(r, "id"))
 	if err != nil {
-		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		writeInvalidUserID(w, r)
 		return
 	}
 
-	var updatedUser User
-	if err := json.NewDecoder(r.Body).Decode(&updatedUser); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+	updatedUser, err := decodeUser(r, id)
+	if err != nil {
+		writeDecodeError(w, r, err)
 		return
 	}
 
-	mu.Lock()
-	defer mu.Unlock()
+	expect, err := ifMatchVersion(r, id)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
 
-	_, ok := users[id]
-	if !ok {
-		http.Error(w, "User not found", http.StatusNotFound)
+	updatedUser, err = store.Update(id, updatedUser, expect)
+	if err != nil {
+		writeStoreError(w, r, err)
 		return
 	}
 
-	updatedUser.ID = id
-	users[id] = updatedUser
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", userETag(updatedUser))
+	json.NewEncoder(w).Encode(versionFrom(r.Context()).user(updatedUser))
+}
+
+// patchUserHandler handles PATCH /users/{id}
+//
+// The body is either a JSON Merge Patch (RFC 7396) or a JSON Patch
+// (RFC 6902), chosen by Content-Type. The patched user is validated like
+// a PUT body before it is stored, and only if the user has not changed
+// since it was read; a stale If-Match gets 412.
+func patchUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		writeInvalidUserID(w, r)
+		return
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != mediaTypeMergePatch && mediaType != mediaTypeJSONPatch {
+		w.Header().Set("Accept-Patch", mediaTypeMergePatch+", "+mediaTypeJSONPatch)
+		writeProblem(w, r, Problem{
+			Type:   problemUnsupportedMedia,
+			Status: http.StatusUnsupportedMediaType,
+			Detail: "PATCH bodies must be " + mediaTypeMergePatch + " or " + mediaTypeJSONPatch + ".",
+		})
+		return
+	}
+
+	patch, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeDecodeError(w, r, err)
+		return
+	}
+
+	expect, err := ifMatchVersion(r, id)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	current, err := store.Get(id)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+	if expect != 0 && current.Version != expect {
+		writeStoreError(w, r, ErrVersionMismatch)
+		return
+	}
+
+	v := versionFrom(r.Context())
+	doc, err := v.patchDocument(current)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+
+	if mediaType == mediaTypeMergePatch {
+		var mp any
+		if err := json.Unmarshal(patch, &mp); err != nil {
+			writeDecodeError(w, r, err)
+			return
+		}
+		doc = mergePatch(doc, mp)
+	} else {
+		ops, err := parseJSONPatch(patch)
+		if err != nil {
+			writeDecodeError(w, r, err)
+			return
+		}
+		if doc, err = applyJSONPatch(doc, ops); err != nil {
+			writePatchError(w, r, err)
+			return
+		}
+	}
+
+	patched, err := json.Marshal(doc)
+	if err != nil {
+		writeInternalError(w, r, err)
+		return
+	}
+
+	user, err := decodeUserJSON(bytes.NewReader(patched), id, v)
+	if err != nil {
+		writeDecodeError(w, r, err)
+		return
+	}
+
+	user, err = store.Update(id, user, current.Version)
+	if errors.Is(err, ErrVersionMismatch) && expect == 0 {
+		writeProblem(w, r, Problem{
+			Type:   problemPatchConflict,
+			Title:  "Patch cannot be applied",
+			Status: http.StatusConflict,
+			Detail: "The user changed while the patch was being applied; retry the request.",
+		})
+		return
+	}
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(updatedUser)
+	w.Header().Set("ETag", userETag(user))
+	json.NewEncoder(w).Encode(v.user(user))
 }
 
 // deleteUserHandler handles DELETE /users/{id}
+//
+// A stale If-Match gets 412 Precondition Failed.
 func deleteUserHandler(w http.ResponseWriter, r *http.Request) {
 	id, err := strconv.Atoi(chi.URLParam(r, "id"))
 	if err != nil {
-		http.Error(w, "Invalid user ID", http.StatusBadRequest)
+		writeInvalidUserID(w, r)
 		return
 	}
 
-	mu.Lock()
-	defer mu.Unlock()
+	expect, err := ifMatchVersion(r, id)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
 
-	if _, ok := users[id]; !ok {
-		http.Error(w, "User not found", http.StatusNotFound)
+	if err := store.Delete(id, expect); err != nil {
+		writeStoreError(w, r, err)
 		return
 	}
 
-	delete(users, id)
 	w.WriteHeader(http.StatusNoContent)
 }
@@ -4,17 +4,43 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 )
 
+// memStore is the in-memory store the handlers use during tests
+var memStore *MemoryStore
+
 // A helper function to reset the state before each test
 func resetState() {
-	users = make(map[int]User)
-	nextID = 1
+	memStore = NewMemoryStore()
+	store = memStore
+	shuttingDown.Store(false)
+	idempotencyStore = NewIdempotencyStore(24 * time.Hour)
+	userEvents = NewEventFeed(defaultEventHistory)
+	webhookStore = NewWebhookStore()
+}
+
+// setUser puts user straight into the test store, bypassing versioning.
+func setUser(user User) {
+	memStore.shard(user.ID).users[user.ID] = user
+}
+
+// peekUser returns the user with the given ID as the test store holds it,
+// deleted or not.
+func peekUser(id int) User {
+	return memStore.shard(id).users[id]
+}
+
+// storedUsers returns every user in the test store, deleted or not.
+func storedUsers() []User {
+	users, _ := memStore.ListWithDeleted()
+	return users
 }
 
 func TestCreateUserHandler(t *testing.T) {
@@ -79,8 +105,8 @@ func TestGetAllUsersHandler(t *testing.T) {
 	resetState()
 
 	// Add some test users
-	users[1] = User{ID: 1, Name: "Alice"}
-	users[2] = User{ID: 2, Name: "Bob"}
+	setUser(User{ID: 1, Name: "Alice"})
+	setUser(User{ID: 2, Name: "Bob"})
 
 	req, err := http.NewRequest("GET", "/users", nil)
 	if err != nil {
@@ -133,11 +159,95 @@ func TestGetAllUsersHandler_EmptyList(t *testing.T) {
 	}
 }
 
+func TestGetAllUsersHandler_Pagination(t *testing.T) {
+	resetState()
+
+	setUser(User{ID: 1, Name: "Charlie"})
+	setUser(User{ID: 2, Name: "alice"})
+	setUser(User{ID: 3, Name: "Bob"})
+	setUser(User{ID: 4, Name: "Alicia"})
+
+	testCases := []struct {
+		name      string
+		url       string
+		wantIDs   []int
+		wantTotal string
+		wantLink  string
+	}{
+		{"Default order is by ID", "/users", []int{1, 2, 3, 4}, "4", ""},
+		{"Sort by descending ID", "/users?sort=-id", []int{4, 3, 2, 1}, "4", ""},
+		{"Sort by name", "/users?sort=name", []int{2, 4, 3, 1}, "4", ""},
+		{"First page", "/users?limit=2", []int{1, 2}, "4", `</users?limit=2&offset=2>; rel="next"`},
+		{"Last page", "/users?limit=2&offset=2", []int{3, 4}, "4", `</users?limit=2&offset=0>; rel="prev"`},
+		{"Offset past the end", "/users?offset=10", []int{}, "4", `</users?limit=100&offset=0>; rel="prev"`},
+		{"Name filter is case-insensitive", "/users?name=ALI", []int{2, 4}, "2", ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest("GET", tc.url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+			router := chi.NewRouter()
+			router.Get("/users", getAllUsersHandler)
+			router.ServeHTTP(rr, req)
+
+			if status := rr.Code; status != http.StatusOK {
+				t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+			}
+
+			if total := rr.Header().Get("X-Total-Count"); total != tc.wantTotal {
+				t.Errorf("handler returned wrong X-Total-Count: got %v want %v", total, tc.wantTotal)
+			}
+
+			if link := rr.Header().Get("Link"); link != tc.wantLink {
+				t.Errorf("handler returned wrong Link: got %v want %v", link, tc.wantLink)
+			}
+
+			var userList []User
+			if err := json.NewDecoder(rr.Body).Decode(&userList); err != nil {
+				t.Fatal(err)
+			}
+
+			var gotIDs []int
+			for _, user := range userList {
+				gotIDs = append(gotIDs, user.ID)
+			}
+			if fmt.Sprint(gotIDs) != fmt.Sprint(tc.wantIDs) {
+				t.Errorf("handler returned unexpected users: got %v want %v", gotIDs, tc.wantIDs)
+			}
+		})
+	}
+}
+
+func TestGetAllUsersHandler_InvalidQuery(t *testing.T) {
+	resetState()
+
+	for _, url := range []string{"/users?limit=0", "/users?limit=abc", "/users?offset=-1", "/users?sort=email"} {
+		req, err := http.NewRequest("GET", url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rr := httptest.NewRecorder()
+		router := chi.NewRouter()
+		router.Get("/users", getAllUsersHandler)
+		router.ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusBadRequest {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v", url, status, http.StatusBadRequest)
+		}
+	}
+}
+
 func TestGetUserHandler(t *testing.T) {
 	resetState()
 
 	// First, create a user to fetch
-	users[1] = User{ID: 1, Name: "Jane Doe"}
+	setUser(User{ID: 1, Name: "Jane Doe"})
 
 	// Test case 1: User found
 	t.Run("User Found", func(t *testing.T) {
@@ -201,7 +311,7 @@ func TestUpdateUserHandler(t *testing.T) {
 	resetState()
 
 	// Create a user to update
-	users[1] = User{ID: 1, Name: "Original Name"}
+	setUser(User{ID: 1, Name: "Original Name"})
 
 	// Test case 1: Successful update
 	t.Run("Successful Update", func(t *testing.T) {
@@ -234,7 +344,7 @@ func TestUpdateUserHandler(t *testing.T) {
 		}
 
 		// Verify the user was actually updated in the map
-		if users[1].Name != "Updated Name" {
+		if peekUser(1).Name != "Updated Name" {
 			t.Error("user was not actually updated in the map")
 		}
 	})
@@ -299,7 +409,7 @@ func TestDeleteUserHandler(t *testing.T) {
 
 	// Test case 1: Successful deletion
 	t.Run("Successful Deletion", func(t *testing.T) {
-		users[1] = User{ID: 1, Name: "To Be Deleted"}
+		setUser(User{ID: 1, Name: "To Be Deleted"})
 
 		req, err := http.NewRequest("DELETE", "/users/1", nil)
 		if err != nil {
@@ -315,9 +425,9 @@ func TestDeleteUserHandler(t *testing.T) {
 			t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusNoContent)
 		}
 
-		// Verify the user was actually deleted
-		if _, ok := users[1]; ok {
-			t.Error("user was not deleted from the map")
+		// Verify the user was marked as deleted
+		if peekUser(1).DeletedAt == nil {
+			t.Error("user was not marked as deleted")
 		}
 	})
 
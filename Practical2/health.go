@@ -0,0 +1,107 @@
+// health.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+)
+
+// buildTime is set at link time with -ldflags "-X main.buildTime=...".
+var buildTime string
+
+// shuttingDown is set once the server starts draining so that /readyz
+// takes the instance out of rotation before it stops accepting requests.
+var shuttingDown atomic.Bool
+
+// Pinger is implemented by stores that depend on an external service.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// healthzHandler handles GET /healthz. It only reports that the process
+// is serving requests.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
+}
+
+// readyzHandler handles GET /readyz. It fails while the server shuts down
+// or when the store cannot be reached. The endpoint is unauthenticated, so
+// why the store is unreachable is only logged.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if shuttingDown.Load() {
+		writeNotReady(w, r, "The server is shutting down.")
+		return
+	}
+
+	if p, ok := store.(Pinger); ok {
+		ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+		defer cancel()
+
+		if err := p.Ping(ctx); err != nil {
+			loggerFrom(r.Context()).Error("user store is unreachable", slog.Any("error", err))
+			writeNotReady(w, r, "The user store is unavailable.")
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "ready"})
+}
+
+func writeNotReady(w http.ResponseWriter, r *http.Request, detail string) {
+	writeProblem(w, r, Problem{
+		Type:   problemNotReady,
+		Title:  "Not ready",
+		Status: http.StatusServiceUnavailable,
+		Detail: detail,
+	})
+}
+
+// VersionInfo is the body of GET /version.
+type VersionInfo struct {
+	Version      string `json:"version"`
+	GoVersion    string `json:"go_version"`
+	Revision     string `json:"revision,omitempty"`
+	RevisionTime string `json:"revision_time,omitempty"`
+	Modified     bool   `json:"modified"`
+	BuildTime    string `json:"build_time,omitempty"`
+}
+
+// readVersionInfo collects the module version and VCS stamp embedded by
+// the Go toolchain.
+func readVersionInfo() VersionInfo {
+	info := VersionInfo{Version: "unknown", BuildTime: buildTime}
+
+	bi, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+
+	info.GoVersion = bi.GoVersion
+	if bi.Main.Version != "" {
+		info.Version = bi.Main.Version
+	}
+	for _, s := range bi.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			info.Revision = s.Value
+		case "vcs.time":
+			info.RevisionTime = s.Value
+		case "vcs.modified":
+			info.Modified = s.Value == "true"
+		}
+	}
+	return info
+}
+
+// versionHandler handles GET /version
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(readVersionInfo())
+}
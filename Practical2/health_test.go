@@ -0,0 +1,71 @@
+// health_test.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// pingStore is a MemoryStore whose Ping result the test controls.
+type pingStore struct {
+	*MemoryStore
+	err error
+}
+
+func (s pingStore) Ping(ctx context.Context) error { return s.err }
+
+func TestHealthz(t *testing.T) {
+	rr := serve(t, "GET", "/healthz", "", nil)
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	testCases := []struct {
+		name         string
+		store        UserStore
+		shuttingDown bool
+		wantStatus   int
+	}{
+		{"Memory store is always ready", NewMemoryStore(), false, http.StatusOK},
+		{"Reachable store", pingStore{NewMemoryStore(), nil}, false, http.StatusOK},
+		{"Unreachable store", pingStore{NewMemoryStore(), errors.New("dial tcp db.internal:5432: connection refused")}, false, http.StatusServiceUnavailable},
+		{"Shutting down", NewMemoryStore(), true, http.StatusServiceUnavailable},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			store = tc.store
+			shuttingDown.Store(tc.shuttingDown)
+			defer resetState()
+
+			rr := serve(t, "GET", "/readyz", "", nil)
+			if status := rr.Code; status != tc.wantStatus {
+				t.Errorf("handler returned wrong status code: got %v want %v", status, tc.wantStatus)
+			}
+			if strings.Contains(rr.Body.String(), "db.internal") {
+				t.Errorf("handler leaked the store error: %s", rr.Body)
+			}
+		})
+	}
+}
+
+func TestVersion(t *testing.T) {
+	rr := serve(t, "GET", "/version", "", nil)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	var info VersionInfo
+	if err := json.NewDecoder(rr.Body).Decode(&info); err != nil {
+		t.Fatal(err)
+	}
+	if info.GoVersion == "" || info.Version == "" {
+		t.Errorf("handler returned incomplete version info: %+v", info)
+	}
+}
@@ -0,0 +1,213 @@
+// idempotency.go
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// replayedHeaders are the response headers stored with an idempotent
+// response. Headers set per request, such as X-Request-ID, are left out.
+var replayedHeaders = []string{"Content-Type", "ETag", "Location"}
+
+// idempotencyRecord is the outcome of the first request made with a key.
+// It is pending until that request completes.
+type idempotencyRecord struct {
+	fingerprint string
+	done        bool
+	status      int
+	header      http.Header
+	body        []byte
+	expires     time.Time
+}
+
+// IdempotencyStore remembers responses by Idempotency-Key for a window.
+type IdempotencyStore struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu      sync.Mutex
+	records map[string]*idempotencyRecord
+	inserts int
+}
+
+// NewIdempotencyStore keeps responses for ttl after they are recorded.
+func NewIdempotencyStore(ttl time.Duration) *IdempotencyStore {
+	return &IdempotencyStore{
+		ttl:     ttl,
+		now:     time.Now,
+		records: make(map[string]*idempotencyRecord),
+	}
+}
+
+// idempotencyStore backs the idempotent middleware.
+var idempotencyStore = NewIdempotencyStore(24 * time.Hour)
+
+// begin returns a copy of the live record for key and true, or reserves
+// key for a request with fingerprint and returns false. The copy is taken
+// under the lock, since finish may complete the record at any time.
+func (s *IdempotencyStore) begin(key, fingerprint string) (idempotencyRecord, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if rec, ok := s.records[key]; ok && now.Before(rec.expires) {
+		return *rec, true
+	}
+
+	s.inserts++
+	if s.inserts%256 == 0 {
+		for k, rec := range s.records {
+			if !now.Before(rec.expires) {
+				delete(s.records, k)
+			}
+		}
+	}
+
+	// Pending records expire too, so a crashed request cannot lock a key
+	s.records[key] = &idempotencyRecord{fingerprint: fingerprint, expires: now.Add(s.ttl)}
+	return idempotencyRecord{}, false
+}
+
+// finish stores the response of the request that reserved key.
+func (s *IdempotencyStore) finish(key string, status int, header http.Header, body []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if rec, ok := s.records[key]; ok {
+		rec.done = true
+		rec.status = status
+		rec.header = header
+		rec.body = body
+		rec.expires = s.now().Add(s.ttl)
+	}
+}
+
+// release forgets key so the request can be retried.
+func (s *IdempotencyStore) release(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.records, key)
+}
+
+// idempotent replays the stored response when a request repeats an
+// Idempotency-Key with the same body. A key reused with a different body
+// gets 422, and one whose first request is still running gets 409.
+// Server errors are not stored, so those requests can be retried.
+func idempotent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > 255 {
+			writeProblem(w, r, Problem{
+				Type:   problemInvalidIdempotencyKey,
+				Status: http.StatusBadRequest,
+				Detail: "Idempotency-Key must be at most 255 characters.",
+			})
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeDecodeError(w, r, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		// Keys are scoped to the caller so clients cannot collide
+		if claims, ok := claimsFrom(r.Context()); ok {
+			key = claims.Subject + ":" + key
+		}
+		key = r.Method + " " + r.URL.Path + " " + key
+
+		sum := sha256.Sum256(body)
+		fingerprint := hex.EncodeToString(sum[:])
+
+		if rec, ok := idempotencyStore.begin(key, fingerprint); ok {
+			replayIdempotent(w, r, rec, fingerprint)
+			return
+		}
+
+		// A panicking handler must not leave the key pending until it
+		// expires, or every retry would get 409
+		defer func() {
+			if p := recover(); p != nil {
+				idempotencyStore.release(key)
+				panic(p)
+			}
+		}()
+
+		cw := &captureWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(cw, r)
+
+		if cw.status >= http.StatusInternalServerError {
+			idempotencyStore.release(key)
+			return
+		}
+
+		header := make(http.Header)
+		for _, name := range replayedHeaders {
+			if v := w.Header().Values(name); len(v) > 0 {
+				header[http.CanonicalHeaderKey(name)] = v
+			}
+		}
+		idempotencyStore.finish(key, cw.status, header, cw.body.Bytes())
+	})
+}
+
+func replayIdempotent(w http.ResponseWriter, r *http.Request, rec idempotencyRecord, fingerprint string) {
+	switch {
+	case rec.fingerprint != fingerprint:
+		writeProblem(w, r, Problem{
+			Type:   problemIdempotencyMismatch,
+			Status: http.StatusUnprocessableEntity,
+			Detail: "This Idempotency-Key was already used with a different request body.",
+		})
+	case !rec.done:
+		writeProblem(w, r, Problem{
+			Type:   problemIdempotencyInFlight,
+			Status: http.StatusConflict,
+			Detail: "A request with this Idempotency-Key is still being processed.",
+		})
+	default:
+		for name, values := range rec.header {
+			w.Header()[name] = values
+		}
+		w.Header().Set("Idempotent-Replayed", "true")
+		w.WriteHeader(rec.status)
+		w.Write(rec.body)
+	}
+}
+
+// captureWriter passes a response through while keeping a copy of it.
+type captureWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (cw *captureWriter) WriteHeader(status int) {
+	if !cw.wroteHeader {
+		cw.status = status
+		cw.wroteHeader = true
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *captureWriter) Write(b []byte) (int, error) {
+	cw.wroteHeader = true
+	cw.body.Write(b)
+	return cw.ResponseWriter.Write(b)
+}
@@ -0,0 +1,137 @@
+// idempotency_test.go
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIdempotentCreate(t *testing.T) {
+	resetState()
+	idempotencyStore = NewIdempotencyStore(time.Hour)
+
+	headers := map[string]string{idempotencyKeyHeader: "create-alice"}
+
+	first := serve(t, "POST", "/v1/users", `{"name": "Alice"}`, headers)
+	if status := first.Code; status != http.StatusCreated {
+		t.Fatalf("first request: wrong status code: got %v want %v", status, http.StatusCreated)
+	}
+
+	t.Run("Retry replays the first response", func(t *testing.T) {
+		rr := serve(t, "POST", "/v1/users", `{"name": "Alice"}`, headers)
+		if status := rr.Code; status != http.StatusCreated {
+			t.Errorf("wrong status code: got %v want %v", status, http.StatusCreated)
+		}
+		if rr.Body.String() != first.Body.String() {
+			t.Errorf("replayed body differs: got %s want %s", rr.Body, first.Body)
+		}
+		if rr.Header().Get("ETag") != first.Header().Get("ETag") {
+			t.Errorf("replayed ETag differs: got %v want %v", rr.Header().Get("ETag"), first.Header().Get("ETag"))
+		}
+		if rr.Header().Get("Idempotent-Replayed") != "true" {
+			t.Error("replayed response is not marked as replayed")
+		}
+		if len(storedUsers()) != 1 {
+			t.Errorf("retry created a duplicate user: %d users stored", len(storedUsers()))
+		}
+	})
+
+	t.Run("Reused key with a different body", func(t *testing.T) {
+		rr := serve(t, "POST", "/v1/users", `{"name": "Mallory"}`, headers)
+		if status := rr.Code; status != http.StatusUnprocessableEntity {
+			t.Errorf("wrong status code: got %v want %v", status, http.StatusUnprocessableEntity)
+		}
+	})
+
+	t.Run("New key creates a new user", func(t *testing.T) {
+		rr := serve(t, "POST", "/v1/users", `{"name": "Alice"}`, map[string]string{idempotencyKeyHeader: "create-alice-2"})
+		var user User
+		if err := json.NewDecoder(rr.Body).Decode(&user); err != nil {
+			t.Fatal(err)
+		}
+		if user.ID != 2 {
+			t.Errorf("wrong ID for new key: got %v want %v", user.ID, 2)
+		}
+	})
+
+	t.Run("Key too long", func(t *testing.T) {
+		long := make([]byte, 256)
+		for i := range long {
+			long[i] = 'k'
+		}
+		rr := serve(t, "POST", "/v1/users", `{"name": "Alice"}`, map[string]string{idempotencyKeyHeader: string(long)})
+		if status := rr.Code; status != http.StatusBadRequest {
+			t.Errorf("wrong status code: got %v want %v", status, http.StatusBadRequest)
+		}
+	})
+}
+
+func TestIdempotencyStore(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1700000000, 0)}
+	s := NewIdempotencyStore(time.Minute)
+	s.now = clock.now
+
+	if _, ok := s.begin("k", "a"); ok {
+		t.Fatal("new key returned a record")
+	}
+
+	// A second request while the first is running sees it pending
+	if rec, ok := s.begin("k", "a"); !ok || rec.done {
+		t.Fatalf("in-flight key: got %+v want a pending record", rec)
+	}
+
+	s.finish("k", http.StatusCreated, nil, []byte("{}"))
+	if rec, ok := s.begin("k", "a"); !ok || !rec.done || rec.status != http.StatusCreated {
+		t.Fatalf("finished key: got %+v want the stored response", rec)
+	}
+
+	// Records are forgotten after the window
+	clock.advance(2 * time.Minute)
+	if rec, ok := s.begin("k", "a"); ok {
+		t.Errorf("expired key: got %+v want none", rec)
+	}
+
+	// Released keys can be retried straight away
+	s.release("k")
+	if rec, ok := s.begin("k", "b"); ok {
+		t.Errorf("released key: got %+v want none", rec)
+	}
+}
+
+func TestIdempotentPanic(t *testing.T) {
+	idempotencyStore = NewIdempotencyStore(time.Hour)
+
+	calls := 0
+	handler := idempotent(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			panic("boom")
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	send := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/v1/users", strings.NewReader(`{"name": "Alice"}`))
+		req.Header.Set(idempotencyKeyHeader, "panics")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("the panic was swallowed")
+			}
+		}()
+		send()
+	}()
+
+	// The retry runs instead of getting 409
+	if rr := send(); rr.Code != http.StatusCreated {
+		t.Errorf("retry after panic: got status %v want %v", rr.Code, http.StatusCreated)
+	}
+}
@@ -0,0 +1,154 @@
+// listing.go
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+// listQuery holds the pagination, sorting and filtering options of GET /users.
+type listQuery struct {
+	limit          int
+	offset         int
+	sort           string
+	name           string
+	includeDeleted bool
+}
+
+// parseListQuery reads limit, offset, sort, name and include_deleted from
+// the query string.
+func parseListQuery(values url.Values) (listQuery, error) {
+	q := listQuery{limit: defaultPageLimit, sort: "id"}
+
+	if v := values.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxPageLimit {
+			return q, fmt.Errorf("limit must be between 1 and %d", maxPageLimit)
+		}
+		q.limit = limit
+	}
+
+	if v := values.Get("offset"); v != "" {
+		offset, err := strconv.Atoi(v)
+		if err != nil || offset < 0 {
+			return q, fmt.Errorf("offset must be a non-negative integer")
+		}
+		q.offset = offset
+	}
+
+	if v := values.Get("sort"); v != "" {
+		switch v {
+		case "id", "-id", "name", "-name":
+			q.sort = v
+		default:
+			return q, fmt.Errorf("sort must be one of id, -id, name, -name")
+		}
+	}
+
+	if v := values.Get("include_deleted"); v != "" {
+		include, err := strconv.ParseBool(v)
+		if err != nil {
+			return q, fmt.Errorf("include_deleted must be true or false")
+		}
+		q.includeDeleted = include
+	}
+
+	q.name = values.Get("name")
+	return q, nil
+}
+
+// userPager is implemented by stores that can filter, sort and page users
+// themselves instead of loading all of them for apply.
+type userPager interface {
+	ListPage(q listQuery) ([]User, int, error)
+}
+
+// listPage returns the page of users described by q along with the number
+// of users that matched the filter.
+func listPage(q listQuery) ([]User, int, error) {
+	if p, ok := store.(userPager); ok {
+		return p.ListPage(q)
+	}
+	userList, err := listUsers(q.includeDeleted)
+	if err != nil {
+		return nil, 0, err
+	}
+	page, total := q.apply(userList)
+	return page, total, nil
+}
+
+// apply filters and sorts userList and returns the requested page along
+// with the number of users that matched the filter.
+func (q listQuery) apply(userList []User) ([]User, int) {
+	var matched []User
+	needle := strings.ToLower(q.name)
+	for _, user := range userList {
+		if strings.Contains(strings.ToLower(user.Name), needle) {
+			matched = append(matched, user)
+		}
+	}
+
+	// Names compare case-insensitively and ties fall back to ID so the
+	// order is stable between calls
+	desc := strings.HasPrefix(q.sort, "-")
+	byName := strings.TrimPrefix(q.sort, "-") == "name"
+	sort.Slice(matched, func(i, j int) bool {
+		a, b := matched[i], matched[j]
+		if desc {
+			a, b = b, a
+		}
+		if byName {
+			if an, bn := strings.ToLower(a.Name), strings.ToLower(b.Name); an != bn {
+				return an < bn
+			}
+		}
+		return a.ID < b.ID
+	})
+
+	total := len(matched)
+	if q.offset >= total {
+		return []User{}, total
+	}
+	end := q.offset + q.limit
+	if end > total {
+		end = total
+	}
+	return matched[q.offset:end], total
+}
+
+// pageLinks builds an RFC 8288 Link header value with next and prev
+// relations for the page described by q.
+func pageLinks(r *http.Request, q listQuery, total int) string {
+	var links []string
+
+	link := func(offset int, rel string) string {
+		u := *r.URL
+		values := u.Query()
+		values.Set("limit", strconv.Itoa(q.limit))
+		values.Set("offset", strconv.Itoa(offset))
+		u.RawQuery = values.Encode()
+		return fmt.Sprintf("<%s>; rel=\"%s\"", u.RequestURI(), rel)
+	}
+
+	if q.offset+q.limit < total {
+		links = append(links, link(q.offset+q.limit, "next"))
+	}
+	if q.offset > 0 {
+		prev := q.offset - q.limit
+		if prev < 0 {
+			prev = 0
+		}
+		links = append(links, link(prev, "prev"))
+	}
+
+	return strings.Join(links, ", ")
+}
@@ -0,0 +1,93 @@
+// logging_test.go
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// captureLogs points the process logger at a buffer for the test.
+func captureLogs(t *testing.T) *bytes.Buffer {
+	t.Helper()
+
+	var buf bytes.Buffer
+	prev := logger
+	logger = slog.New(slog.NewJSONHandler(&buf, nil))
+	t.Cleanup(func() { logger = prev })
+	return &buf
+}
+
+func TestRequestLogger(t *testing.T) {
+	resetState()
+	setUser(User{ID: 1, Name: "Alice"})
+	logs := captureLogs(t)
+
+	rr := serve(t, "GET", "/v1/users/1", "", nil)
+
+	id := rr.Header().Get(requestIDHeader)
+	if len(id) != 32 {
+		t.Fatalf("handler returned wrong %s: got %q", requestIDHeader, id)
+	}
+
+	var entry map[string]any
+	if err := json.Unmarshal(logs.Bytes(), &entry); err != nil {
+		t.Fatalf("log line is not JSON: %v (%s)", err, logs)
+	}
+
+	want := map[string]any{
+		"msg":        "request",
+		"request_id": id,
+		"method":     "GET",
+		"route":      "/v1/users/{id}",
+		"path":       "/v1/users/1",
+		"status":     float64(http.StatusOK),
+		"bytes":      float64(rr.Body.Len()),
+	}
+	for k, v := range want {
+		if entry[k] != v {
+			t.Errorf("log field %s: got %v want %v", k, entry[k], v)
+		}
+	}
+	if _, ok := entry["duration"]; !ok {
+		t.Error("log line has no duration")
+	}
+}
+
+func TestRequestLogger_PropagatesRequestID(t *testing.T) {
+	resetState()
+	captureLogs(t)
+
+	rr := serve(t, "GET", "/healthz", "", map[string]string{requestIDHeader: "upstream-123"})
+	if got := rr.Header().Get(requestIDHeader); got != "upstream-123" {
+		t.Errorf("handler did not keep the incoming request ID: got %v", got)
+	}
+
+	rr = serve(t, "GET", "/healthz", "", map[string]string{requestIDHeader: "has spaces"})
+	if got := rr.Header().Get(requestIDHeader); got == "has spaces" {
+		t.Error("handler echoed a malformed request ID")
+	}
+}
+
+func TestLoggerFrom(t *testing.T) {
+	logs := captureLogs(t)
+
+	handler := requestLogger(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		loggerFrom(r.Context()).Info("inside handler")
+	}))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set(requestIDHeader, "abc")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	var entry map[string]any
+	if err := json.NewDecoder(logs).Decode(&entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry["msg"] != "inside handler" || entry["request_id"] != "abc" {
+		t.Errorf("handler log line is not request-scoped: %v", entry)
+	}
+}
@@ -2,26 +2,238 @@
 package main
 
 import (
-	"log"
-	"net/http"
+	"context"
+	"database/sql"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/go-chi/chi/v5"
-	"github.com/go-chi/chi/v5/middleware"
+	_ "github.com/lib/pq"
+	"github.com/redis/go-redis/v9"
 )
 
 func main() {
+	// Failures once the servers run set exitCode instead of calling fatal,
+	// so the deferred closes below still run; this defer runs last
+	exitCode := 0
+	defer func() {
+		if exitCode != 0 {
+			os.Exit(exitCode)
+		}
+	}()
+
+	cfg, err := loadConfig(os.Args[1:], os.Getenv)
+	if err != nil {
+		fatal("invalid configuration", err)
+	}
+
+	// Use Postgres when a database URL is set, otherwise keep users in memory
+	if cfg.DatabaseURL != "" {
+		db, err := sql.Open("postgres", cfg.DatabaseURL)
+		if err != nil {
+			fatal("could not open database", err)
+		}
+		defer db.Close()
+
+		if err := db.Ping(); err != nil {
+			fatal("could not connect to database", err)
+		}
+
+		pgStore := NewPostgresStore(db)
+		if err := pgStore.Migrate(context.Background()); err != nil {
+			fatal("could not migrate database", err)
+		}
+		store = pgStore
+		logger.Info("using Postgres user store")
+	} else if cfg.DataDir != "" {
+		memStore, err := OpenMemoryStore(cfg.DataDir, cfg.WALSync, cfg.WALSyncInterval)
+		if err != nil {
+			fatal("could not recover user store", err)
+		}
+		defer func() {
+			if err := memStore.Close(); err != nil {
+				logger.Error("could not close WAL", slog.Any("error", err))
+			}
+		}()
+
+		store = memStore
+		logger.Info("using persistent in-memory user store", slog.String("data_dir", cfg.DataDir))
+	} else {
+		logger.Info("using in-memory user store")
+	}
+
+	authKeys, err = loadKeySet(cfg.JWTHMACSecret, cfg.JWTRSAPublicKeyFile)
+	if err != nil {
+		fatal("could not load JWT keys", err)
+	}
+	if authKeys == nil {
+		logger.Warn("no JWT keys configured, authentication is disabled")
+	}
+
+	specValidator, err = NewOpenAPIValidator(cfg.OpenAPIValidation)
+	if err != nil {
+		fatal("could not load OpenAPI document", err)
+	}
+
+	apiV1.sunset = cfg.V1Sunset
+	maxBodyBytes = cfg.MaxBodyBytes
+	allowPrivateWebhooks = cfg.WebhookAllowPrivate
+	idempotencyStore = NewIdempotencyStore(cfg.IdempotencyTTL)
+	if cfg.RateLimit > 0 || cfg.IPRateLimit > 0 {
+		// Limiters share Redis when it is configured, so every instance
+		// sees the same buckets
+		newLimiter := func(rate float64, burst int) RateLimiter {
+			return NewMemoryRateLimiter(rate, burst)
+		}
+		if cfg.RedisURL != "" {
+			opts, err := redis.ParseURL(cfg.RedisURL)
+			if err != nil {
+				fatal("invalid Redis URL", err)
+			}
+			client := redis.NewClient(opts)
+			defer client.Close()
+			newLimiter = func(rate float64, burst int) RateLimiter {
+				return NewRedisRateLimiter(client, rate, burst)
+			}
+		}
+		if cfg.RateLimit > 0 {
+			rateLimiter = newLimiter(cfg.RateLimit, cfg.RateBurst)
+		}
+		if cfg.IPRateLimit > 0 {
+			ipRateLimiter = newLimiter(cfg.IPRateLimit, cfg.IPRateBurst)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// Deliver user events to webhooks until the server shuts down
+	dispatcher := NewDispatcher(webhookStore, userEvents, cfg.WebhookMaxAttempts, cfg.WebhookBackoff, cfg.WebhookTimeout, webhookWorkers, cfg.WebhookAllowPrivate)
+	dispatched := make(chan struct{})
+	go func() {
+		dispatcher.Run(ctx)
+		close(dispatched)
+	}()
+
+	// Snapshot the persistent store so the WAL does not grow forever
+	if memStore, ok := store.(*MemoryStore); ok && cfg.DataDir != "" {
+		go runSnapshots(ctx, memStore, cfg.SnapshotInterval)
+	}
+
+	// Purge deleted users once they are past retention
+	go runPurger(ctx, cfg.DeletedRetention, cfg.PurgeInterval)
+
+	// Serve the gRPC user service alongside HTTP. If it fails, HTTP is
+	// shut down too
+	grpcErr := make(chan error, 1)
+	if cfg.GRPCAddr != "" {
+		grpcLn, err := net.Listen("tcp", cfg.GRPCAddr)
+		if err != nil {
+			fatal("could not start gRPC server", err)
+		}
+		logger.Info("gRPC server starting", slog.String("addr", grpcLn.Addr().String()))
+		go func() {
+			err := serveGRPC(ctx, newGRPCServer(), grpcLn, cfg.ShutdownTimeout)
+			if err != nil {
+				stop()
+			}
+			grpcErr <- err
+		}()
+	} else {
+		grpcErr <- nil
+	}
+
+	ln, err := net.Listen("tcp", cfg.Addr)
+	if err != nil {
+		fatal("could not start server", err)
+	}
+
+	logger.Info("server starting", slog.String("addr", ln.Addr().String()))
+	srv := newServer(cfg, newRouter())
+	srv.RegisterOnShutdown(userEvents.Close)
+	if err := runServer(ctx, srv, ln, cfg.ShutdownTimeout); err != nil {
+		logger.Error("server error", slog.Any("error", err))
+		exitCode = 1
+		stop()
+	}
+	if err := <-grpcErr; err != nil {
+		logger.Error("gRPC server error", slog.Any("error", err))
+		exitCode = 1
+	}
+	<-dispatched
+	logger.Info("server stopped")
+}
+
+// fatal logs msg with err and exits.
+func fatal(msg string, err error) {
+	logger.Error(msg, slog.Any("error", err))
+	os.Exit(1)
+}
+
+// newRouter registers every route of the users API.
+func newRouter() chi.Router {
 	r := chi.NewRouter()
-	r.Use(middleware.Logger)
+	r.Use(requestLogger)
+	r.Use(metricsMiddleware)
+	r.NotFound(notFoundHandler)
+	r.MethodNotAllowed(methodNotAllowedHandler)
+
+	// Probes
+	r.Get("/healthz", healthzHandler)
+	r.Get("/readyz", readyzHandler)
+	r.Get("/version", versionHandler)
+	r.Method("GET", "/metrics", metricsHandler())
+
+	// API description
+	r.Get("/openapi.json", openAPIHandler)
+	r.Get("/docs", docsHandler)
+
+	// API versions, which share the handlers and differ in how users
+	// are represented; see versions.go
+	r.Route("/"+apiV1.name, func(r chi.Router) { apiRoutes(r, apiV1) })
+	r.Route("/"+apiV2.name, func(r chi.Router) { apiRoutes(r, apiV2) })
 
-	// Setup routes
-	r.Get("/users", getAllUsersHandler)
-	r.Post("/users", createUserHandler)
-	r.Get("/users/{id}", getUserHandler)
-	r.Put("/users/{id}", updateUserHandler)
-	r.Delete("/users/{id}", deleteUserHandler)
+	// Paths from before versioning
+	r.HandleFunc("/users", redirectToV1)
+	r.HandleFunc("/users/*", redirectToV1)
+	r.HandleFunc("/users:batch", redirectToV1)
+	r.HandleFunc("/webhooks", redirectToV1)
+	r.HandleFunc("/webhooks/*", redirectToV1)
 
-	log.Println("Server starting on :3000")
-	if err := http.ListenAndServe(":3000", r); err != nil {
-		log.Fatalf("Could not start server: %s\n", err)
+	return r
+}
+
+// apiRoutes sets up the user and webhook routes of version v.
+func apiRoutes(r chi.Router, v *apiVersion) {
+	r.Use(v.middleware)
+	// Around authenticate: by remote IP before it, so bad tokens are
+	// limited too, and by verified subject after it
+	r.Use(rateLimitIP)
+	r.Use(authenticate)
+	r.Use(rateLimit)
+	r.Use(limitBody)
+	if specValidator != nil {
+		r.Use(specValidator.Middleware)
 	}
+
+	r.With(requireAdmin).Get("/users", getAllUsersHandler)
+	r.With(requireAdmin).Get("/users/events", userEventsHandler)
+	r.With(requireAdmin, idempotent).Post("/users", createUserHandler)
+	r.With(requireAdmin, idempotent).Post("/users:batch", batchUsersHandler)
+	r.With(requireSelfOrAdmin).Get("/users/{id}", getUserHandler)
+	r.With(requireSelfOrAdmin).Put("/users/{id}", updateUserHandler)
+	r.With(requireSelfOrAdmin).Patch("/users/{id}", patchUserHandler)
+	r.With(requireAdmin).Delete("/users/{id}", deleteUserHandler)
+	r.With(requireAdmin).Post("/users/{id}:restore", restoreUserHandler)
+
+	r.With(requireAdmin).Get("/webhooks", listWebhooksHandler)
+	r.With(requireAdmin).Post("/webhooks", createWebhookHandler)
+	r.With(requireAdmin).Get("/webhooks/dead-letters", deadLettersHandler)
+	r.With(requireAdmin).Get("/webhooks/{id}", getWebhookHandler)
+	r.With(requireAdmin).Put("/webhooks/{id}", updateWebhookHandler)
+	r.With(requireAdmin).Delete("/webhooks/{id}", deleteWebhookHandler)
+	r.With(requireAdmin).Get("/webhooks/{id}/deliveries", webhookDeliveriesHandler)
 }
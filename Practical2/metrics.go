@@ -0,0 +1,133 @@
+// metrics.go
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metricsRegistry holds every metric served at /metrics.
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	httpRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "Number of HTTP requests handled, by route pattern and status code.",
+	}, []string{"method", "route", "code"})
+
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "Time spent handling HTTP requests, by route pattern and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route", "code"})
+
+	httpRequestsInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "http_requests_in_flight",
+		Help: "Number of HTTP requests currently being handled.",
+	})
+
+	grpcRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "grpc_requests_total",
+		Help: "Number of gRPC calls handled, by method and status code.",
+	}, []string{"method", "code"})
+
+	grpcRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "grpc_request_duration_seconds",
+		Help:    "Time spent handling gRPC calls, by method and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "code"})
+
+	grpcRequestsInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "grpc_requests_in_flight",
+		Help: "Number of gRPC calls currently being handled.",
+	})
+
+	rateLimiterErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "rate_limiter_errors_total",
+		Help: "Number of requests let through unchecked because the rate limiter failed.",
+	})
+
+	usersStored = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "users_stored",
+		Help: "Number of users in the store.",
+	}, func() float64 {
+		n, err := countUsers()
+		if err != nil {
+			return -1
+		}
+		return float64(n)
+	})
+)
+
+func init() {
+	metricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		httpRequestsTotal,
+		httpRequestDuration,
+		httpRequestsInFlight,
+		grpcRequestsTotal,
+		grpcRequestDuration,
+		grpcRequestsInFlight,
+		rateLimiterErrors,
+		usersStored,
+	)
+}
+
+// unmatchedRoute labels requests that match no route, so that arbitrary
+// paths cannot blow up the number of series.
+const unmatchedRoute = "unmatched"
+
+// metricsMiddleware records the request count, latency and in-flight
+// gauge. Requests are labelled with the chi route pattern rather than the
+// raw path so /users/1 and /users/2 share a series.
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		httpRequestsInFlight.Inc()
+		defer httpRequestsInFlight.Dec()
+
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		route := unmatchedRoute
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		code := strconv.Itoa(status)
+
+		httpRequestsTotal.WithLabelValues(r.Method, route, code).Inc()
+		httpRequestDuration.WithLabelValues(r.Method, route, code).Observe(time.Since(start).Seconds())
+	})
+}
+
+// metricsHandler serves the registry in the Prometheus text format.
+func metricsHandler() http.Handler {
+	return promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})
+}
+
+// userCounter is implemented by stores that can count users without
+// listing them.
+type userCounter interface {
+	Count() (int, error)
+}
+
+func countUsers() (int, error) {
+	if c, ok := store.(userCounter); ok {
+		return c.Count()
+	}
+	userList, err := store.List()
+	return len(userList), err
+}
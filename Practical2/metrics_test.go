@@ -0,0 +1,67 @@
+// metrics_test.go
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetricsMiddleware(t *testing.T) {
+	resetState()
+	setUser(User{ID: 1, Name: "Alice"})
+	setUser(User{ID: 2, Name: "Bob"})
+
+	found := httpRequestsTotal.WithLabelValues("GET", "/v1/users/{id}", "200")
+	missing := httpRequestsTotal.WithLabelValues("GET", "/v1/users/{id}", "404")
+	unmatched := httpRequestsTotal.WithLabelValues("GET", unmatchedRoute, "404")
+	beforeFound := testutil.ToFloat64(found)
+	beforeMissing := testutil.ToFloat64(missing)
+	beforeUnmatched := testutil.ToFloat64(unmatched)
+
+	serve(t, "GET", "/v1/users/1", "", nil)
+	serve(t, "GET", "/v1/users/2", "", nil)
+	serve(t, "GET", "/v1/users/99", "", nil)
+	serve(t, "GET", "/no/such/route", "", nil)
+
+	// Both IDs share the route pattern series
+	if got := testutil.ToFloat64(found) - beforeFound; got != 2 {
+		t.Errorf("wrong count for 200 responses: got %v want %v", got, 2)
+	}
+	if got := testutil.ToFloat64(missing) - beforeMissing; got != 1 {
+		t.Errorf("wrong count for 404 responses: got %v want %v", got, 1)
+	}
+	if got := testutil.ToFloat64(unmatched) - beforeUnmatched; got != 1 {
+		t.Errorf("wrong count for unmatched routes: got %v want %v", got, 1)
+	}
+	if got := testutil.ToFloat64(httpRequestsInFlight); got != 0 {
+		t.Errorf("in-flight gauge did not return to zero: got %v", got)
+	}
+	if got := testutil.ToFloat64(usersStored); got != 2 {
+		t.Errorf("wrong users_stored gauge: got %v want %v", got, 2)
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	resetState()
+	serve(t, "GET", "/v1/users", "", nil)
+
+	rr := serve(t, "GET", "/metrics", "", nil)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	body := rr.Body.String()
+	for _, want := range []string{
+		`http_requests_total{code="200",method="GET",route="/v1/users"}`,
+		`http_request_duration_seconds_bucket{code="200",method="GET",route="/v1/users",le="+Inf"}`,
+		"http_requests_in_flight",
+		"users_stored 0",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics output is missing %s", want)
+		}
+	}
+}
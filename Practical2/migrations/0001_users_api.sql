@@ -0,0 +1,8 @@
+-- The users API shares the users table of Practical5 and adds to it: a
+-- version counter for conditional writes, when a user was last written,
+-- and when it was deleted. Users created through v1 have no email.
+ALTER TABLE users ADD COLUMN IF NOT EXISTS version INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
+ALTER TABLE users ALTER COLUMN email DROP NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_users_deleted_at ON users(deleted_at) WHERE deleted_at IS NOT NULL;
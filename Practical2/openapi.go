@@ -0,0 +1,325 @@
+// openapi.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/gorillamux"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+//go:embed api/openapi.json api/docs.html
+var apiFiles embed.FS
+
+// Modes of the OpenAPI validation middleware. In warn mode responses that
+// do not match the spec are logged; in strict mode they are replaced with
+// a 500. Requests that do not match are rejected in both modes.
+const (
+	openAPIOff    = "off"
+	openAPIWarn   = "warn"
+	openAPIStrict = "strict"
+)
+
+// specValidator checks requests and responses against the OpenAPI
+// document. Validation is off when it is nil.
+var specValidator *OpenAPIValidator
+
+// OpenAPIValidator validates traffic against the embedded OpenAPI document.
+type OpenAPIValidator struct {
+	router routers.Router
+	strict bool
+}
+
+// loadOpenAPI parses and validates the embedded OpenAPI document.
+func loadOpenAPI() (*openapi3.T, error) {
+	data, err := apiFiles.ReadFile("api/openapi.json")
+	if err != nil {
+		return nil, err
+	}
+	doc, err := openapi3.NewLoader().LoadFromData(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := doc.Validate(context.Background()); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// NewOpenAPIValidator returns a validator for mode, or nil when mode is off.
+func NewOpenAPIValidator(mode string) (*OpenAPIValidator, error) {
+	if mode == openAPIOff {
+		return nil, nil
+	}
+	doc, err := loadOpenAPI()
+	if err != nil {
+		return nil, fmt.Errorf("load OpenAPI document: %w", err)
+	}
+	router, err := gorillamux.NewRouter(doc)
+	if err != nil {
+		return nil, err
+	}
+	return &OpenAPIValidator{router: router, strict: mode == openAPIStrict}, nil
+}
+
+// openAPIHandler serves the OpenAPI document.
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	serveAPIFile(w, "api/openapi.json", "application/json")
+}
+
+// docsHandler serves a page that renders the OpenAPI document.
+func docsHandler(w http.ResponseWriter, r *http.Request) {
+	serveAPIFile(w, "api/docs.html", "text/html; charset=utf-8")
+}
+
+func serveAPIFile(w http.ResponseWriter, name, contentType string) {
+	data, _ := apiFiles.ReadFile(name)
+	w.Header().Set("Content-Type", contentType)
+	w.Write(data)
+}
+
+// The validator decodes bodies by content type and only knows JSON and CSV
+// of the user list formats.
+func init() {
+	openapi3filter.RegisterBodyDecoder(mediaTypeNDJSON, ndjsonBodyDecoder)
+	openapi3filter.RegisterBodyDecoder(mediaTypeMsgpack, msgpackBodyDecoder)
+}
+
+// ndjsonBodyDecoder decodes an NDJSON body into an array of its values.
+func ndjsonBodyDecoder(body io.Reader, header http.Header, schema *openapi3.SchemaRef, encFn openapi3filter.EncodingFn) (any, error) {
+	dec := json.NewDecoder(body)
+	dec.UseNumber()
+	values := []any{}
+	for {
+		var v any
+		err := dec.Decode(&v)
+		if err == io.EOF {
+			return values, nil
+		}
+		if err != nil {
+			return nil, &openapi3filter.ParseError{Kind: openapi3filter.KindInvalidFormat, Cause: err}
+		}
+		values = append(values, v)
+	}
+}
+
+// msgpackBodyDecoder decodes a MessagePack body into the values JSON would
+// give, so schemas apply to both alike.
+func msgpackBodyDecoder(body io.Reader, header http.Header, schema *openapi3.SchemaRef, encFn openapi3filter.EncodingFn) (any, error) {
+	var v any
+	if err := msgpack.NewDecoder(body).Decode(&v); err != nil {
+		return nil, &openapi3filter.ParseError{Kind: openapi3filter.KindInvalidFormat, Cause: err}
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, &openapi3filter.ParseError{Kind: openapi3filter.KindInvalidFormat, Cause: err}
+	}
+	return openapi3filter.JSONBodyDecoder(bytes.NewReader(data), header, schema, encFn)
+}
+
+var openAPIOptions = &openapi3filter.Options{
+	// Authentication is enforced by the auth middleware, and defaults
+	// must not be written into the request the handlers see.
+	AuthenticationFunc:  openapi3filter.NoopAuthenticationFunc,
+	SkipSettingDefaults: true,
+	MultiError:          true,
+}
+
+// Middleware rejects requests that do not match the OpenAPI document and
+// checks the responses to the ones that do. Paths the document does not
+// describe are passed through untouched.
+func (v *OpenAPIValidator) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route, params, err := v.router.FindRoute(r)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		input := &openapi3filter.RequestValidationInput{
+			Request:    specRequest(r),
+			PathParams: params,
+			Route:      route,
+			Options:    openAPIOptions,
+		}
+		if err := openapi3filter.ValidateRequest(r.Context(), input); err != nil {
+			writeSpecViolation(w, r, err)
+			return
+		}
+		r.Body = input.Request.Body
+
+		// Event streams never end, so they cannot be buffered
+		if streams(route) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		bw := &bufferWriter{header: make(http.Header), status: http.StatusOK}
+		next.ServeHTTP(bw, r)
+
+		err = openapi3filter.ValidateResponse(r.Context(), &openapi3filter.ResponseValidationInput{
+			RequestValidationInput: input,
+			Status:                 bw.status,
+			Header:                 bw.header,
+			Body:                   io.NopCloser(bytes.NewReader(bw.body.Bytes())),
+			Options:                openAPIOptions,
+		})
+		if err != nil {
+			loggerFrom(r.Context()).Error("response does not match OpenAPI document",
+				slog.Int("status", bw.status),
+				slog.Any("error", err),
+			)
+			if v.strict {
+				writeProblem(w, r, Problem{
+					Type:   problemInternal,
+					Title:  "Internal server error",
+					Status: http.StatusInternalServerError,
+					Detail: "The response did not match the API specification.",
+				})
+				return
+			}
+		}
+		bw.flush(w)
+	})
+}
+
+// streams reports whether the route responds with an event stream.
+func streams(route *routers.Route) bool {
+	ok := route.Operation.Responses.Status(http.StatusOK)
+	return ok != nil && ok.Value != nil && ok.Value.Content.Get("text/event-stream") != nil
+}
+
+// specRequest returns the request to validate. Handlers accept JSON bodies
+// without a Content-Type, so the validator is told to expect JSON too.
+func specRequest(r *http.Request) *http.Request {
+	if r.ContentLength == 0 || r.Header.Get("Content-Type") != "" {
+		return r
+	}
+	clone := r.Clone(r.Context())
+	clone.Header.Set("Content-Type", "application/json")
+	return clone
+}
+
+// writeSpecViolation responds with 422 when the request body breaks the
+// schema and with 400 when a parameter or header does.
+func writeSpecViolation(w http.ResponseWriter, r *http.Request, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeBodyTooLarge(w, r)
+		return
+	}
+
+	var fields []FieldError
+	status := http.StatusUnprocessableEntity
+	for _, e := range specErrors(err) {
+		var reqErr *openapi3filter.RequestError
+		if errors.As(e, &reqErr) && reqErr.Parameter != nil {
+			status = http.StatusBadRequest
+			fields = append(fields, FieldError{Field: reqErr.Parameter.Name, Message: reqErr.Error()})
+			continue
+		}
+		var schemaErr *openapi3.SchemaError
+		if errors.As(e, &schemaErr) {
+			fields = append(fields, schemaFields(schemaErr)...)
+			continue
+		}
+		status = http.StatusBadRequest
+		fields = append(fields, FieldError{Message: e.Error()})
+	}
+
+	writeProblem(w, r, Problem{
+		Type:   problemSpecViolation,
+		Title:  "Request does not match the API specification",
+		Status: status,
+		Errors: fields,
+	})
+}
+
+// specErrors flattens the errors reported by openapi3filter, including
+// the schema errors of a request body.
+func specErrors(err error) []error {
+	switch e := err.(type) {
+	case openapi3.MultiError:
+		var errs []error
+		for _, inner := range e {
+			errs = append(errs, specErrors(inner)...)
+		}
+		return errs
+	case *openapi3filter.RequestError:
+		if e.Parameter == nil && e.Err != nil {
+			return specErrors(e.Err)
+		}
+	}
+	return []error{err}
+}
+
+// schemaFields turns a schema error into field errors. JSON Schema 2020-12
+// validation reports every failure as an "at '<pointer>': <message>" line
+// of the reason rather than as separate errors.
+func schemaFields(err *openapi3.SchemaError) []FieldError {
+	if ptr := err.JSONPointer(); len(ptr) > 0 {
+		return []FieldError{{Field: strings.Join(ptr, "."), Message: err.Reason}}
+	}
+
+	var fields []FieldError
+	for _, line := range strings.Split(err.Reason, "\n") {
+		rest, ok := strings.CutPrefix(strings.TrimLeft(line, " -"), "at '")
+		if !ok {
+			continue
+		}
+		ptr, msg, ok := strings.Cut(rest, "': ")
+		if !ok || msg == "validation failed" {
+			continue
+		}
+		fields = append(fields, FieldError{
+			Field:   strings.ReplaceAll(strings.TrimPrefix(ptr, "/"), "/", "."),
+			Message: msg,
+		})
+	}
+	if len(fields) == 0 {
+		return []FieldError{{Message: err.Reason}}
+	}
+	return fields
+}
+
+// bufferWriter holds a response back until it has been validated.
+type bufferWriter struct {
+	header      http.Header
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (bw *bufferWriter) Header() http.Header { return bw.header }
+
+func (bw *bufferWriter) WriteHeader(status int) {
+	if !bw.wroteHeader {
+		bw.status = status
+		bw.wroteHeader = true
+	}
+}
+
+func (bw *bufferWriter) Write(b []byte) (int, error) {
+	bw.wroteHeader = true
+	return bw.body.Write(b)
+}
+
+func (bw *bufferWriter) flush(w http.ResponseWriter) {
+	for name, values := range bw.header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(bw.status)
+	w.Write(bw.body.Bytes())
+}
@@ -0,0 +1,199 @@
+// openapi_test.go
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func enableSpecValidation(t *testing.T) {
+	t.Helper()
+
+	v, err := NewOpenAPIValidator(openAPIStrict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	specValidator = v
+	t.Cleanup(func() { specValidator = nil })
+}
+
+func TestOpenAPIDocument(t *testing.T) {
+	if _, err := loadOpenAPI(); err != nil {
+		t.Fatalf("OpenAPI document is invalid: %v", err)
+	}
+
+	rr := serve(t, "GET", "/openapi.json", "", nil)
+	if rr.Code != 200 {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, 200)
+	}
+	var doc struct {
+		OpenAPI string                     `json:"openapi"`
+		Paths   map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.OpenAPI != "3.1.0" {
+		t.Errorf("wrong OpenAPI version: got %v want %v", doc.OpenAPI, "3.1.0")
+	}
+	for _, path := range []string{"/v1/users", "/v1/users/events", "/v1/users/{id}", "/v1/users:batch", "/v1/webhooks", "/v1/webhooks/{id}", "/v2/users", "/v2/users/{id}", "/v2/users:batch", "/v2/webhooks", "/healthz", "/readyz", "/version", "/metrics"} {
+		if _, ok := doc.Paths[path]; !ok {
+			t.Errorf("OpenAPI document does not describe %v", path)
+		}
+	}
+
+	rr = serve(t, "GET", "/docs", "", nil)
+	if ct := rr.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("docs page has wrong content type: got %v", ct)
+	}
+}
+
+// TestOpenAPIContract drives the user routes through the strict validator,
+// which turns any response that drifts from the document into a 500.
+func TestOpenAPIContract(t *testing.T) {
+	resetState()
+	enableSpecValidation(t)
+
+	packed, err := msgpack.Marshal([]map[string]any{{"name": "Erin"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	csvType := map[string]string{"Content-Type": "text/csv", "Accept": "text/csv"}
+	ndjsonType := map[string]string{"Content-Type": "application/x-ndjson", "Accept": "application/x-ndjson"}
+	msgpackType := map[string]string{"Content-Type": "application/msgpack", "Accept": "application/msgpack"}
+
+	steps := []struct {
+		name    string
+		method  string
+		url     string
+		body    string
+		headers map[string]string
+		status  int
+	}{
+		{"create", "POST", "/v1/users", `{"name": "Alice"}`, nil, 201},
+		{"create another", "POST", "/v1/users", `{"name": "Bob"}`, map[string]string{"Content-Type": "application/json"}, 201},
+		{"list", "GET", "/v1/users?limit=1&sort=-name", "", nil, 200},
+		{"get", "GET", "/v1/users/1", "", nil, 200},
+		{"get unchanged", "GET", "/v1/users/1", "", map[string]string{"If-None-Match": `"1"`}, 304},
+		{"get missing", "GET", "/v1/users/99", "", nil, 404},
+		{"update", "PUT", "/v1/users/1", `{"name": "Alicia"}`, map[string]string{"If-Match": `"1"`}, 200},
+		{"stale update", "PUT", "/v1/users/1", `{"name": "Alice"}`, map[string]string{"If-Match": `"1"`}, 412},
+		{"merge patch", "PATCH", "/v1/users/2", `{"name": "Robert"}`, map[string]string{"Content-Type": "application/merge-patch+json"}, 200},
+		{"json patch", "PATCH", "/v1/users/2", `[{"op": "replace", "path": "/name", "value": "Rob"}]`, map[string]string{"Content-Type": "application/json-patch+json"}, 200},
+		{"batch", "POST", "/v1/users:batch", `{"mode": "best-effort", "operations": [{"op": "create", "user": {"name": "Carol"}}, {"op": "delete", "id": 42}]}`, nil, 200},
+		{"delete", "DELETE", "/v1/users/2", "", nil, 204},
+		{"list CSV", "GET", "/v1/users", "", csvType, 200},
+		{"list NDJSON", "GET", "/v1/users", "", ndjsonType, 200},
+		{"list MessagePack", "GET", "/v1/users", "", msgpackType, 200},
+		{"list unacceptable", "GET", "/v1/users", "", map[string]string{"Accept": "application/xml"}, 406},
+		{"import CSV", "POST", "/v1/users", "name\nCarol\n", csvType, 201},
+		{"import NDJSON", "POST", "/v1/users", "{\"name\": \"Dan\"}\n", ndjsonType, 201},
+		{"import MessagePack", "POST", "/v1/users", string(packed), msgpackType, 201},
+		{"create webhook", "POST", "/v1/webhooks", `{"url": "https://example.com/hook", "events": ["user.created"]}`, nil, 201},
+		{"list webhooks", "GET", "/v1/webhooks", "", nil, 200},
+		{"update webhook", "PUT", "/v1/webhooks/1", `{"url": "https://example.com/hook", "active": false}`, nil, 200},
+		{"webhook deliveries", "GET", "/v1/webhooks/1/deliveries", "", nil, 200},
+		{"dead letters", "GET", "/v1/webhooks/dead-letters", "", nil, 200},
+		{"delete webhook", "DELETE", "/v1/webhooks/1", "", nil, 204},
+		{"v2 create", "POST", "/v2/users", `{"name": "Frank", "email": "frank@example.com"}`, nil, 201},
+		{"v2 create without email", "POST", "/v2/users", `{"name": "Grace"}`, nil, 422},
+		{"v2 get v1 user", "GET", "/v2/users/1", "", nil, 200},
+		{"v2 update", "PUT", "/v2/users/1", `{"name": "Alice", "email": "alice@example.com"}`, nil, 200},
+		{"v2 merge patch", "PATCH", "/v2/users/1", `{"email": "ali@example.com"}`, map[string]string{"Content-Type": "application/merge-patch+json"}, 200},
+		{"v2 list", "GET", "/v2/users?include_deleted=true", "", nil, 200},
+		{"v2 list CSV", "GET", "/v2/users", "", csvType, 200},
+		{"v2 import NDJSON", "POST", "/v2/users", "{\"name\": \"Heidi\", \"email\": \"heidi@example.com\"}\n", ndjsonType, 201},
+		{"v2 batch", "POST", "/v2/users:batch", `{"operations": [{"op": "create", "user": {"name": "Ivan", "email": "ivan@example.com"}}, {"op": "update", "id": 1, "user": {"name": "Alicia", "email": "alicia@example.com"}}]}`, nil, 200},
+		{"v2 restore", "POST", "/v2/users/2:restore", "", nil, 200},
+	}
+	for _, step := range steps {
+		rr := serve(t, step.method, step.url, step.body, step.headers)
+		if rr.Code != step.status {
+			t.Errorf("%s: handler returned wrong status code: got %v want %v (%s)", step.name, rr.Code, step.status, rr.Body)
+		}
+	}
+}
+
+func TestOpenAPIRequestValidation(t *testing.T) {
+	resetState()
+	setUser(User{ID: 1, Name: "Alice", Version: 1})
+	enableSpecValidation(t)
+
+	tests := []struct {
+		name   string
+		method string
+		url    string
+		body   string
+		status int
+		field  string
+	}{
+		{"name too long", "POST", "/v1/users", `{"name": "` + strings.Repeat("a", 101) + `"}`, 422, "name"},
+		{"unknown field", "PUT", "/v1/users/1", `{"name": "Alice", "role": "admin"}`, 422, ""},
+		{"bad limit", "GET", "/v1/users?limit=0", "", 400, "limit"},
+		{"bad sort", "GET", "/v1/users?sort=age", "", 400, "sort"},
+		{"non-numeric id", "GET", "/v1/users/abc", "", 400, "id"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := serve(t, tt.method, tt.url, tt.body, nil)
+			if rr.Code != tt.status {
+				t.Fatalf("handler returned wrong status code: got %v want %v (%s)", rr.Code, tt.status, rr.Body)
+			}
+
+			var p Problem
+			if err := json.NewDecoder(rr.Body).Decode(&p); err != nil {
+				t.Fatal(err)
+			}
+			if p.Type != problemSpecViolation {
+				t.Errorf("wrong problem type: got %v want %v", p.Type, problemSpecViolation)
+			}
+			if tt.field != "" && (len(p.Errors) == 0 || p.Errors[0].Field != tt.field) {
+				t.Errorf("wrong field errors: got %+v want field %v", p.Errors, tt.field)
+			}
+		})
+	}
+}
+
+func TestOpenAPIResponseValidation(t *testing.T) {
+	// The handler leaves out the required name of a User.
+	drifted := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"id": 1}`))
+	})
+
+	tests := []struct {
+		mode   string
+		status int
+	}{
+		{openAPIWarn, 200},
+		{openAPIStrict, 500},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			v, err := NewOpenAPIValidator(tt.mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			logs := captureLogs(t)
+
+			req, err := http.NewRequest("GET", "/v1/users/1", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rr := httptest.NewRecorder()
+			v.Middleware(drifted).ServeHTTP(rr, req)
+
+			if rr.Code != tt.status {
+				t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, tt.status)
+			}
+			if !strings.Contains(logs.String(), "response does not match OpenAPI document") {
+				t.Errorf("mismatch was not logged: %s", logs)
+			}
+		})
+	}
+}
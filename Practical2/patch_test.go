@@ -0,0 +1,164 @@
+// patch_test.go
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestPatchUserHandler(t *testing.T) {
+	testCases := []struct {
+		name        string
+		contentType string
+		payload     string
+		wantStatus  int
+		wantName    string
+	}{
+		{"Merge patch", mediaTypeMergePatch, `{"name": "Patched"}`, http.StatusOK, "Patched"},
+		{"Empty merge patch keeps user", mediaTypeMergePatch, `{}`, http.StatusOK, "Original Name"},
+		{"Merge patch removing name fails validation", mediaTypeMergePatch, `{"name": null}`, http.StatusUnprocessableEntity, ""},
+		{"Merge patch with unknown field", mediaTypeMergePatch, `{"role": "admin"}`, http.StatusUnprocessableEntity, ""},
+		{"Merge patch changing id", mediaTypeMergePatch, `{"id": 2}`, http.StatusUnprocessableEntity, ""},
+		{"JSON patch replace", mediaTypeJSONPatch, `[{"op": "test", "path": "/name", "value": "Original Name"}, {"op": "replace", "path": "/name", "value": "Replaced"}]`, http.StatusOK, "Replaced"},
+		{"JSON patch failed test", mediaTypeJSONPatch, `[{"op": "test", "path": "/name", "value": "Someone Else"}, {"op": "replace", "path": "/name", "value": "Replaced"}]`, http.StatusConflict, ""},
+		{"JSON patch missing path", mediaTypeJSONPatch, `[{"op": "remove", "path": "/email"}]`, http.StatusConflict, ""},
+		{"JSON patch unknown op", mediaTypeJSONPatch, `[{"op": "frobnicate", "path": "/name"}]`, http.StatusBadRequest, ""},
+		{"JSON patch invalid result", mediaTypeJSONPatch, `[{"op": "replace", "path": "/name", "value": ""}]`, http.StatusUnprocessableEntity, ""},
+		{"Unsupported content type", "application/json", `{"name": "Patched"}`, http.StatusUnsupportedMediaType, ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resetState()
+			setUser(User{ID: 1, Name: "Original Name"})
+
+			req, err := http.NewRequest("PATCH", "/users/1", bytes.NewBufferString(tc.payload))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", tc.contentType)
+
+			rr := httptest.NewRecorder()
+			router := chi.NewRouter()
+			router.Patch("/users/{id}", patchUserHandler)
+			router.ServeHTTP(rr, req)
+
+			if status := rr.Code; status != tc.wantStatus {
+				t.Fatalf("handler returned wrong status code: got %v want %v (%s)", status, tc.wantStatus, rr.Body)
+			}
+
+			if tc.wantStatus != http.StatusOK {
+				// A rejected patch must leave the stored user untouched
+				if peekUser(1).Name != "Original Name" {
+					t.Errorf("rejected patch modified the user: got %v", peekUser(1).Name)
+				}
+				return
+			}
+
+			var patched User
+			if err := json.NewDecoder(rr.Body).Decode(&patched); err != nil {
+				t.Fatal(err)
+			}
+			if patched.Name != tc.wantName || patched.ID != 1 {
+				t.Errorf("handler returned unexpected user: got %+v want name %v", patched, tc.wantName)
+			}
+			if peekUser(1).Name != tc.wantName {
+				t.Errorf("user was not patched in the store: got %v want %v", peekUser(1).Name, tc.wantName)
+			}
+		})
+	}
+}
+
+func TestPatchUserHandler_NotFound(t *testing.T) {
+	resetState()
+
+	req, err := http.NewRequest("PATCH", "/users/99", bytes.NewBufferString(`{"name": "Ghost"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", mediaTypeMergePatch)
+
+	rr := httptest.NewRecorder()
+	router := chi.NewRouter()
+	router.Patch("/users/{id}", patchUserHandler)
+	router.ServeHTTP(rr, req)
+
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusNotFound)
+	}
+}
+
+func TestApplyJSONPatch(t *testing.T) {
+	// Examples adapted from RFC 6902 Appendix A
+	testCases := []struct {
+		name  string
+		doc   string
+		patch string
+		want  string
+	}{
+		{"Add object member", `{"foo": "bar"}`, `[{"op": "add", "path": "/baz", "value": "qux"}]`, `{"baz": "qux", "foo": "bar"}`},
+		{"Add array element", `{"foo": ["bar", "baz"]}`, `[{"op": "add", "path": "/foo/1", "value": "qux"}]`, `{"foo": ["bar", "qux", "baz"]}`},
+		{"Append to array", `{"foo": ["bar"]}`, `[{"op": "add", "path": "/foo/-", "value": "baz"}]`, `{"foo": ["bar", "baz"]}`},
+		{"Remove array element", `{"foo": ["bar", "qux", "baz"]}`, `[{"op": "remove", "path": "/foo/1"}]`, `{"foo": ["bar", "baz"]}`},
+		{"Move value", `{"foo": {"bar": "baz", "waldo": "fred"}, "qux": {"corge": "grault"}}`, `[{"op": "move", "from": "/foo/waldo", "path": "/qux/thud"}]`, `{"foo": {"bar": "baz"}, "qux": {"corge": "grault", "thud": "fred"}}`},
+		{"Copy value", `{"a": {"b": 1}}`, `[{"op": "copy", "from": "/a", "path": "/c"}]`, `{"a": {"b": 1}, "c": {"b": 1}}`},
+		{"Escaped pointer", `{"a/b": 1, "m~n": 2}`, `[{"op": "replace", "path": "/a~1b", "value": 3}, {"op": "remove", "path": "/m~0n"}]`, `{"a/b": 3}`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var doc, want any
+			if err := json.Unmarshal([]byte(tc.doc), &doc); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal([]byte(tc.want), &want); err != nil {
+				t.Fatal(err)
+			}
+
+			ops, err := parseJSONPatch([]byte(tc.patch))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := applyJSONPatch(doc, ops)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("applyJSONPatch returned %v want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestMergePatch(t *testing.T) {
+	// Examples from RFC 7396 Appendix A
+	testCases := []struct {
+		target string
+		patch  string
+		want   string
+	}{
+		{`{"a": "b"}`, `{"a": "c"}`, `{"a": "c"}`},
+		{`{"a": "b"}`, `{"a": null}`, `{}`},
+		{`{"a": {"b": "c"}}`, `{"a": {"b": "d", "c": null}}`, `{"a": {"b": "d"}}`},
+		{`{"a": "foo"}`, `"bar"`, `"bar"`},
+		{`["a", "b"]`, `{"a": "c"}`, `{"a": "c"}`},
+	}
+
+	for _, tc := range testCases {
+		var target, patch, want any
+		json.Unmarshal([]byte(tc.target), &target)
+		json.Unmarshal([]byte(tc.patch), &patch)
+		json.Unmarshal([]byte(tc.want), &want)
+
+		if got := mergePatch(target, patch); !reflect.DeepEqual(got, want) {
+			t.Errorf("mergePatch(%s, %s) = %v want %v", tc.target, tc.patch, got, want)
+		}
+	}
+}
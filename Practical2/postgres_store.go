@@ -0,0 +1,435 @@
+// postgres_store.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"SWE302_p5/repository"
+
+	"github.com/lib/pq"
+)
+
+// PostgresStore persists users in the users table of Practical5. The
+// repository of that module deletes rows for good, knows nothing of
+// deletion marks and expects every user to have an email, so the store
+// runs its own queries over the columns its migrations add and change.
+//
+// Writes are serialized by mu, which is held until their events are
+// published, so the change feed sees them in commit order.
+type PostgresStore struct {
+	db *sql.DB
+	mu sync.Mutex
+}
+
+// NewPostgresStore creates a store backed by db. Call Migrate before use.
+func NewPostgresStore(db *sql.DB) *PostgresStore {
+	return &PostgresStore{db: db}
+}
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLock is the key of the advisory lock held while migrating, so
+// instances that start together do not apply a migration twice.
+const migrationLock = 0x75736572 // "user"
+
+// Migrate applies the migrations in migrations/ that the database has not
+// seen yet, in name order and each in its own transaction, and records
+// them in users_api_migrations so they run once.
+func (s *PostgresStore) Migrate(ctx context.Context) error {
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to migrate users table: %w", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLock); err != nil {
+		return fmt.Errorf("failed to lock migrations: %w", err)
+	}
+	defer conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLock)
+
+	if _, err := conn.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS users_api_migrations (name TEXT PRIMARY KEY, applied_at TIMESTAMPTZ NOT NULL DEFAULT now())"); err != nil {
+		return fmt.Errorf("failed to create migrations table: %w", err)
+	}
+
+	names, err := fs.Glob(migrationFiles, "migrations/*.sql")
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := applyMigration(ctx, conn, name); err != nil {
+			return fmt.Errorf("failed to apply %s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// applyMigration runs the migration in the named file unless it is
+// already recorded.
+func applyMigration(ctx context.Context, conn *sql.Conn, name string) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, "INSERT INTO users_api_migrations (name) VALUES ($1) ON CONFLICT DO NOTHING", path.Base(name))
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return err
+	}
+
+	migration, err := migrationFiles.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, string(migration)); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	logger.Info("applied database migration", slog.String("migration", path.Base(name)))
+	return nil
+}
+
+// Ping checks that the database is reachable.
+func (s *PostgresStore) Ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+// List returns every live user ordered by ID.
+func (s *PostgresStore) List() ([]User, error) {
+	return queryUsers(s.db, "SELECT "+userColumns+" FROM users WHERE deleted_at IS NULL ORDER BY id")
+}
+
+// ListWithDeleted returns every user, deleted or not, ordered by ID.
+func (s *PostgresStore) ListWithDeleted() ([]User, error) {
+	return queryUsers(s.db, "SELECT "+userColumns+" FROM users ORDER BY id")
+}
+
+// pageOrders are the ORDER BY clauses of the sorts of listQuery. Names
+// compare by their lowercase bytes and ties fall back to ID, as in apply.
+var pageOrders = map[string]string{
+	"id":    "id",
+	"-id":   "id DESC",
+	"name":  `lower(name) COLLATE "C", id`,
+	"-name": `lower(name) COLLATE "C" DESC, id DESC`,
+}
+
+// ListPage filters, sorts and pages users in SQL. The page and the total
+// are read in one snapshot, so they agree with each other.
+func (s *PostgresStore) ListPage(q listQuery) ([]User, int, error) {
+	var where []string
+	var args []any
+	if !q.includeDeleted {
+		where = append(where, "deleted_at IS NULL")
+	}
+	if q.name != "" {
+		args = append(args, q.name)
+		where = append(where, fmt.Sprintf("strpos(lower(name), lower($%d)) > 0", len(args)))
+	}
+	filter := ""
+	if len(where) > 0 {
+		filter = " WHERE " + strings.Join(where, " AND ")
+	}
+
+	tx, err := s.db.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var total int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM users"+filter, args...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("failed to count users: %w", err)
+	}
+	page, err := queryUsers(tx, fmt.Sprintf("SELECT %s FROM users%s ORDER BY %s LIMIT %d OFFSET %d",
+		userColumns, filter, pageOrders[q.sort], q.limit, q.offset), args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	return page, total, tx.Commit()
+}
+
+// Count returns the number of live users.
+func (s *PostgresStore) Count() (int, error) {
+	var n int
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM users WHERE deleted_at IS NULL").Scan(&n); err != nil {
+		return 0, fmt.Errorf("failed to count users: %w", err)
+	}
+	return n, nil
+}
+
+// Get returns the live user with the given ID.
+func (s *PostgresStore) Get(id int) (User, error) {
+	return getLive(s.db, id)
+}
+
+// Create inserts user. Users created through v1 have no email, which is
+// stored as NULL.
+func (s *PostgresStore) Create(user User) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, err := createWith(s.db, user)
+	if err != nil {
+		return User{}, err
+	}
+	publishUser(EventCreated, user)
+	return user, nil
+}
+
+// Update replaces the name of the user with the given ID, and its email
+// when user has one, and bumps its version.
+func (s *PostgresStore) Update(id int, user User, expectVersion int) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, err := updateWith(s.db, id, user, expectVersion)
+	if err != nil {
+		return User{}, err
+	}
+	publishUser(EventUpdated, user)
+	return user, nil
+}
+
+// Delete marks the user with the given ID as deleted and bumps its
+// version.
+func (s *PostgresStore) Delete(id int, expectVersion int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, err := deleteWith(s.db, id, expectVersion)
+	if err != nil {
+		return err
+	}
+	publishUser(EventDeleted, user)
+	return nil
+}
+
+// Restore clears the deletion mark of the user with the given ID.
+func (s *PostgresStore) Restore(id int) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	row := s.db.QueryRow("UPDATE users SET deleted_at = NULL, updated_at = now(), version = version + 1 WHERE id = $1 AND deleted_at IS NOT NULL RETURNING "+userColumns, id)
+	user, err := scanUser(row)
+	if err == nil {
+		publishUser(EventRestored, user)
+		return user, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return User{}, fmt.Errorf("failed to restore user: %w", err)
+	}
+
+	var exists bool
+	if err := s.db.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE id = $1)", id).Scan(&exists); err != nil {
+		return User{}, fmt.Errorf("failed to get user: %w", err)
+	}
+	if exists {
+		return User{}, ErrUserNotDeleted
+	}
+	return User{}, ErrUserNotFound
+}
+
+// Purge removes the users deleted before cutoff.
+func (s *PostgresStore) Purge(cutoff time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result, err := s.db.Exec("DELETE FROM users WHERE deleted_at < $1", cutoff)
+	if err != nil {
+		return 0, fmt.Errorf("failed to purge users: %w", err)
+	}
+	n, err := result.RowsAffected()
+	return int(n), err
+}
+
+// Batch applies ops one by one. An atomic batch runs in a transaction that
+// is rolled back at the first failure.
+func (s *PostgresStore) Batch(ops []BatchOp, atomic bool) ([]BatchResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var db repository.DBExecutor = s.db
+	var tx *sql.Tx
+	if atomic {
+		var err error
+		if tx, err = s.db.Begin(); err != nil {
+			return nil, fmt.Errorf("failed to begin batch: %w", err)
+		}
+		defer tx.Rollback()
+		db = tx
+	}
+
+	results := make([]BatchResult, len(ops))
+	for i, op := range ops {
+		switch op.Op {
+		case BatchCreate:
+			results[i].User, results[i].Err = createWith(db, op.User)
+		case BatchUpdate:
+			results[i].User, results[i].Err = updateWith(db, op.ID, op.User, op.ExpectVersion)
+		case BatchDelete:
+			results[i].User, results[i].Err = deleteWith(db, op.ID, op.ExpectVersion)
+		default:
+			results[i].Err = fmt.Errorf("unknown batch operation %q", op.Op)
+		}
+
+		if atomic && results[i].Err != nil {
+			abortBatch(results, i)
+			return results, nil
+		}
+	}
+
+	if tx != nil {
+		if err := tx.Commit(); err != nil {
+			return nil, fmt.Errorf("failed to commit batch: %w", err)
+		}
+	}
+	for i, res := range results {
+		if res.Err == nil {
+			publishUser(batchEvents[ops[i].Op], res.User)
+		}
+	}
+	return results, nil
+}
+
+// batchEvents maps batch operations to the events they publish.
+var batchEvents = map[string]string{
+	BatchCreate: EventCreated,
+	BatchUpdate: EventUpdated,
+	BatchDelete: EventDeleted,
+}
+
+// userColumns are the columns scanUser reads, in order.
+const userColumns = "id, email, name, version, created_at, updated_at, deleted_at"
+
+func getLive(db repository.DBExecutor, id int) (User, error) {
+	user, err := scanUser(db.QueryRow("SELECT "+userColumns+" FROM users WHERE id = $1 AND deleted_at IS NULL", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, ErrUserNotFound
+	}
+	return user, err
+}
+
+func createWith(db repository.DBExecutor, user User) (User, error) {
+	row := db.QueryRow("INSERT INTO users (email, name, updated_at) VALUES (NULLIF($1, ''), $2, now()) RETURNING "+userColumns, user.Email, user.Name)
+	created, err := scanUser(row)
+	if isUniqueViolation(err) {
+		return User{}, ErrEmailTaken
+	}
+	if err != nil {
+		return User{}, fmt.Errorf("failed to create user: %w", err)
+	}
+	return created, nil
+}
+
+// uniqueViolation is the SQLSTATE of a failed unique constraint. The only
+// unique column the API writes is users.email.
+const uniqueViolation = "23505"
+
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == uniqueViolation
+}
+
+// updateWith checks the version in the statement that changes the row, so
+// no other write can come between the check and the change. An expected
+// version of 0 matches any.
+func updateWith(db repository.DBExecutor, id int, user User, expectVersion int) (User, error) {
+	// An empty email keeps the stored one
+	row := db.QueryRow("UPDATE users SET email = COALESCE(NULLIF($1, ''), email), name = $2, version = version + 1, updated_at = now() WHERE id = $3 AND deleted_at IS NULL AND ($4 = 0 OR version = $4) RETURNING "+userColumns, user.Email, user.Name, id, expectVersion)
+	updated, err := scanUser(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, missedWrite(db, id)
+	}
+	if isUniqueViolation(err) {
+		return User{}, ErrEmailTaken
+	}
+	if err != nil {
+		return User{}, fmt.Errorf("failed to update user: %w", err)
+	}
+	return updated, nil
+}
+
+// deleteWith checks the version like updateWith and returns the user as
+// it was marked.
+func deleteWith(db repository.DBExecutor, id int, expectVersion int) (User, error) {
+	row := db.QueryRow("UPDATE users SET deleted_at = now(), updated_at = now(), version = version + 1 WHERE id = $1 AND deleted_at IS NULL AND ($2 = 0 OR version = $2) RETURNING "+userColumns, id, expectVersion)
+	deleted, err := scanUser(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return User{}, missedWrite(db, id)
+	}
+	if err != nil {
+		return User{}, fmt.Errorf("failed to delete user: %w", err)
+	}
+	return deleted, nil
+}
+
+// missedWrite explains why a conditional write changed no row: the user is
+// gone, or it is there with another version.
+func missedWrite(db repository.DBExecutor, id int) error {
+	if _, err := getLive(db, id); err != nil {
+		return err
+	}
+	return ErrVersionMismatch
+}
+
+func queryUsers(db repository.DBExecutor, query string, args ...any) ([]User, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list users: %w", err)
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan user: %w", err)
+		}
+		users = append(users, user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating users: %w", err)
+	}
+	return users, nil
+}
+
+// scanUser reads a row of userColumns. Users created through v1 have no
+// email, and rows written before updated_at existed have no update time.
+func scanUser(row interface{ Scan(...any) error }) (User, error) {
+	var (
+		user      User
+		email     sql.NullString
+		updatedAt sql.NullTime
+		deletedAt sql.NullTime
+	)
+	if err := row.Scan(&user.ID, &email, &user.Name, &user.Version, &user.CreatedAt, &updatedAt, &deletedAt); err != nil {
+		return User{}, err
+	}
+
+	user.Email = email.String
+	user.CreatedAt = user.CreatedAt.UTC()
+	if updatedAt.Valid {
+		user.UpdatedAt = updatedAt.Time.UTC()
+	}
+	if deletedAt.Valid {
+		t := deletedAt.Time.UTC()
+		user.DeletedAt = &t
+	}
+	return user, nil
+}
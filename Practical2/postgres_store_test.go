@@ -0,0 +1,317 @@
+// postgres_store_test.go
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/modules/postgres"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+// The Postgres container is started by the first test that needs it and
+// shared by the rest; TestMain removes it.
+var (
+	pgOnce      sync.Once
+	pgContainer *postgres.PostgresContainer
+	pgDB        *sql.DB
+	pgErr       error
+)
+
+func TestMain(m *testing.M) {
+	code := m.Run()
+	if pgDB != nil {
+		pgDB.Close()
+	}
+	if pgContainer != nil {
+		pgContainer.Terminate(context.Background())
+	}
+	os.Exit(code)
+}
+
+// openPostgresStore returns a migrated store over an empty users table,
+// created from the schema of Practical5. The test is skipped when Docker
+// is not available.
+func openPostgresStore(t *testing.T) *PostgresStore {
+	t.Helper()
+	testcontainers.SkipIfProviderIsNotHealthy(t)
+
+	pgOnce.Do(func() {
+		ctx := context.Background()
+		pgContainer, pgErr = postgres.Run(ctx, "postgres:15-alpine",
+			postgres.WithDatabase("testdb"),
+			postgres.WithUsername("testuser"),
+			postgres.WithPassword("testpass"),
+			postgres.WithInitScripts("../Practical5/migrations/init.sql"),
+			testcontainers.WithWaitStrategy(
+				wait.ForLog("database system is ready to accept connections").
+					WithOccurrence(2).
+					WithStartupTimeout(30*time.Second)),
+		)
+		if pgErr != nil {
+			return
+		}
+		connStr, err := pgContainer.ConnectionString(ctx, "sslmode=disable")
+		if err != nil {
+			pgErr = err
+			return
+		}
+		if pgDB, pgErr = sql.Open("postgres", connStr); pgErr != nil {
+			return
+		}
+		pgErr = NewPostgresStore(pgDB).Migrate(ctx)
+	})
+	if pgErr != nil {
+		t.Fatalf("could not start Postgres: %v", pgErr)
+	}
+
+	if _, err := pgDB.Exec("TRUNCATE users RESTART IDENTITY"); err != nil {
+		t.Fatal(err)
+	}
+	return NewPostgresStore(pgDB)
+}
+
+func TestPostgresStore(t *testing.T) {
+	s := openPostgresStore(t)
+
+	created, err := s.Create(User{Name: "Alice", Email: "alice@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.ID != 1 || created.Version != 1 || created.CreatedAt.IsZero() {
+		t.Errorf("Create returned wrong user: %+v", created)
+	}
+
+	// Users created through v1 have no email
+	anonymous, err := s.Create(User{Name: "Bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if anonymous.Email != "" {
+		t.Errorf("Create gave a v1 user an email: %q", anonymous.Email)
+	}
+
+	updated, err := s.Update(created.ID, User{Name: "Alicia"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Name != "Alicia" || updated.Email != "alice@example.com" || updated.Version != 2 {
+		t.Errorf("Update returned wrong user: %+v", updated)
+	}
+
+	found, err := s.Get(created.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.Name != "Alicia" || found.Version != 2 {
+		t.Errorf("Get returned wrong user: %+v", found)
+	}
+
+	users, err := s.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 2 || users[0].ID != 1 || users[1].ID != 2 {
+		t.Errorf("List returned wrong users: %+v", users)
+	}
+
+	if err := s.Delete(created.ID, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(created.ID); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Get after delete: got %v want %v", err, ErrUserNotFound)
+	}
+	if _, err := s.Update(created.ID, User{Name: "Ghost"}, 0); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Update after delete: got %v want %v", err, ErrUserNotFound)
+	}
+	if err := s.Delete(created.ID, 0); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Delete after delete: got %v want %v", err, ErrUserNotFound)
+	}
+}
+
+func TestPostgresStore_EmailTaken(t *testing.T) {
+	s := openPostgresStore(t)
+
+	s.Create(User{Name: "Alice", Email: "alice@example.com"})
+	bob, _ := s.Create(User{Name: "Bob", Email: "bob@example.com"})
+
+	if _, err := s.Create(User{Name: "Alicia", Email: "alice@example.com"}); !errors.Is(err, ErrEmailTaken) {
+		t.Errorf("Create with a taken email: got %v want %v", err, ErrEmailTaken)
+	}
+	if _, err := s.Update(bob.ID, User{Name: "Bob", Email: "alice@example.com"}, 0); !errors.Is(err, ErrEmailTaken) {
+		t.Errorf("Update to a taken email: got %v want %v", err, ErrEmailTaken)
+	}
+}
+
+func TestPostgresStore_Versions(t *testing.T) {
+	s := openPostgresStore(t)
+
+	created, _ := s.Create(User{Name: "Alice"})
+
+	if _, err := s.Update(created.ID, User{Name: "Alicia"}, created.Version+1); !errors.Is(err, ErrVersionMismatch) {
+		t.Errorf("Update with stale version: got %v want %v", err, ErrVersionMismatch)
+	}
+	if err := s.Delete(created.ID, created.Version+1); !errors.Is(err, ErrVersionMismatch) {
+		t.Errorf("Delete with stale version: got %v want %v", err, ErrVersionMismatch)
+	}
+
+	// Writing the same content back still moves the version on
+	renamed, _ := s.Update(created.ID, User{Name: "Alicia"}, created.Version)
+	reverted, err := s.Update(created.ID, User{Name: "Alice"}, renamed.Version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reverted.Version == created.Version {
+		t.Errorf("A->B->A kept version %v", reverted.Version)
+	}
+
+	// Of two writers holding the same version only one may win
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, errs[i] = s.Update(created.ID, User{Name: "Writer"}, reverted.Version)
+		}()
+	}
+	wg.Wait()
+
+	won := 0
+	for _, err := range errs {
+		switch {
+		case err == nil:
+			won++
+		case !errors.Is(err, ErrVersionMismatch):
+			t.Errorf("concurrent Update: got %v want %v", err, ErrVersionMismatch)
+		}
+	}
+	if won != 1 {
+		t.Errorf("concurrent writers with the same version: got %d successes want 1", won)
+	}
+}
+
+func TestPostgresStore_SoftDelete(t *testing.T) {
+	s := openPostgresStore(t)
+
+	created, _ := s.Create(User{Name: "Alice"})
+	s.Create(User{Name: "Bob"})
+	if err := s.Delete(created.ID, created.Version); err != nil {
+		t.Fatal(err)
+	}
+
+	if users, _ := s.List(); len(users) != 1 || users[0].Name != "Bob" {
+		t.Errorf("List included the deleted user: %+v", users)
+	}
+	all, err := s.ListWithDeleted()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 || all[0].DeletedAt == nil || all[1].DeletedAt != nil {
+		t.Errorf("ListWithDeleted returned wrong users: %+v", all)
+	}
+
+	restored, err := s.Restore(created.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.DeletedAt != nil || restored.Version != created.Version+2 {
+		t.Errorf("Restore returned wrong user: %+v", restored)
+	}
+	if _, err := s.Restore(created.ID); !errors.Is(err, ErrUserNotDeleted) {
+		t.Errorf("Restore of a live user: got %v want %v", err, ErrUserNotDeleted)
+	}
+	if _, err := s.Restore(99); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Restore of a missing user: got %v want %v", err, ErrUserNotFound)
+	}
+
+	s.Delete(created.ID, 0)
+	if n, err := s.Purge(time.Now().Add(time.Hour)); err != nil || n != 1 {
+		t.Errorf("Purge: got %v, %v want 1, nil", n, err)
+	}
+	if _, err := s.Restore(created.ID); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Restore after purge: got %v want %v", err, ErrUserNotFound)
+	}
+}
+
+func TestPostgresStore_ListPage(t *testing.T) {
+	s := openPostgresStore(t)
+	for _, name := range []string{"alice", "Bob", "Carol", "Dave", "Erin"} {
+		s.Create(User{Name: name})
+	}
+	s.Delete(4, 0)
+
+	names := func(users []User) []string {
+		out := []string{}
+		for _, user := range users {
+			out = append(out, user.Name)
+		}
+		return out
+	}
+
+	tests := []struct {
+		name  string
+		q     listQuery
+		want  []string
+		total int
+	}{
+		{"first page", listQuery{limit: 2, sort: "id"}, []string{"alice", "Bob"}, 4},
+		{"past the end", listQuery{limit: 2, offset: 10, sort: "id"}, []string{}, 4},
+		{"by name descending", listQuery{limit: 10, sort: "-name"}, []string{"Erin", "Carol", "Bob", "alice"}, 4},
+		{"name filter ignores case", listQuery{limit: 10, sort: "name", name: "A"}, []string{"alice", "Carol"}, 2},
+		{"with deleted", listQuery{limit: 10, sort: "-id", includeDeleted: true}, []string{"Erin", "Dave", "Carol", "Bob", "alice"}, 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, total, err := s.ListPage(tt.q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := names(page); !reflect.DeepEqual(got, tt.want) || total != tt.total {
+				t.Errorf("wrong page: got %v of %v want %v of %v", got, total, tt.want, tt.total)
+			}
+		})
+	}
+}
+
+func TestPostgresStore_Batch(t *testing.T) {
+	s := openPostgresStore(t)
+	s.Create(User{Name: "Alice"})
+
+	results, err := s.Batch([]BatchOp{
+		{Op: BatchCreate, User: User{Name: "Bob"}},
+		{Op: BatchUpdate, ID: 1, User: User{Name: "Alicia"}, ExpectVersion: 7},
+	}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(results[0].Err, ErrBatchAborted) || !errors.Is(results[1].Err, ErrVersionMismatch) {
+		t.Errorf("wrong atomic batch results: %+v", results)
+	}
+	if users, _ := s.List(); len(users) != 1 || users[0].Name != "Alice" {
+		t.Errorf("aborted batch left changes behind: %+v", users)
+	}
+}
+
+func TestPostgresStore_Migrate(t *testing.T) {
+	s := openPostgresStore(t)
+
+	// Migrations that ran already are skipped
+	if err := s.Migrate(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err := pgDB.QueryRow("SELECT COUNT(*) FROM users_api_migrations").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	if names, _ := migrationFiles.ReadDir("migrations"); n != len(names) {
+		t.Errorf("wrong number of recorded migrations: got %v want %v", n, len(names))
+	}
+}
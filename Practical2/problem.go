@@ -0,0 +1,191 @@
+// problem.go
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+)
+
+// Problem types returned in the "type" member of error responses.
+const (
+	problemInvalidBody           = "/problems/invalid-body"
+	problemValidationFailed      = "/problems/validation-failed"
+	problemInvalidUserID         = "/problems/invalid-user-id"
+	problemInvalidQuery          = "/problems/invalid-query"
+	problemUserNotFound          = "/problems/user-not-found"
+	problemUserNotDeleted        = "/problems/user-not-deleted"
+	problemEmailTaken            = "/problems/email-taken"
+	problemNotFound              = "/problems/not-found"
+	problemMethodNotAllowed      = "/problems/method-not-allowed"
+	problemUnsupportedMedia      = "/problems/unsupported-media-type"
+	problemNotAcceptable         = "/problems/not-acceptable"
+	problemPatchConflict         = "/problems/patch-conflict"
+	problemPrecondition          = "/problems/precondition-failed"
+	problemNotReady              = "/problems/not-ready"
+	problemUnauthorized          = "/problems/unauthorized"
+	problemForbidden             = "/problems/forbidden"
+	problemRateLimited           = "/problems/rate-limited"
+	problemBodyTooLarge          = "/problems/body-too-large"
+	problemBatchAborted          = "/problems/batch-aborted"
+	problemInvalidIdempotencyKey = "/problems/invalid-idempotency-key"
+	problemIdempotencyMismatch   = "/problems/idempotency-key-reused"
+	problemIdempotencyInFlight   = "/problems/idempotency-key-in-flight"
+	problemSpecViolation         = "/problems/spec-violation"
+	problemInvalidEventID        = "/problems/invalid-last-event-id"
+	problemWebhookNotFound       = "/problems/webhook-not-found"
+	problemInvalidWebhookID      = "/problems/invalid-webhook-id"
+	problemInternal              = "/problems/internal-error"
+)
+
+// Problem is an RFC 7807 problem details object. Validation failures list
+// the offending fields in the Errors extension member.
+type Problem struct {
+	Type     string       `json:"type"`
+	Title    string       `json:"title"`
+	Status   int          `json:"status"`
+	Detail   string       `json:"detail,omitempty"`
+	Instance string       `json:"instance,omitempty"`
+	Errors   []FieldError `json:"errors,omitempty"`
+}
+
+// writeProblem sends p as application/problem+json, filling in the title
+// and instance when they are empty.
+func writeProblem(w http.ResponseWriter, r *http.Request, p Problem) {
+	if p.Title == "" {
+		p.Title = http.StatusText(p.Status)
+	}
+	if p.Instance == "" {
+		p.Instance = r.URL.RequestURI()
+	}
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
+
+// writeInvalidUserID responds to a non-numeric {id} path parameter.
+func writeInvalidUserID(w http.ResponseWriter, r *http.Request) {
+	writeProblem(w, r, Problem{
+		Type:   problemInvalidUserID,
+		Title:  "Invalid user ID",
+		Status: http.StatusBadRequest,
+		Detail: "The user ID in the path must be an integer.",
+	})
+}
+
+// writeInternalError logs err and responds with 500 without leaking it.
+func writeInternalError(w http.ResponseWriter, r *http.Request, err error) {
+	loggerFrom(r.Context()).Error("request failed", slog.Any("error", err))
+	writeProblem(w, r, Problem{
+		Type:   problemInternal,
+		Status: http.StatusInternalServerError,
+	})
+}
+
+// writeStoreError maps a UserStore error to a problem response.
+func writeStoreError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, ErrUserNotFound) {
+		writeProblem(w, r, Problem{
+			Type:   problemUserNotFound,
+			Title:  "User not found",
+			Status: http.StatusNotFound,
+		})
+		return
+	}
+	if errors.Is(err, ErrUserNotDeleted) {
+		writeProblem(w, r, Problem{
+			Type:   problemUserNotDeleted,
+			Title:  "User not deleted",
+			Status: http.StatusConflict,
+			Detail: "Only deleted users can be restored.",
+		})
+		return
+	}
+	if errors.Is(err, ErrEmailTaken) {
+		writeProblem(w, r, emailTakenProblem())
+		return
+	}
+	if errors.Is(err, ErrVersionMismatch) {
+		writeProblem(w, r, Problem{
+			Type:   problemPrecondition,
+			Status: http.StatusPreconditionFailed,
+			Detail: "The user has changed since the entity tag in If-Match was issued.",
+		})
+		return
+	}
+	writeInternalError(w, r, err)
+}
+
+// emailTakenProblem is the 409 for a write whose email another user has.
+func emailTakenProblem() Problem {
+	return Problem{
+		Type:   problemEmailTaken,
+		Title:  "Email taken",
+		Status: http.StatusConflict,
+		Detail: "Another user already has this email address.",
+	}
+}
+
+// writeDecodeError responds with 422 and the failing fields for a
+// ValidationError, and with 400 for any other decoding error.
+func writeDecodeError(w http.ResponseWriter, r *http.Request, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeBodyTooLarge(w, r)
+		return
+	}
+
+	var verr *ValidationError
+	if errors.As(err, &verr) {
+		writeProblem(w, r, Problem{
+			Type:   problemValidationFailed,
+			Title:  "Validation failed",
+			Status: http.StatusUnprocessableEntity,
+			Detail: "One or more fields are invalid.",
+			Errors: verr.Fields,
+		})
+		return
+	}
+
+	writeProblem(w, r, Problem{
+		Type:   problemInvalidBody,
+		Title:  "Invalid request body",
+		Status: http.StatusBadRequest,
+		Detail: err.Error(),
+	})
+}
+
+// writePatchError responds with 409 when a patch cannot be applied to the
+// current user and with 400 when the patch itself is invalid.
+func writePatchError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, errPatchConflict) {
+		writeProblem(w, r, Problem{
+			Type:   problemPatchConflict,
+			Title:  "Patch cannot be applied",
+			Status: http.StatusConflict,
+			Detail: err.Error(),
+		})
+		return
+	}
+	writeDecodeError(w, r, err)
+}
+
+// notFoundHandler answers requests that match no route.
+func notFoundHandler(w http.ResponseWriter, r *http.Request) {
+	writeProblem(w, r, Problem{
+		Type:   problemNotFound,
+		Status: http.StatusNotFound,
+	})
+}
+
+// methodNotAllowedHandler answers requests whose route exists but not for
+// the request method.
+func methodNotAllowedHandler(w http.ResponseWriter, r *http.Request) {
+	writeProblem(w, r, Problem{
+		Type:   problemMethodNotAllowed,
+		Status: http.StatusMethodNotAllowed,
+	})
+}
@@ -0,0 +1,104 @@
+// problem_test.go
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestProblemResponses(t *testing.T) {
+	resetState()
+
+	testCases := []struct {
+		name       string
+		method     string
+		url        string
+		body       string
+		wantStatus int
+		wantType   string
+	}{
+		{"Invalid user ID", "GET", "/v1/users/abc", "", http.StatusBadRequest, problemInvalidUserID},
+		{"User not found", "GET", "/v1/users/99", "", http.StatusNotFound, problemUserNotFound},
+		{"Delete missing user", "DELETE", "/v1/users/99", "", http.StatusNotFound, problemUserNotFound},
+		{"Malformed JSON", "POST", "/v1/users", `{"name": }`, http.StatusBadRequest, problemInvalidBody},
+		{"Invalid field", "POST", "/v1/users", `{"name": ""}`, http.StatusUnprocessableEntity, problemValidationFailed},
+		{"Invalid query", "GET", "/v1/users?limit=-1", "", http.StatusBadRequest, problemInvalidQuery},
+		{"Unknown route", "GET", "/nope", "", http.StatusNotFound, problemNotFound},
+		{"Wrong method", "PATCH", "/v1/users", "", http.StatusMethodNotAllowed, problemMethodNotAllowed},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest(tc.method, tc.url, bytes.NewBufferString(tc.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+			newRouter().ServeHTTP(rr, req)
+
+			if status := rr.Code; status != tc.wantStatus {
+				t.Errorf("handler returned wrong status code: got %v want %v", status, tc.wantStatus)
+			}
+
+			if ct := rr.Header().Get("Content-Type"); ct != "application/problem+json" {
+				t.Errorf("handler returned wrong content type: got %v want %v", ct, "application/problem+json")
+			}
+
+			var problem Problem
+			if err := json.NewDecoder(rr.Body).Decode(&problem); err != nil {
+				t.Fatal(err)
+			}
+
+			if problem.Type != tc.wantType {
+				t.Errorf("handler returned wrong problem type: got %v want %v", problem.Type, tc.wantType)
+			}
+			if problem.Status != tc.wantStatus {
+				t.Errorf("handler returned wrong problem status: got %v want %v", problem.Status, tc.wantStatus)
+			}
+			if problem.Title == "" {
+				t.Error("handler returned a problem without a title")
+			}
+			if problem.Instance != tc.url {
+				t.Errorf("handler returned wrong instance: got %v want %v", problem.Instance, tc.url)
+			}
+		})
+	}
+}
+
+// takenStore rejects the email of every new user, as Postgres does for a
+// duplicate.
+type takenStore struct{ UserStore }
+
+func (takenStore) Create(User) (User, error) { return User{}, ErrEmailTaken }
+
+func TestEmailTakenProblem(t *testing.T) {
+	resetState()
+	store = takenStore{UserStore: memStore}
+	defer func() { store = memStore }()
+
+	rr := serve(t, "POST", "/v2/users", `{"name": "Alice", "email": "alice@example.com"}`, nil)
+	if status := rr.Code; status != http.StatusConflict {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusConflict)
+	}
+	var problem Problem
+	json.NewDecoder(rr.Body).Decode(&problem)
+	if problem.Type != problemEmailTaken {
+		t.Errorf("handler returned wrong problem type: got %v want %v", problem.Type, problemEmailTaken)
+	}
+
+	// An import names the row whose email is taken
+	store = rejectingStore{UserStore: memStore, row: 1, err: ErrEmailTaken}
+	rr = serve(t, "POST", "/v2/users", "name,email\nAlice,alice@example.com\nBob,bob@example.com\n", map[string]string{"Content-Type": "text/csv"})
+	if status := rr.Code; status != http.StatusConflict {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusConflict)
+	}
+	problem = Problem{}
+	json.NewDecoder(rr.Body).Decode(&problem)
+	if len(problem.Errors) != 1 || problem.Errors[0].Field != "rows.1.email" {
+		t.Errorf("problem does not name the failing row: %+v", problem)
+	}
+}
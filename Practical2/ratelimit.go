@@ -0,0 +1,291 @@
+// ratelimit.go
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RateLimitResult is the outcome of one rate limiter decision.
+type RateLimitResult struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	RetryAfter time.Duration // until the next request would be allowed
+	Reset      time.Duration // until the bucket is full again
+}
+
+// RateLimiter decides whether the client identified by key may make
+// another request.
+type RateLimiter interface {
+	Allow(ctx context.Context, key string) (RateLimitResult, error)
+}
+
+// rateLimiter limits requests to the user routes per client once they
+// are authenticated, and ipRateLimiter per remote IP before that, so
+// requests with bad tokens are limited too. Each is disabled when nil.
+var rateLimiter, ipRateLimiter RateLimiter
+
+// maxBodyBytes caps the size of request bodies. Zero means no limit.
+var maxBodyBytes int64 = 1 << 20
+
+// bucketResult describes a token bucket holding tokens after a decision.
+func bucketResult(allowed bool, tokens, rate float64, burst int) RateLimitResult {
+	res := RateLimitResult{
+		Allowed:   allowed,
+		Limit:     burst,
+		Remaining: int(math.Floor(tokens)),
+		Reset:     time.Duration((float64(burst) - tokens) / rate * float64(time.Second)),
+	}
+	if !allowed {
+		res.RetryAfter = time.Duration((1 - tokens) / rate * float64(time.Second))
+	}
+	return res
+}
+
+// MemoryRateLimiter is a token bucket per key held in process memory. It
+// only limits clients of a single instance.
+type MemoryRateLimiter struct {
+	rate  float64 // tokens added per second
+	burst int     // bucket capacity
+	now   func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	calls   int
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewMemoryRateLimiter allows rate requests per second per key with bursts
+// of up to burst requests.
+func NewMemoryRateLimiter(rate float64, burst int) *MemoryRateLimiter {
+	return &MemoryRateLimiter{
+		rate:    rate,
+		burst:   burst,
+		now:     time.Now,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// Allow takes a token from the bucket for key if one is available.
+func (l *MemoryRateLimiter) Allow(ctx context.Context, key string) (RateLimitResult, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(l.burst), last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(float64(l.burst), b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	return bucketResult(allowed, b.tokens, l.rate, l.burst), nil
+}
+
+// sweep periodically drops buckets that have refilled completely, since
+// they are indistinguishable from new ones.
+func (l *MemoryRateLimiter) sweep(now time.Time) {
+	l.calls++
+	if l.calls%1024 != 0 {
+		return
+	}
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= float64(l.burst) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// redisTokenBucket refills and takes from a bucket stored as a hash in one
+// atomic step. Tokens are returned as a string because Redis truncates Lua
+// numbers to integers.
+var redisTokenBucket = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+
+local state = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(state[1]) or burst
+local ts = tonumber(state[2]) or now
+
+tokens = math.min(burst, tokens + math.max(0, now - ts) / 1000 * rate)
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "ts", now)
+redis.call("PEXPIRE", KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+return {allowed, tostring(tokens)}
+`)
+
+// RedisRateLimiter keeps the token buckets in Redis so that every instance
+// of the API shares them.
+type RedisRateLimiter struct {
+	client *redis.Client
+	rate   float64
+	burst  int
+	prefix string
+	now    func() time.Time
+}
+
+// NewRedisRateLimiter allows rate requests per second per key with bursts
+// of up to burst requests, with buckets stored in client.
+func NewRedisRateLimiter(client *redis.Client, rate float64, burst int) *RedisRateLimiter {
+	return &RedisRateLimiter{
+		client: client,
+		rate:   rate,
+		burst:  burst,
+		prefix: "ratelimit:",
+		now:    time.Now,
+	}
+}
+
+// Allow takes a token from the bucket for key if one is available.
+func (l *RedisRateLimiter) Allow(ctx context.Context, key string) (RateLimitResult, error) {
+	res, err := redisTokenBucket.Run(ctx, l.client, []string{l.prefix + key},
+		l.rate, l.burst, l.now().UnixMilli()).Slice()
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+	if len(res) != 2 {
+		return RateLimitResult{}, errors.New("unexpected rate limit script result")
+	}
+
+	allowed, _ := res[0].(int64)
+	tokensStr, _ := res[1].(string)
+	tokens, err := strconv.ParseFloat(tokensStr, 64)
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+	return bucketResult(allowed == 1, tokens, l.rate, l.burst), nil
+}
+
+// rateLimitKey identifies the client by the subject of its verified token,
+// or else by remote IP. Nothing the client sends unchecked is used, so it
+// cannot get a fresh bucket by changing a header.
+func rateLimitKey(r *http.Request) string {
+	if claims, ok := claimsFrom(r.Context()); ok && claims.Subject != "" {
+		return "sub:" + claims.Subject
+	}
+	return "ip:" + remoteIP(r)
+}
+
+// ipRateLimitKey identifies the client by remote IP alone. Its prefix
+// keeps the buckets apart from those of rateLimitKey in a shared Redis.
+func ipRateLimitKey(r *http.Request) string {
+	return "preauth:" + remoteIP(r)
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// rateLimit rejects clients that exceed rateLimiter with 429. It runs
+// after authenticate.
+func rateLimit(next http.Handler) http.Handler {
+	return limitWith(&rateLimiter, rateLimitKey, next)
+}
+
+// rateLimitIP rejects remote IPs that exceed ipRateLimiter with 429. It
+// runs before authenticate, so it costs a rejected client no token
+// verification.
+func rateLimitIP(next http.Handler) http.Handler {
+	return limitWith(&ipRateLimiter, ipRateLimitKey, next)
+}
+
+// limitWith checks requests against the limiter in *limiter, read per
+// request so tests can swap it, and reports the bucket state in
+// RateLimit-* headers. If the limiter itself fails the request is let
+// through rather than taking the API down with it, and counted in
+// rate_limiter_errors_total.
+func limitWith(limiter *RateLimiter, key func(*http.Request) string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if *limiter == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		res, err := (*limiter).Allow(r.Context(), key(r))
+		if err != nil {
+			rateLimiterErrors.Inc()
+			loggerFrom(r.Context()).Error("rate limiter failed", slog.Any("error", err))
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h := w.Header()
+		h.Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+		h.Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+		h.Set("RateLimit-Reset", strconv.Itoa(ceilSeconds(res.Reset)))
+
+		if !res.Allowed {
+			h.Set("Retry-After", strconv.Itoa(ceilSeconds(res.RetryAfter)))
+			writeProblem(w, r, Problem{
+				Type:   problemRateLimited,
+				Status: http.StatusTooManyRequests,
+				Detail: "Rate limit exceeded; retry after the number of seconds in Retry-After.",
+			})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// limitBody rejects requests whose declared Content-Length exceeds
+// maxBodyBytes and caps the body of the rest, so handlers reading past
+// the limit fail with *http.MaxBytesError.
+func limitBody(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if maxBodyBytes <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if r.ContentLength > maxBodyBytes {
+			writeBodyTooLarge(w, r)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeBodyTooLarge(w http.ResponseWriter, r *http.Request) {
+	writeProblem(w, r, Problem{
+		Type:   problemBodyTooLarge,
+		Status: http.StatusRequestEntityTooLarge,
+		Detail: "The request body must not exceed " + strconv.FormatInt(maxBodyBytes, 10) + " bytes.",
+	})
+}
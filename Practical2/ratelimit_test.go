@@ -0,0 +1,251 @@
+// ratelimit_test.go
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redis/go-redis/v9"
+)
+
+// fakeClock is a settable time source for the limiters.
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+// testRateLimiter runs the shared token bucket checks against limiter,
+// which must allow 2 requests per second with bursts of 3.
+func testRateLimiter(t *testing.T, limiter RateLimiter, clock *fakeClock) {
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		res, err := limiter.Allow(ctx, "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !res.Allowed || res.Remaining != 2-i {
+			t.Fatalf("burst request %d: got %+v", i, res)
+		}
+	}
+
+	res, err := limiter.Allow(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Allowed {
+		t.Fatal("request beyond the burst was allowed")
+	}
+	if res.RetryAfter != 500*time.Millisecond {
+		t.Errorf("wrong RetryAfter: got %v want %v", res.RetryAfter, 500*time.Millisecond)
+	}
+
+	// Other keys have their own bucket
+	if res, _ := limiter.Allow(ctx, "b"); !res.Allowed {
+		t.Error("a different key was limited")
+	}
+
+	// Half a second refills one token at 2 per second
+	clock.advance(500 * time.Millisecond)
+	if res, _ := limiter.Allow(ctx, "a"); !res.Allowed {
+		t.Error("request after refill was not allowed")
+	}
+	if res, _ := limiter.Allow(ctx, "a"); res.Allowed {
+		t.Error("refill added more than one token")
+	}
+
+	// The bucket never holds more than the burst
+	clock.advance(time.Hour)
+	res, _ = limiter.Allow(ctx, "a")
+	if res.Remaining != 2 {
+		t.Errorf("bucket overfilled: got %v remaining want %v", res.Remaining, 2)
+	}
+}
+
+func TestMemoryRateLimiter(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1700000000, 0)}
+	limiter := NewMemoryRateLimiter(2, 3)
+	limiter.now = clock.now
+
+	testRateLimiter(t, limiter, clock)
+}
+
+func TestRedisRateLimiter(t *testing.T) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	defer client.Close()
+
+	clock := &fakeClock{t: time.Unix(1700000000, 0)}
+	limiter := NewRedisRateLimiter(client, 2, 3)
+	limiter.now = clock.now
+
+	testRateLimiter(t, limiter, clock)
+
+	if ttl := mr.TTL("ratelimit:a"); ttl <= 0 {
+		t.Errorf("bucket key has no expiry: %v", ttl)
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	resetState()
+	rateLimiter = NewMemoryRateLimiter(1, 2)
+	defer func() { rateLimiter = nil }()
+
+	for i := 0; i < 2; i++ {
+		rr := serve(t, "GET", "/v1/users", "", nil)
+		if status := rr.Code; status != http.StatusOK {
+			t.Fatalf("request %d: handler returned wrong status code: got %v want %v", i, status, http.StatusOK)
+		}
+		if got := rr.Header().Get("RateLimit-Limit"); got != "2" {
+			t.Errorf("wrong RateLimit-Limit: got %v want %v", got, "2")
+		}
+	}
+
+	rr := serve(t, "GET", "/v1/users", "", nil)
+	if status := rr.Code; status != http.StatusTooManyRequests {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusTooManyRequests)
+	}
+	if got := rr.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("wrong Retry-After: got %v want %v", got, "1")
+	}
+	if got := rr.Header().Get("RateLimit-Remaining"); got != "0" {
+		t.Errorf("wrong RateLimit-Remaining: got %v want %v", got, "0")
+	}
+
+	// Unverified headers do not get a fresh bucket
+	for i := 0; i < 5; i++ {
+		rr = serve(t, "GET", "/v1/users", "", map[string]string{"X-API-Key": strconv.Itoa(i)})
+		if status := rr.Code; status != http.StatusTooManyRequests {
+			t.Errorf("rotated header %d: handler returned wrong status code: got %v want %v", i, status, http.StatusTooManyRequests)
+		}
+	}
+
+	// Probes are not limited
+	rr = serve(t, "GET", "/healthz", "", nil)
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("probe: handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+}
+
+func TestRateLimitKey(t *testing.T) {
+	req := httptest.NewRequest("GET", "/users", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	if got := rateLimitKey(req); got != "ip:192.0.2.1" {
+		t.Errorf("wrong key for IP client: got %v", got)
+	}
+
+	req.Header.Set("X-API-Key", "secret")
+	if got := rateLimitKey(req); got != "ip:192.0.2.1" {
+		t.Errorf("wrong key for unverified API key: got %v", got)
+	}
+
+	req = req.WithContext(context.WithValue(req.Context(), claimsKey{}, &Claims{RegisteredClaims: jwt.RegisteredClaims{Subject: "42"}}))
+	if got := rateLimitKey(req); got != "sub:42" {
+		t.Errorf("wrong key for authenticated client: got %v", got)
+	}
+}
+
+func TestRateLimitPerSubject(t *testing.T) {
+	resetState()
+	enableAuth(t)
+	rateLimiter = NewMemoryRateLimiter(1, 2)
+	defer func() { rateLimiter = nil }()
+
+	admin := bearer(mintToken(t, "100", RoleAdmin, time.Hour))
+	for i := 0; i < 2; i++ {
+		serve(t, "GET", "/v1/users", "", admin)
+	}
+	if rr := serve(t, "GET", "/v1/users", "", admin); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusTooManyRequests)
+	}
+
+	// Another subject from the same address has its own bucket
+	other := bearer(mintToken(t, "101", RoleAdmin, time.Hour))
+	if rr := serve(t, "GET", "/v1/users", "", other); rr.Code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+}
+
+func TestRateLimitBeforeAuth(t *testing.T) {
+	resetState()
+	enableAuth(t)
+	ipRateLimiter = NewMemoryRateLimiter(1, 2)
+	defer func() { ipRateLimiter = nil }()
+
+	// Bad tokens use up the address's bucket without being verified
+	for i := 0; i < 2; i++ {
+		if rr := serve(t, "GET", "/v1/users", "", bearer("not-a-token")); rr.Code != http.StatusUnauthorized {
+			t.Fatalf("request %d: handler returned wrong status code: got %v want %v", i, rr.Code, http.StatusUnauthorized)
+		}
+	}
+	admin := bearer(mintToken(t, "100", RoleAdmin, time.Hour))
+	if rr := serve(t, "GET", "/v1/users", "", admin); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusTooManyRequests)
+	}
+}
+
+// failingLimiter is a RateLimiter whose backend is down.
+type failingLimiter struct{}
+
+func (failingLimiter) Allow(context.Context, string) (RateLimitResult, error) {
+	return RateLimitResult{}, errors.New("connection refused")
+}
+
+func TestRateLimitFailsOpen(t *testing.T) {
+	resetState()
+	rateLimiter = failingLimiter{}
+	defer func() { rateLimiter = nil }()
+
+	before := testutil.ToFloat64(rateLimiterErrors)
+	if rr := serve(t, "GET", "/v1/users", "", nil); rr.Code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if got := testutil.ToFloat64(rateLimiterErrors) - before; got != 1 {
+		t.Errorf("wrong rate_limiter_errors_total increase: got %v want %v", got, 1)
+	}
+}
+
+func TestLimitBody(t *testing.T) {
+	resetState()
+	maxBodyBytes = 32
+	defer func() { maxBodyBytes = 1 << 20 }()
+
+	large := `{"name": "` + strings.Repeat("a", 64) + `"}`
+
+	t.Run("Declared length too large", func(t *testing.T) {
+		rr := serve(t, "POST", "/v1/users", large, nil)
+		if status := rr.Code; status != http.StatusRequestEntityTooLarge {
+			t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusRequestEntityTooLarge)
+		}
+	})
+
+	t.Run("Streamed body too large", func(t *testing.T) {
+		req, err := http.NewRequest("POST", "/v1/users", io.MultiReader(strings.NewReader(large)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		newRouter().ServeHTTP(rr, req)
+
+		if status := rr.Code; status != http.StatusRequestEntityTooLarge {
+			t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusRequestEntityTooLarge)
+		}
+	})
+
+	t.Run("Small body", func(t *testing.T) {
+		rr := serve(t, "POST", "/v1/users", `{"name": "Al"}`, nil)
+		if status := rr.Code; status != http.StatusCreated {
+			t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusCreated)
+		}
+	})
+}
@@ -0,0 +1,105 @@
+// server_test.go
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestRunServer_DrainsInFlightRequests(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		io.WriteString(w, "done")
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	srv := newServer(Config{MaxHeaderBytes: 1 << 20}, handler)
+
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- runServer(ctx, srv, ln, 5*time.Second)
+	}()
+
+	type result struct {
+		body string
+		err  error
+	}
+	resCh := make(chan result, 1)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String() + "/")
+		if err != nil {
+			resCh <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		resCh <- result{string(body), err}
+	}()
+
+	// Signal shutdown while the request is still being handled
+	<-started
+	cancel()
+
+	res := <-resCh
+	if res.err != nil {
+		t.Fatalf("in-flight request failed: %v", res.err)
+	}
+	if res.body != "done" {
+		t.Errorf("in-flight request returned wrong body: got %q want %q", res.body, "done")
+	}
+
+	if err := <-runErr; err != nil {
+		t.Errorf("runServer returned error: %v", err)
+	}
+
+	if _, err := http.Get("http://" + ln.Addr().String() + "/"); err == nil {
+		t.Error("server still accepts connections after shutdown")
+	}
+}
+
+func TestRunServer_ShutdownDeadline(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	srv := newServer(Config{MaxHeaderBytes: 1 << 20}, handler)
+
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- runServer(ctx, srv, ln, 50*time.Millisecond)
+	}()
+
+	go http.Get("http://" + ln.Addr().String() + "/")
+	<-started
+	cancel()
+
+	select {
+	case err := <-runErr:
+		if err != context.DeadlineExceeded {
+			t.Errorf("runServer returned %v want %v", err, context.DeadlineExceeded)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("runServer did not give up after the shutdown deadline")
+	}
+}
@@ -0,0 +1,484 @@
+// store.go
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrUserNotFound is returned by a UserStore when no user has the given ID.
+	ErrUserNotFound = errors.New("user not found")
+	// ErrVersionMismatch is returned by a conditional write when the stored
+	// user has changed since the caller read it.
+	ErrVersionMismatch = errors.New("user version does not match")
+	// ErrBatchAborted is the result of every operation in an atomic batch
+	// that was rolled back or skipped because another operation failed.
+	ErrBatchAborted = errors.New("batch aborted")
+	// ErrUserNotDeleted is returned when restoring a user that is not
+	// deleted.
+	ErrUserNotDeleted = errors.New("user is not deleted")
+	// ErrEmailTaken is returned by stores that keep emails unique when
+	// another user, deleted or not, already has the email.
+	ErrEmailTaken = errors.New("email is already taken")
+)
+
+// Batch operation kinds.
+const (
+	BatchCreate = "create"
+	BatchUpdate = "update"
+	BatchDelete = "delete"
+)
+
+// BatchOp is one write in a batch. ID and ExpectVersion are ignored for
+// creates, and User for deletes.
+type BatchOp struct {
+	Op            string
+	ID            int
+	User          User
+	ExpectVersion int
+}
+
+// BatchResult is the outcome of the BatchOp at the same index.
+type BatchResult struct {
+	User User
+	Err  error
+}
+
+// abortBatch marks every result except the failed one as aborted.
+func abortBatch(results []BatchResult, failed int) {
+	for i := range results {
+		if i != failed {
+			results[i] = BatchResult{Err: ErrBatchAborted}
+		}
+	}
+}
+
+// UserStore is the storage backend used by the handlers.
+//
+// Update and Delete take the version the caller expects the stored user
+// to have; 0 makes the write unconditional. Update keeps the stored email
+// when user has none, since v1 clients cannot see or send it. Batch
+// applies several writes and, when atomic is set, either all of them or
+// none.
+//
+// Delete only marks a user as deleted. Deleted users are hidden from the
+// other methods until they are restored, and removed for good by Purge.
+//
+// Every write except a purge is published to the change feed with
+// publishUser before the store lets the next write commit, so events come
+// in the order the writes were committed and carry the stored user.
+type UserStore interface {
+	List() ([]User, error)
+	Get(id int) (User, error)
+	Create(user User) (User, error)
+	Update(id int, user User, expectVersion int) (User, error)
+	Delete(id int, expectVersion int) error
+	Batch(ops []BatchOp, atomic bool) ([]BatchResult, error)
+	// ListWithDeleted returns every user, deleted or not.
+	ListWithDeleted() ([]User, error)
+	// Restore undeletes the user with the given ID and bumps its version.
+	Restore(id int) (User, error)
+	// Purge removes the users deleted before cutoff and returns how many
+	// there were.
+	Purge(cutoff time.Time) (int, error)
+}
+
+// storeShards is how many shards a MemoryStore spreads users over by ID.
+// It is a power of two, so the shard is picked by the low bits of the ID.
+const storeShards = 32
+
+// userShard holds the users whose IDs map to it.
+type userShard struct {
+	mu    sync.RWMutex
+	users map[int]User
+}
+
+// MemoryStore keeps users in sharded maps. Deleted users stay in the maps,
+// marked with DeletedAt, until they are purged. Without a WAL the users
+// are lost on restart; see OpenMemoryStore.
+//
+// Readers only take read locks on the shards they look at, so they never
+// wait for each other. Writers are serialized by mu, which keeps IDs, the
+// WAL and batches in order; a write is staged, logged and then applied
+// with every shard it touches locked at once, so readers see all of it or
+// none of it.
+type MemoryStore struct {
+	mu     sync.Mutex
+	shards [storeShards]userShard
+	nextID int
+	now    func() time.Time
+
+	// wal, when set, records every change before it is applied. staged and
+	// pending hold the changes of the current write until commit.
+	wal        *WAL
+	staged     map[int]*User
+	pending    []walChange
+	prevNextID int
+	snapMu     sync.Mutex
+}
+
+// NewMemoryStore creates an empty in-memory store.
+func NewMemoryStore() *MemoryStore {
+	s := &MemoryStore{
+		nextID: 1,
+		now:    time.Now,
+		staged: make(map[int]*User),
+	}
+	for i := range s.shards {
+		s.shards[i].users = make(map[int]User)
+	}
+	return s
+}
+
+func (s *MemoryStore) shard(id int) *userShard {
+	return &s.shards[uint(id)%storeShards]
+}
+
+// List returns every stored user that is not deleted.
+func (s *MemoryStore) List() ([]User, error) {
+	s.rlockAll()
+	defer s.runlockAll()
+
+	var userList []User
+	for i := range s.shards {
+		for _, user := range s.shards[i].users {
+			if user.DeletedAt == nil {
+				userList = append(userList, user)
+			}
+		}
+	}
+	return userList, nil
+}
+
+// ListWithDeleted returns every stored user, including deleted ones.
+func (s *MemoryStore) ListWithDeleted() ([]User, error) {
+	s.rlockAll()
+	defer s.runlockAll()
+
+	var userList []User
+	for i := range s.shards {
+		for _, user := range s.shards[i].users {
+			userList = append(userList, user)
+		}
+	}
+	return userList, nil
+}
+
+// Count returns the number of stored users that are not deleted.
+func (s *MemoryStore) Count() (int, error) {
+	s.rlockAll()
+	defer s.runlockAll()
+
+	n := 0
+	for i := range s.shards {
+		for _, user := range s.shards[i].users {
+			if user.DeletedAt == nil {
+				n++
+			}
+		}
+	}
+	return n, nil
+}
+
+// Get returns the user with the given ID.
+func (s *MemoryStore) Get(id int) (User, error) {
+	sh := s.shard(id)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+
+	user, ok := sh.users[id]
+	if !ok || user.DeletedAt != nil {
+		return User{}, ErrUserNotFound
+	}
+	return user, nil
+}
+
+// Create assigns the next ID to user and stores it as version 1.
+func (s *MemoryStore) Create(user User) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user = s.create(user)
+	if err := s.commit(); err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+// Update replaces the user with the given ID and bumps its version.
+func (s *MemoryStore) Update(id int, user User, expectVersion int) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, err := s.update(id, user, expectVersion)
+	if err != nil {
+		return User{}, err
+	}
+	if err := s.commit(); err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+// Delete marks the user with the given ID as deleted and bumps its
+// version.
+func (s *MemoryStore) Delete(id int, expectVersion int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.delete(id, expectVersion); err != nil {
+		return err
+	}
+	return s.commit()
+}
+
+// Restore clears the deletion mark of the user with the given ID.
+func (s *MemoryStore) Restore(id int) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.lookup(id)
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+	if user.DeletedAt == nil {
+		return User{}, ErrUserNotDeleted
+	}
+
+	user.DeletedAt = nil
+	user.UpdatedAt = s.now().UTC()
+	user.Version++
+	s.put(walRestore, user)
+	if err := s.commit(); err != nil {
+		return User{}, err
+	}
+	return user, nil
+}
+
+// Purge removes the users deleted before cutoff.
+func (s *MemoryStore) Purge(cutoff time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Writers hold mu, so the shards cannot change under us
+	n := 0
+	for i := range s.shards {
+		for _, user := range s.shards[i].users {
+			if user.DeletedAt != nil && user.DeletedAt.Before(cutoff) {
+				s.remove(user)
+				n++
+			}
+		}
+	}
+	if err := s.commit(); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// Batch applies ops as one write, so no other request sees a partly
+// applied batch. An atomic batch that fails is discarded. The changes of
+// a batch are logged together, so after a crash either all of them are
+// recovered or none.
+func (s *MemoryStore) Batch(ops []BatchOp, atomic bool) ([]BatchResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	results := make([]BatchResult, len(ops))
+	for i, op := range ops {
+		switch op.Op {
+		case BatchCreate:
+			results[i].User = s.create(op.User)
+		case BatchUpdate:
+			results[i].User, results[i].Err = s.update(op.ID, op.User, op.ExpectVersion)
+		case BatchDelete:
+			results[i].Err = s.delete(op.ID, op.ExpectVersion)
+		default:
+			results[i].Err = fmt.Errorf("unknown batch operation %q", op.Op)
+		}
+
+		if atomic && results[i].Err != nil {
+			s.discard()
+			abortBatch(results, i)
+			return results, nil
+		}
+	}
+	if err := s.commit(); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// rlockAll read-locks every shard, in order, for a consistent view.
+func (s *MemoryStore) rlockAll() {
+	for i := range s.shards {
+		s.shards[i].mu.RLock()
+	}
+}
+
+func (s *MemoryStore) runlockAll() {
+	for i := range s.shards {
+		s.shards[i].mu.RUnlock()
+	}
+}
+
+// The helpers below expect s.mu to be held. Since only writers change the
+// shards, they read them without the shard locks.
+
+// lookup returns the user with the given ID as the current write sees it,
+// deleted or not.
+func (s *MemoryStore) lookup(id int) (User, bool) {
+	if staged, ok := s.staged[id]; ok {
+		if staged == nil {
+			return User{}, false
+		}
+		return *staged, true
+	}
+	user, ok := s.shard(id).users[id]
+	return user, ok
+}
+
+// live returns the user with the given ID unless it is missing or deleted.
+func (s *MemoryStore) live(id int) (User, error) {
+	user, ok := s.lookup(id)
+	if !ok || user.DeletedAt != nil {
+		return User{}, ErrUserNotFound
+	}
+	return user, nil
+}
+
+func (s *MemoryStore) create(user User) User {
+	user.ID = s.nextID
+	user.Version = 1
+	user.CreatedAt = s.now().UTC()
+	user.UpdatedAt = user.CreatedAt
+	s.put(walCreate, user)
+	s.nextID++
+	return user
+}
+
+func (s *MemoryStore) update(id int, user User, expectVersion int) (User, error) {
+	current, err := s.live(id)
+	if err != nil {
+		return User{}, err
+	}
+	if expectVersion != 0 && current.Version != expectVersion {
+		return User{}, ErrVersionMismatch
+	}
+
+	user.ID = id
+	user.Version = current.Version + 1
+	if user.Email == "" {
+		user.Email = current.Email
+	}
+	user.CreatedAt = current.CreatedAt
+	user.UpdatedAt = s.now().UTC()
+	s.put(walUpdate, user)
+	return user, nil
+}
+
+func (s *MemoryStore) delete(id int, expectVersion int) error {
+	current, err := s.live(id)
+	if err != nil {
+		return err
+	}
+	if expectVersion != 0 && current.Version != expectVersion {
+		return ErrVersionMismatch
+	}
+
+	deletedAt := s.now().UTC()
+	current.DeletedAt = &deletedAt
+	current.UpdatedAt = deletedAt
+	current.Version++
+	s.put(walDelete, current)
+	return nil
+}
+
+// put stages user for commit.
+func (s *MemoryStore) put(op string, user User) {
+	s.track(walChange{Op: op, User: storedUser{User: user, Version: user.Version}})
+	s.staged[user.ID] = &user
+}
+
+// remove stages the removal of a purged user.
+func (s *MemoryStore) remove(user User) {
+	s.track(walChange{Op: walPurge, User: storedUser{User: User{ID: user.ID}}})
+	s.staged[user.ID] = nil
+}
+
+func (s *MemoryStore) track(change walChange) {
+	if len(s.pending) == 0 {
+		s.prevNextID = s.nextID
+	}
+	s.pending = append(s.pending, change)
+}
+
+// commit logs the staged changes and applies them. If they cannot be
+// logged they are discarded, so the store never holds a change that would
+// be lost.
+func (s *MemoryStore) commit() error {
+	if len(s.pending) == 0 {
+		return nil
+	}
+	if s.wal != nil {
+		if err := s.wal.Append(s.pending); err != nil {
+			s.discard()
+			return err
+		}
+	}
+
+	// Lock the touched shards in order, so readers see the whole write
+	var touched [storeShards]bool
+	for id := range s.staged {
+		touched[uint(id)%storeShards] = true
+	}
+	for i := range s.shards {
+		if touched[i] {
+			s.shards[i].mu.Lock()
+		}
+	}
+	for id, user := range s.staged {
+		if user == nil {
+			delete(s.shard(id).users, id)
+		} else {
+			s.shard(id).users[id] = *user
+		}
+	}
+	for i := range s.shards {
+		if touched[i] {
+			s.shards[i].mu.Unlock()
+		}
+	}
+
+	// Publish while still holding mu, so events follow commit order
+	for _, change := range s.pending {
+		if eventType, ok := changeEvents[change.Op]; ok {
+			publishUser(eventType, change.User.User)
+		}
+	}
+
+	clear(s.staged)
+	s.pending = s.pending[:0]
+	return nil
+}
+
+// changeEvents maps the changes of a write to the events they publish.
+// Purges publish none.
+var changeEvents = map[string]string{
+	walCreate:  EventCreated,
+	walUpdate:  EventUpdated,
+	walDelete:  EventDeleted,
+	walRestore: EventRestored,
+}
+
+// discard drops the staged changes.
+func (s *MemoryStore) discard() {
+	if len(s.pending) > 0 {
+		s.nextID = s.prevNextID
+	}
+	clear(s.staged)
+	s.pending = s.pending[:0]
+}
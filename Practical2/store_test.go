@@ -0,0 +1,312 @@
+// store_test.go
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemoryStore(t *testing.T) {
+	s := NewMemoryStore()
+
+	created, err := s.Create(User{Name: "Alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.ID != 1 {
+		t.Errorf("Create assigned wrong ID: got %v want %v", created.ID, 1)
+	}
+
+	updated, err := s.Update(created.ID, User{ID: 42, Name: "Alicia"}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.ID != created.ID {
+		t.Errorf("Update changed the ID: got %v want %v", updated.ID, created.ID)
+	}
+
+	found, err := s.Get(created.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found.Name != "Alicia" {
+		t.Errorf("Get returned unexpected name: got %v want %v", found.Name, "Alicia")
+	}
+
+	if err := s.Delete(created.ID, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every lookup of a missing user should report ErrUserNotFound
+	if _, err := s.Get(created.ID); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Get after delete: got %v want %v", err, ErrUserNotFound)
+	}
+	if _, err := s.Update(created.ID, User{Name: "Ghost"}, 0); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Update after delete: got %v want %v", err, ErrUserNotFound)
+	}
+	if err := s.Delete(created.ID, 0); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Delete after delete: got %v want %v", err, ErrUserNotFound)
+	}
+}
+
+func TestMemoryStore_Versions(t *testing.T) {
+	s := NewMemoryStore()
+
+	created, _ := s.Create(User{Name: "Alice"})
+	if created.Version != 1 {
+		t.Errorf("Create assigned wrong version: got %v want %v", created.Version, 1)
+	}
+
+	updated, err := s.Update(created.ID, User{Name: "Alicia"}, created.Version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Version != 2 {
+		t.Errorf("Update assigned wrong version: got %v want %v", updated.Version, 2)
+	}
+
+	// Writes that expect the old version must fail
+	if _, err := s.Update(created.ID, User{Name: "Stale"}, created.Version); !errors.Is(err, ErrVersionMismatch) {
+		t.Errorf("stale Update: got %v want %v", err, ErrVersionMismatch)
+	}
+	if err := s.Delete(created.ID, created.Version); !errors.Is(err, ErrVersionMismatch) {
+		t.Errorf("stale Delete: got %v want %v", err, ErrVersionMismatch)
+	}
+	if err := s.Delete(created.ID, updated.Version); err != nil {
+		t.Errorf("Delete with current version: %v", err)
+	}
+}
+
+func TestMemoryStore_SoftDelete(t *testing.T) {
+	s := NewMemoryStore()
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	s.now = func() time.Time { return now }
+
+	alice, _ := s.Create(User{Name: "Alice"})
+	bob, _ := s.Create(User{Name: "Bob"})
+	if err := s.Delete(alice.ID, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if users, _ := s.List(); len(users) != 1 || users[0].ID != bob.ID {
+		t.Errorf("List returned deleted users: %v", users)
+	}
+	if n, _ := s.Count(); n != 1 {
+		t.Errorf("Count included deleted users: got %v want %v", n, 1)
+	}
+	all, _ := s.ListWithDeleted()
+	if len(all) != 2 {
+		t.Fatalf("ListWithDeleted returned wrong users: %v", all)
+	}
+
+	if _, err := s.Restore(bob.ID); !errors.Is(err, ErrUserNotDeleted) {
+		t.Errorf("Restore of a live user: got %v want %v", err, ErrUserNotDeleted)
+	}
+	restored, err := s.Restore(alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.DeletedAt != nil || restored.Version != 3 {
+		t.Errorf("Restore returned wrong user: %+v", restored)
+	}
+
+	// Only users deleted before the cutoff are purged
+	s.Delete(alice.ID, 0)
+	now = now.Add(time.Hour)
+	s.Delete(bob.ID, 0)
+	if n, _ := s.Purge(now.Add(-time.Minute)); n != 1 {
+		t.Errorf("Purge removed wrong number of users: got %v want %v", n, 1)
+	}
+	if _, err := s.Restore(alice.ID); !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("Restore after purge: got %v want %v", err, ErrUserNotFound)
+	}
+	if _, err := s.Restore(bob.ID); err != nil {
+		t.Errorf("Restore of a user not yet purged: %v", err)
+	}
+}
+
+func TestMemoryStore_Concurrent(t *testing.T) {
+	s := NewMemoryStore()
+	const writers, rounds = 8, 50
+
+	stop := make(chan struct{})
+	var readers sync.WaitGroup
+	for range 4 {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				users, _ := s.List()
+				for _, user := range users {
+					s.Get(user.ID)
+				}
+				s.Count()
+			}
+		}()
+	}
+
+	var wg sync.WaitGroup
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range rounds {
+				user, err := s.Create(User{Name: fmt.Sprintf("user-%d-%d", w, i)})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				updated, err := s.Update(user.ID, User{Name: "updated"}, user.Version)
+				if err != nil {
+					t.Errorf("Update of user %d: %v", user.ID, err)
+					return
+				}
+				if i%2 == 0 {
+					if err := s.Delete(user.ID, updated.Version); err != nil {
+						t.Errorf("Delete of user %d: %v", user.ID, err)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	readers.Wait()
+
+	all, _ := s.ListWithDeleted()
+	if len(all) != writers*rounds {
+		t.Fatalf("wrong number of users: got %v want %v", len(all), writers*rounds)
+	}
+	ids := make(map[int]bool)
+	for _, user := range all {
+		if ids[user.ID] {
+			t.Errorf("ID %d was assigned twice", user.ID)
+		}
+		ids[user.ID] = true
+	}
+	if n, _ := s.Count(); n != writers*rounds/2 {
+		t.Errorf("wrong number of live users: got %v want %v", n, writers*rounds/2)
+	}
+}
+
+func TestMemoryStore_BatchIsAtomicForReaders(t *testing.T) {
+	s := NewMemoryStore()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range 200 {
+			// Consecutive IDs land in different shards
+			s.Batch([]BatchOp{
+				{Op: BatchCreate, User: User{Name: "a"}},
+				{Op: BatchCreate, User: User{Name: "b"}},
+			}, true)
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		if n, _ := s.Count(); n%2 != 0 {
+			t.Fatalf("reader saw half of a batch: %d users", n)
+		}
+	}
+}
+
+// mutexStore puts a single lock around a store, the way every read and
+// write used to be serialized, as a baseline for the benchmarks.
+type mutexStore struct {
+	mu sync.Mutex
+	UserStore
+}
+
+func (s *mutexStore) Get(id int) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.UserStore.Get(id)
+}
+
+func (s *mutexStore) List() ([]User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.UserStore.List()
+}
+
+func (s *mutexStore) Update(id int, user User, expectVersion int) (User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.UserStore.Update(id, user, expectVersion)
+}
+
+// benchStores returns the sharded store and the single-lock baseline, each
+// holding n users.
+func benchStores(n int) map[string]UserStore {
+	sharded := NewMemoryStore()
+	for i := range n {
+		sharded.Create(User{Name: fmt.Sprintf("user-%d", i)})
+	}
+	baseline := NewMemoryStore()
+	for i := range n {
+		baseline.Create(User{Name: fmt.Sprintf("user-%d", i)})
+	}
+	return map[string]UserStore{"sharded": sharded, "single mutex": &mutexStore{UserStore: baseline}}
+}
+
+func BenchmarkMemoryStore_ParallelGet(b *testing.B) {
+	const n = 10000
+	for name, s := range benchStores(n) {
+		b.Run(name, func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				id := 0
+				for pb.Next() {
+					s.Get(id%n + 1)
+					id++
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkMemoryStore_ParallelList(b *testing.B) {
+	for name, s := range benchStores(1000) {
+		b.Run(name, func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					s.List()
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkMemoryStore_ParallelMixed makes one call in 20 a write.
+func BenchmarkMemoryStore_ParallelMixed(b *testing.B) {
+	const n = 10000
+	for name, s := range benchStores(n) {
+		b.Run(name, func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					id := i%n + 1
+					if i%20 == 0 {
+						s.Update(id, User{Name: "updated"}, 0)
+					} else {
+						s.Get(id)
+					}
+					i++
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,67 @@
+// trash.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// listUsers returns the users for GET /users, with deleted ones when
+// includeDeleted is set.
+func listUsers(includeDeleted bool) ([]User, error) {
+	if includeDeleted {
+		return store.ListWithDeleted()
+	}
+	return store.List()
+}
+
+// restoreUserHandler handles POST /users/{id}:restore
+//
+// It undoes a DELETE that has not been purged yet. Users that are not
+// deleted get 409.
+func restoreUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		writeInvalidUserID(w, r)
+		return
+	}
+
+	user, err := store.Restore(id)
+	if err != nil {
+		writeStoreError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", userETag(user))
+	json.NewEncoder(w).Encode(versionFrom(r.Context()).user(user))
+}
+
+// runPurger removes users deleted more than retention ago, checking every
+// interval until ctx is done.
+func runPurger(ctx context.Context, retention, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		n, err := store.Purge(time.Now().Add(-retention))
+		if err != nil {
+			logger.Error("could not purge deleted users", slog.Any("error", err))
+			continue
+		}
+		if n > 0 {
+			logger.Info("purged deleted users", slog.Int("count", n))
+		}
+	}
+}
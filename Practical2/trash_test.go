@@ -0,0 +1,145 @@
+// trash_test.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSoftDelete(t *testing.T) {
+	resetState()
+	serve(t, "POST", "/v1/users", `{"name":"Alice"}`, nil)
+	serve(t, "POST", "/v1/users", `{"name":"Bob"}`, nil)
+
+	rr := serve(t, "DELETE", "/v1/users/1", "", nil)
+	if status := rr.Code; status != http.StatusNoContent {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusNoContent)
+	}
+
+	t.Run("Deleted users are hidden", func(t *testing.T) {
+		rr := serve(t, "GET", "/v1/users/1", "", nil)
+		if status := rr.Code; status != http.StatusNotFound {
+			t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusNotFound)
+		}
+
+		rr = serve(t, "GET", "/v1/users", "", nil)
+		var users []User
+		json.Unmarshal(rr.Body.Bytes(), &users)
+		if len(users) != 1 || users[0].ID != 2 {
+			t.Errorf("list included deleted users: %s", rr.Body)
+		}
+	})
+
+	t.Run("include_deleted lists them", func(t *testing.T) {
+		rr := serve(t, "GET", "/v1/users?include_deleted=true", "", nil)
+		if status := rr.Code; status != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+		}
+		var users []User
+		json.Unmarshal(rr.Body.Bytes(), &users)
+		if len(users) != 2 || users[0].DeletedAt == nil || users[1].DeletedAt != nil {
+			t.Errorf("wrong users listed: %s", rr.Body)
+		}
+		if got := rr.Header().Get("X-Total-Count"); got != "2" {
+			t.Errorf("wrong total count: got %v want %v", got, "2")
+		}
+	})
+
+	t.Run("include_deleted must be a boolean", func(t *testing.T) {
+		rr := serve(t, "GET", "/v1/users?include_deleted=maybe", "", nil)
+		if status := rr.Code; status != http.StatusBadRequest {
+			t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
+		}
+	})
+}
+
+func TestRestoreUser(t *testing.T) {
+	resetState()
+	serve(t, "POST", "/v1/users", `{"name":"Alice"}`, nil)
+	serve(t, "DELETE", "/v1/users/1", "", nil)
+
+	rr := serve(t, "POST", "/v1/users/1:restore", "", nil)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v (%s)", status, http.StatusOK, rr.Body)
+	}
+	if got := rr.Header().Get("ETag"); got != `"3"` {
+		t.Errorf("handler returned wrong ETag: got %v want %v", got, `"3"`)
+	}
+	var user User
+	json.Unmarshal(rr.Body.Bytes(), &user)
+	if user.Name != "Alice" || user.DeletedAt != nil {
+		t.Errorf("handler returned wrong user: %s", rr.Body)
+	}
+
+	if rr := serve(t, "GET", "/v1/users/1", "", nil); rr.Code != http.StatusOK {
+		t.Errorf("restored user is not visible: got %v want %v", rr.Code, http.StatusOK)
+	}
+
+	events, _, _ := userEvents.Since(0)
+	if last := events[len(events)-1]; last.Type != EventRestored || last.User.ID != 1 {
+		t.Errorf("wrong event published: %+v", last)
+	}
+
+	testCases := []struct {
+		name       string
+		url        string
+		wantStatus int
+	}{
+		{"Live user", "/v1/users/1:restore", http.StatusConflict},
+		{"Missing user", "/v1/users/99:restore", http.StatusNotFound},
+		{"Invalid ID", "/v1/users/abc:restore", http.StatusBadRequest},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rr := serve(t, "POST", tc.url, "", nil)
+			if status := rr.Code; status != tc.wantStatus {
+				t.Errorf("handler returned wrong status code: got %v want %v", status, tc.wantStatus)
+			}
+		})
+	}
+}
+
+func TestRestoreUserWithSpecValidation(t *testing.T) {
+	resetState()
+	enableSpecValidation(t)
+	serve(t, "POST", "/v1/users", `{"name":"Alice"}`, nil)
+	serve(t, "DELETE", "/v1/users/1", "", nil)
+
+	if rr := serve(t, "GET", "/v1/users?include_deleted=true", "", nil); rr.Code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v (%s)", rr.Code, http.StatusOK, rr.Body)
+	}
+	if rr := serve(t, "POST", "/v1/users/1:restore", "", nil); rr.Code != http.StatusOK {
+		t.Errorf("handler returned wrong status code: got %v want %v (%s)", rr.Code, http.StatusOK, rr.Body)
+	}
+	if rr := serve(t, "POST", "/v1/users/1:restore", "", nil); rr.Code != http.StatusConflict {
+		t.Errorf("handler returned wrong status code: got %v want %v (%s)", rr.Code, http.StatusConflict, rr.Body)
+	}
+}
+
+func TestRunPurger(t *testing.T) {
+	resetState()
+	serve(t, "POST", "/v1/users", `{"name":"Alice"}`, nil)
+	serve(t, "DELETE", "/v1/users/1", "", nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		runPurger(ctx, time.Nanosecond, time.Millisecond)
+		close(done)
+	}()
+
+	eventually(t, "deleted user to be purged", func() bool {
+		users, _ := memStore.ListWithDeleted()
+		return len(users) == 0
+	})
+	cancel()
+	<-done
+
+	if rr := serve(t, "POST", "/v1/users/1:restore", "", nil); rr.Code != http.StatusNotFound {
+		t.Errorf("purged user was restored: got %v want %v", rr.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,227 @@
+// commands.go
+package usersctl
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"crud-testing/client"
+)
+
+// exportPageSize is the page size used to read every user, the most the
+// API returns at once.
+const exportPageSize = 1000
+
+// importChunkSize is the most users the API imports in one request.
+const importChunkSize = 1000
+
+// parseFlags parses the flags of a subcommand and checks that it was given
+// exactly the named positional arguments.
+func parseFlags(fs *flag.FlagSet, args []string, names ...string) error {
+	fs.SetOutput(io.Discard)
+	if err := fs.Parse(args); err != nil {
+		return usagef("%s: %v", fs.Name(), err)
+	}
+	if fs.NArg() != len(names) {
+		if len(names) == 0 {
+			return usagef("%s takes no arguments", fs.Name())
+		}
+		return usagef("%s needs %s", fs.Name(), strings.Join(names, " and "))
+	}
+	return nil
+}
+
+func parseID(s string) (int, error) {
+	id, err := strconv.Atoi(s)
+	if err != nil || id < 1 {
+		return 0, usagef("invalid user ID %q", s)
+	}
+	return id, nil
+}
+
+func listCommand(ctx context.Context, a *app, args []string) error {
+	fs := flag.NewFlagSet("list", flag.ContinueOnError)
+	var opts client.ListOptions
+	fs.StringVar(&opts.Name, "name", "", "only users whose name contains this")
+	fs.StringVar(&opts.Sort, "sort", "", "order: id, -id, name or -name")
+	fs.BoolVar(&opts.IncludeDeleted, "include-deleted", false, "list deleted users too")
+	fs.IntVar(&opts.Offset, "offset", 0, "number of users to skip")
+	limit := fs.Int("limit", 0, "most users to list; 0 lists all")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if *limit < 0 || opts.Offset < 0 {
+		return usagef("list: -limit and -offset must not be negative")
+	}
+
+	opts.Limit = exportPageSize
+	if *limit > 0 {
+		opts.Limit = min(*limit, exportPageSize)
+	}
+	users, err := collect(ctx, a.client, opts, *limit)
+	if err != nil {
+		return err
+	}
+	return a.printUsers(users)
+}
+
+func getCommand(ctx context.Context, a *app, args []string) error {
+	fs := flag.NewFlagSet("get", flag.ContinueOnError)
+	if err := parseFlags(fs, args, "<id>"); err != nil {
+		return err
+	}
+	id, err := parseID(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	user, err := a.client.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	return a.printUser(user)
+}
+
+func createCommand(ctx context.Context, a *app, args []string) error {
+	fs := flag.NewFlagSet("create", flag.ContinueOnError)
+	if err := parseFlags(fs, args, "<name>", "<email>"); err != nil {
+		return err
+	}
+
+	user, err := a.client.Create(ctx, client.UserInput{Name: fs.Arg(0), Email: fs.Arg(1)})
+	if err != nil {
+		return err
+	}
+	return a.printUser(user)
+}
+
+func updateCommand(ctx context.Context, a *app, args []string) error {
+	fs := flag.NewFlagSet("update", flag.ContinueOnError)
+	ifMatch := fs.String("if-match", "", "only update the user if its ETag is still this")
+	if err := parseFlags(fs, args, "<id>", "<name>", "<email>"); err != nil {
+		return err
+	}
+	id, err := parseID(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	user, err := a.client.Update(ctx, id, client.UserInput{Name: fs.Arg(1), Email: fs.Arg(2)}, callOptions(*ifMatch)...)
+	if err != nil {
+		return err
+	}
+	return a.printUser(user)
+}
+
+func deleteCommand(ctx context.Context, a *app, args []string) error {
+	fs := flag.NewFlagSet("delete", flag.ContinueOnError)
+	ifMatch := fs.String("if-match", "", "only delete the user if its ETag is still this")
+	if err := parseFlags(fs, args, "<id>"); err != nil {
+		return err
+	}
+	id, err := parseID(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	return a.client.Delete(ctx, id, callOptions(*ifMatch)...)
+}
+
+func importCommand(ctx context.Context, a *app, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	format := fs.String("format", "", "format of the file: csv or json; by default taken from its extension")
+	if err := parseFlags(fs, args, "<file>"); err != nil {
+		return err
+	}
+
+	path := fs.Arg(0)
+	if *format == "" {
+		*format = strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+	}
+	if *format != fileCSV && *format != fileJSON {
+		return usagef("import: cannot import %q: -format must be csv or json", path)
+	}
+
+	in := a.stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	users, err := readUsers(in, *format)
+	if err != nil {
+		return err
+	}
+	if len(users) == 0 {
+		return fmt.Errorf("import: %s has no users", path)
+	}
+
+	// Each chunk is created as a whole or not at all, but a failed chunk
+	// leaves the earlier ones in place
+	created := []client.User{}
+	for start := 0; start < len(users); start += importChunkSize {
+		chunk := users[start:min(start+importChunkSize, len(users))]
+		imported, err := a.client.Import(ctx, chunk)
+		if err != nil {
+			return fmt.Errorf("import of rows %d to %d failed, after %d users were created: %w", start+1, start+len(chunk), len(created), err)
+		}
+		created = append(created, imported...)
+	}
+	return a.printUsers(created)
+}
+
+func exportCommand(ctx context.Context, a *app, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	format := fs.String("format", fileJSON, "format to write: csv or json")
+	includeDeleted := fs.Bool("include-deleted", false, "export deleted users too")
+	if err := parseFlags(fs, args); err != nil {
+		return err
+	}
+	if *format != fileCSV && *format != fileJSON {
+		return usagef("export: -format must be csv or json")
+	}
+
+	users, err := collect(ctx, a.client, client.ListOptions{Limit: exportPageSize, IncludeDeleted: *includeDeleted}, 0)
+	if err != nil {
+		return err
+	}
+	return writeUsers(a.stdout, *format, users)
+}
+
+// collect reads the users matching opts page by page, stopping after limit
+// users unless limit is 0.
+func collect(ctx context.Context, c *client.Client, opts client.ListOptions, limit int) ([]client.User, error) {
+	users := []client.User{}
+	for page, err := range c.List(ctx, opts) {
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, page.Users...)
+		if limit > 0 && len(users) >= limit {
+			return users[:limit], nil
+		}
+	}
+	return users, nil
+}
+
+// callOptions makes a write conditional on ifMatch, if set. The quotes of
+// an ETag can be left out, since shells tend to strip them.
+func callOptions(ifMatch string) []client.CallOption {
+	if ifMatch == "" {
+		return nil
+	}
+	if !strings.HasPrefix(ifMatch, `"`) && !strings.HasPrefix(ifMatch, "W/") {
+		ifMatch = strconv.Quote(ifMatch)
+	}
+	return []client.CallOption{client.IfMatch(ifMatch)}
+}
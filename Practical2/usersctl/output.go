@@ -0,0 +1,184 @@
+// output.go
+package usersctl
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"crud-testing/client"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Output formats selected with -o.
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+	outputYAML  = "yaml"
+)
+
+// File formats read by import and written by export.
+const (
+	fileCSV  = "csv"
+	fileJSON = "json"
+)
+
+func validOutput(format string) bool {
+	return format == outputTable || format == outputJSON || format == outputYAML
+}
+
+// userView is how usersctl shows a user. ETag is only known for a user
+// that was read on its own.
+type userView struct {
+	ID        int        `json:"id" yaml:"id"`
+	Name      string     `json:"name" yaml:"name"`
+	Email     string     `json:"email,omitempty" yaml:"email,omitempty"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty" yaml:"deleted_at,omitempty"`
+	ETag      string     `json:"etag,omitempty" yaml:"etag,omitempty"`
+}
+
+func viewOf(user client.User) userView {
+	return userView{ID: user.ID, Name: user.Name, Email: user.Email, DeletedAt: user.DeletedAt, ETag: user.ETag}
+}
+
+// printUser writes one user in the output format.
+func (a *app) printUser(user *client.User) error {
+	view := viewOf(*user)
+	if a.output == outputTable {
+		return writeTable(a.stdout, []userView{view})
+	}
+	return a.encode(view)
+}
+
+// printUsers writes a list of users in the output format.
+func (a *app) printUsers(users []client.User) error {
+	views := make([]userView, len(users))
+	for i, user := range users {
+		views[i] = viewOf(user)
+	}
+	if a.output == outputTable {
+		return writeTable(a.stdout, views)
+	}
+	return a.encode(views)
+}
+
+func (a *app) encode(v any) error {
+	if a.output == outputYAML {
+		enc := yaml.NewEncoder(a.stdout)
+		enc.SetIndent(2)
+		if err := enc.Encode(v); err != nil {
+			return err
+		}
+		return enc.Close()
+	}
+	enc := json.NewEncoder(a.stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// writeTable writes users as aligned columns, with an ETAG column when any
+// user has an ETag.
+func writeTable(w io.Writer, users []userView) error {
+	withETag := false
+	for _, user := range users {
+		withETag = withETag || user.ETag != ""
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	header := "ID\tNAME\tEMAIL\tDELETED AT"
+	if withETag {
+		header += "\tETAG"
+	}
+	fmt.Fprintln(tw, header)
+	for _, user := range users {
+		email := user.Email
+		if email == "" {
+			email = "-"
+		}
+		row := []string{strconv.Itoa(user.ID), user.Name, email, formatTime(user.DeletedAt)}
+		if withETag {
+			row = append(row, user.ETag)
+		}
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	return tw.Flush()
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "-"
+	}
+	return t.Format(time.RFC3339)
+}
+
+// readUsers reads the users to import. A CSV file needs a header row with
+// "name" and "email" columns; a JSON file holds an array of objects with
+// a "name" and an "email".
+// Other columns and fields, such as the id written by export, are ignored
+// since the server assigns IDs.
+func readUsers(r io.Reader, format string) ([]client.UserInput, error) {
+	if format == fileJSON {
+		var users []client.UserInput
+		if err := json.NewDecoder(r).Decode(&users); err != nil {
+			return nil, fmt.Errorf("invalid JSON import: %w", err)
+		}
+		return users, nil
+	}
+
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("invalid CSV import: %w", err)
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("invalid CSV import: missing header row")
+	}
+	nameCol, emailCol := -1, -1
+	for i, name := range records[0] {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "name":
+			nameCol = i
+		case "email":
+			emailCol = i
+		}
+	}
+	if nameCol < 0 || emailCol < 0 {
+		return nil, fmt.Errorf("invalid CSV import: header row needs name and email columns")
+	}
+
+	users := make([]client.UserInput, len(records)-1)
+	for i, record := range records[1:] {
+		users[i] = client.UserInput{Name: record[nameCol], Email: record[emailCol]}
+	}
+	return users, nil
+}
+
+// writeUsers writes an export that readUsers can import again.
+func writeUsers(w io.Writer, format string, users []client.User) error {
+	if format == fileJSON {
+		views := make([]userView, len(users))
+		for i, user := range users {
+			views[i] = viewOf(user)
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(views)
+	}
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"id", "name", "email", "deleted_at"})
+	for _, user := range users {
+		deletedAt := ""
+		if user.DeletedAt != nil {
+			deletedAt = user.DeletedAt.Format(time.RFC3339)
+		}
+		cw.Write([]string{strconv.Itoa(user.ID), user.Name, user.Email, deletedAt})
+	}
+	cw.Flush()
+	return cw.Error()
+}
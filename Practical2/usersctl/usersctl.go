@@ -0,0 +1,212 @@
+// usersctl.go
+
+// Package usersctl implements usersctl, the command-line admin tool for the
+// users API. It talks to the API through the client package, so it uses
+// the same routes as every other client.
+//
+// The server URL and bearer token come from the -server and -token flags,
+// then the USERSCTL_SERVER and USERSCTL_TOKEN environment variables, then a
+// YAML config file:
+//
+//	server: https://users.example.com
+//	token: eyJhbGciOi...
+//
+// The config file is read from -config, USERSCTL_CONFIG or
+// $XDG_CONFIG_HOME/usersctl/config.yaml, falling back to
+// ~/.config/usersctl/config.yaml.
+package usersctl
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"crud-testing/client"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Exit codes returned by Run.
+const (
+	ExitOK    = 0
+	ExitError = 1 // the API or the local system reported an error
+	ExitUsage = 2 // the command line was invalid
+)
+
+const defaultServer = "http://localhost:3000"
+
+const usage = `Usage: usersctl [flags] <command> [arguments]
+
+Commands:
+  list [-name s] [-sort s] [-include-deleted] [-limit n] [-offset n]
+  get <id>
+  create <name> <email>
+  update [-if-match etag] <id> <name> <email>
+  delete [-if-match etag] <id>
+  import [-format csv|json] <file>     reads standard input when file is -;
+                                       sends 1000 users per request
+  export [-format csv|json] [-include-deleted]
+
+Flags:
+`
+
+// Env is what usersctl reads from and writes to besides its arguments.
+type Env struct {
+	Getenv func(string) string
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+}
+
+// Config is where usersctl finds the users API.
+type Config struct {
+	Server string `yaml:"server"`
+	Token  string `yaml:"token"`
+}
+
+// usageError is an invalid command line.
+type usageError struct{ msg string }
+
+func (e usageError) Error() string { return e.msg }
+
+func usagef(format string, args ...any) error {
+	return usageError{fmt.Sprintf(format, args...)}
+}
+
+// command is a usersctl subcommand, run with the arguments after its name.
+type command func(ctx context.Context, a *app, args []string) error
+
+var commands = map[string]command{
+	"list":   listCommand,
+	"get":    getCommand,
+	"create": createCommand,
+	"update": updateCommand,
+	"delete": deleteCommand,
+	"import": importCommand,
+	"export": exportCommand,
+}
+
+// app is the state shared by the subcommands.
+type app struct {
+	client *client.Client
+	output string
+	stdin  io.Reader
+	stdout io.Writer
+}
+
+// Run runs usersctl with args, not including the program name, and returns
+// its exit code.
+func Run(ctx context.Context, args []string, env Env) int {
+	fs := flag.NewFlagSet("usersctl", flag.ContinueOnError)
+	fs.SetOutput(env.Stderr)
+	fs.Usage = func() {
+		fmt.Fprint(env.Stderr, usage)
+		fs.PrintDefaults()
+	}
+
+	var flags Config
+	configPath := fs.String("config", "", "config file (env USERSCTL_CONFIG)")
+	fs.StringVar(&flags.Server, "server", "", "URL of the users API (env USERSCTL_SERVER, default "+defaultServer+")")
+	fs.StringVar(&flags.Token, "token", "", "bearer token sent with every request (env USERSCTL_TOKEN)")
+	output := fs.String("o", outputTable, "output format: table, json or yaml")
+	timeout := fs.Duration("timeout", 30*time.Second, "time limit for the whole command")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return ExitOK
+		}
+		return ExitUsage
+	}
+
+	fail := func(err error) int {
+		fmt.Fprintf(env.Stderr, "usersctl: %v\n", err)
+		var uerr usageError
+		if errors.As(err, &uerr) {
+			fmt.Fprintln(env.Stderr, `Run "usersctl -h" for usage.`)
+			return ExitUsage
+		}
+		return ExitError
+	}
+
+	if fs.NArg() == 0 {
+		return fail(usagef("no command given"))
+	}
+	cmd, ok := commands[fs.Arg(0)]
+	if !ok {
+		return fail(usagef("unknown command %q", fs.Arg(0)))
+	}
+	if !validOutput(*output) {
+		return fail(usagef("invalid output format %q: must be table, json or yaml", *output))
+	}
+
+	cfg, err := loadConfig(*configPath, flags, env.Getenv)
+	if err != nil {
+		return fail(err)
+	}
+	c, err := client.New(cfg.Server, client.WithToken(cfg.Token))
+	if err != nil {
+		return fail(err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+	a := &app{client: c, output: *output, stdin: env.Stdin, stdout: env.Stdout}
+	if err := cmd(ctx, a, fs.Args()[1:]); err != nil {
+		return fail(err)
+	}
+	return ExitOK
+}
+
+// loadConfig merges the config file, the environment and flags, each
+// overriding the one before. Only a config file that was asked for by name
+// has to exist.
+func loadConfig(path string, flags Config, getenv func(string) string) (Config, error) {
+	cfg := Config{Server: defaultServer}
+
+	if path == "" {
+		path = getenv("USERSCTL_CONFIG")
+	}
+	required := path != ""
+	if !required {
+		path = defaultConfigPath(getenv)
+	}
+	if path != "" {
+		data, err := os.ReadFile(path)
+		switch {
+		case err == nil:
+			if err := yaml.Unmarshal(data, &cfg); err != nil {
+				return cfg, fmt.Errorf("invalid config file %s: %w", path, err)
+			}
+		case required || !errors.Is(err, os.ErrNotExist):
+			return cfg, fmt.Errorf("could not read config file: %w", err)
+		}
+	}
+
+	for _, src := range []Config{{Server: getenv("USERSCTL_SERVER"), Token: getenv("USERSCTL_TOKEN")}, flags} {
+		if src.Server != "" {
+			cfg.Server = src.Server
+		}
+		if src.Token != "" {
+			cfg.Token = src.Token
+		}
+	}
+	return cfg, nil
+}
+
+// defaultConfigPath returns the config file looked for when none is named,
+// or "" if there is no home directory to look in.
+func defaultConfigPath(getenv func(string) string) string {
+	dir := getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home := getenv("HOME")
+		if home == "" {
+			return ""
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "usersctl", "config.yaml")
+}
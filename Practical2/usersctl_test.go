@@ -0,0 +1,227 @@
+// usersctl_test.go
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"crud-testing/usersctl"
+)
+
+// runCtl runs usersctl with args and env as its whole environment, and
+// returns its exit code and output.
+func runCtl(t *testing.T, env map[string]string, stdin string, args ...string) (int, string, string) {
+	t.Helper()
+
+	var stdout, stderr bytes.Buffer
+	code := usersctl.Run(context.Background(), args, usersctl.Env{
+		Getenv: func(key string) string { return env[key] },
+		Stdin:  strings.NewReader(stdin),
+		Stdout: &stdout,
+		Stderr: &stderr,
+	})
+	return code, stdout.String(), stderr.String()
+}
+
+// newCtlEnv serves the router and returns an environment pointing
+// usersctl at it.
+func newCtlEnv(t *testing.T) map[string]string {
+	t.Helper()
+
+	srv := httptest.NewServer(newRouter())
+	t.Cleanup(srv.Close)
+	return map[string]string{"USERSCTL_SERVER": srv.URL}
+}
+
+func TestUsersctl(t *testing.T) {
+	resetState()
+	env := newCtlEnv(t)
+
+	code, out, errOut := runCtl(t, env, "", "-o", "json", "create", "Alice", "alice@example.com")
+	if code != usersctl.ExitOK {
+		t.Fatalf("create failed: exit %v: %s", code, errOut)
+	}
+	var created map[string]any
+	json.Unmarshal([]byte(out), &created)
+	if created["id"] != 1.0 || created["name"] != "Alice" || created["email"] != "alice@example.com" || created["etag"] != `"1"` {
+		t.Errorf("wrong user created: %s", out)
+	}
+
+	code, out, _ = runCtl(t, env, "", "-o", "yaml", "get", "1")
+	var got map[string]any
+	if err := yaml.Unmarshal([]byte(out), &got); err != nil || code != usersctl.ExitOK {
+		t.Fatalf("get failed: exit %v: %v", code, err)
+	}
+	if got["name"] != "Alice" || got["etag"] != `"1"` {
+		t.Errorf("wrong user returned: %s", out)
+	}
+
+	// The quotes of the ETag are optional
+	if code, _, errOut := runCtl(t, env, "", "update", "-if-match", "1", "1", "Alicia", "alicia@example.com"); code != usersctl.ExitOK {
+		t.Fatalf("update failed: exit %v: %s", code, errOut)
+	}
+	if code, _, _ := runCtl(t, env, "", "update", "-if-match", "1", "1", "Ali", "ali@example.com"); code != usersctl.ExitError {
+		t.Errorf("update with a stale ETag: got exit %v want %v", code, usersctl.ExitError)
+	}
+
+	runCtl(t, env, "", "create", "Bob", "bob@example.com")
+	_, out, _ = runCtl(t, env, "", "list")
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "ID") || !strings.Contains(lines[1], "alicia@example.com") {
+		t.Errorf("wrong table listed:\n%s", out)
+	}
+
+	_, out, _ = runCtl(t, env, "", "-o", "json", "list", "-sort", "-name", "-limit", "1")
+	var users []map[string]any
+	json.Unmarshal([]byte(out), &users)
+	if len(users) != 1 || users[0]["name"] != "Bob" {
+		t.Errorf("wrong users listed: %s", out)
+	}
+
+	if code, _, errOut := runCtl(t, env, "", "delete", "1"); code != usersctl.ExitOK {
+		t.Fatalf("delete failed: exit %v: %s", code, errOut)
+	}
+	code, _, errOut = runCtl(t, env, "", "get", "1")
+	if code != usersctl.ExitError || !strings.Contains(errOut, "404") {
+		t.Errorf("get after delete: got exit %v (%s) want %v", code, errOut, usersctl.ExitError)
+	}
+}
+
+func TestUsersctl_ImportExport(t *testing.T) {
+	resetState()
+	env := newCtlEnv(t)
+
+	csvImport := "name,email\nAlice,alice@example.com\nBob,bob@example.com\n"
+	if code, _, errOut := runCtl(t, env, csvImport, "import", "-format", "csv", "-"); code != usersctl.ExitOK {
+		t.Fatalf("CSV import failed: exit %v: %s", code, errOut)
+	}
+
+	jsonFile := filepath.Join(t.TempDir(), "users.json")
+	os.WriteFile(jsonFile, []byte(`[{"name":"Carol","email":"carol@example.com"}]`), 0o644)
+	code, out, errOut := runCtl(t, env, "", "-o", "json", "import", jsonFile)
+	if code != usersctl.ExitOK {
+		t.Fatalf("JSON import failed: exit %v: %s", code, errOut)
+	}
+	var imported []map[string]any
+	json.Unmarshal([]byte(out), &imported)
+	if len(imported) != 1 || imported[0]["id"] != 3.0 {
+		t.Errorf("wrong users imported: %s", out)
+	}
+
+	// An invalid row fails the whole import
+	if code, _, _ := runCtl(t, env, "name,email\nDave,dave@example.com\n\n\"\",nobody@example.com\n", "import", "-format", "csv", "-"); code != usersctl.ExitError {
+		t.Errorf("invalid import: got exit %v want %v", code, usersctl.ExitError)
+	}
+	if count, _ := memStore.Count(); count != 3 {
+		t.Errorf("wrong number of users after imports: got %v want %v", count, 3)
+	}
+
+	runCtl(t, env, "", "delete", "2")
+	_, out, _ = runCtl(t, env, "", "export", "-format", "csv", "-include-deleted")
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) != 4 || lines[0] != "id,name,email,deleted_at" || !strings.HasPrefix(lines[1], "1,Alice,alice@example.com,") {
+		t.Errorf("wrong CSV exported:\n%s", out)
+	}
+
+	// A JSON export of the live users imports again
+	_, out, _ = runCtl(t, env, "", "export")
+	if code, _, errOut := runCtl(t, env, out, "import", "-format", "json", "-"); code != usersctl.ExitOK {
+		t.Fatalf("import of export failed: exit %v: %s", code, errOut)
+	}
+	if count, _ := memStore.Count(); count != 4 {
+		t.Errorf("wrong number of users after reimport: got %v want %v", count, 4)
+	}
+}
+
+func TestUsersctl_LargeImport(t *testing.T) {
+	resetState()
+	env := newCtlEnv(t)
+
+	var csvImport strings.Builder
+	csvImport.WriteString("name,email\n")
+	for i := 0; i < 2500; i++ {
+		csvImport.WriteString("User,user@example.com\n")
+	}
+	if code, _, errOut := runCtl(t, env, csvImport.String(), "import", "-format", "csv", "-"); code != usersctl.ExitOK {
+		t.Fatalf("import failed: exit %v: %s", code, errOut)
+	}
+	if count, _ := memStore.Count(); count != 2500 {
+		t.Fatalf("wrong number of users imported: got %v want %v", count, 2500)
+	}
+
+	// An export of more users than fit in one request imports again
+	_, out, _ := runCtl(t, env, "", "export", "-format", "csv")
+	if code, _, errOut := runCtl(t, env, out, "import", "-format", "csv", "-"); code != usersctl.ExitOK {
+		t.Fatalf("import of export failed: exit %v: %s", code, errOut)
+	}
+	if count, _ := memStore.Count(); count != 5000 {
+		t.Errorf("wrong number of users after reimport: got %v want %v", count, 5000)
+	}
+}
+
+func TestUsersctl_Config(t *testing.T) {
+	resetState()
+	enableAuth(t)
+	srv := httptest.NewServer(newRouter())
+	t.Cleanup(srv.Close)
+
+	home := t.TempDir()
+	dir := filepath.Join(home, ".config", "usersctl")
+	os.MkdirAll(dir, 0o755)
+	config := "server: " + srv.URL + "\ntoken: " + mintToken(t, "1", "admin", time.Hour) + "\n"
+	os.WriteFile(filepath.Join(dir, "config.yaml"), []byte(config), 0o600)
+
+	t.Run("Default config file", func(t *testing.T) {
+		if code, _, errOut := runCtl(t, map[string]string{"HOME": home}, "", "list"); code != usersctl.ExitOK {
+			t.Errorf("list failed: exit %v: %s", code, errOut)
+		}
+	})
+
+	t.Run("Environment overrides the file", func(t *testing.T) {
+		env := map[string]string{"HOME": home, "USERSCTL_TOKEN": "not-a-token"}
+		code, _, errOut := runCtl(t, env, "", "list")
+		if code != usersctl.ExitError || !strings.Contains(errOut, "401") {
+			t.Errorf("got exit %v (%s) want %v", code, errOut, usersctl.ExitError)
+		}
+	})
+
+	t.Run("Missing config file", func(t *testing.T) {
+		env := map[string]string{"USERSCTL_CONFIG": filepath.Join(home, "missing.yaml")}
+		if code, _, _ := runCtl(t, env, "", "list"); code != usersctl.ExitError {
+			t.Errorf("got exit %v want %v", code, usersctl.ExitError)
+		}
+	})
+}
+
+func TestUsersctl_Usage(t *testing.T) {
+	testCases := []struct {
+		name string
+		args []string
+	}{
+		{"No command", nil},
+		{"Unknown command", []string{"frobnicate"}},
+		{"Unknown flag", []string{"-verbose", "list"}},
+		{"Invalid output", []string{"-o", "xml", "list"}},
+		{"Invalid ID", []string{"get", "abc"}},
+		{"Missing argument", []string{"update", "1"}},
+		{"Missing email", []string{"create", "Alice"}},
+		{"Unknown import format", []string{"import", "users.xml"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if code, _, _ := runCtl(t, nil, "", tc.args...); code != usersctl.ExitUsage {
+				t.Errorf("got exit %v want %v", code, usersctl.ExitUsage)
+			}
+		})
+	}
+}
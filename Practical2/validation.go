@@ -0,0 +1,144 @@
+// validation.go
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	maxNameLength  = 100
+	maxEmailLength = 254
+)
+
+// FieldError describes why a single request field was rejected.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError collects every field that failed validation.
+type ValidationError struct {
+	Fields []FieldError `json:"fields"`
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Fields))
+	for i, f := range e.Fields {
+		msgs[i] = f.Field + ": " + f.Message
+	}
+	return "validation failed: " + strings.Join(msgs, "; ")
+}
+
+// userRequest is the body accepted by create and update. ID and Email are
+// pointers so fields the client sent can be told apart from absent ones.
+type userRequest struct {
+	ID    *int    `json:"id,omitempty"`
+	Name  string  `json:"name"`
+	Email *string `json:"email,omitempty"`
+}
+
+// decodeUser reads a user from the request body, rejecting unknown fields
+// and trailing data. pathID is the ID from the URL, or 0 on create, and a
+// body id is only accepted when it matches it.
+func decodeUser(r *http.Request, pathID int) (User, error) {
+	return decodeUserJSON(r.Body, pathID, versionFrom(r.Context()))
+}
+
+// decodeUserJSON is decodeUser for an arbitrary reader and API version.
+func decodeUserJSON(body io.Reader, pathID int, v *apiVersion) (User, error) {
+	dec := json.NewDecoder(body)
+	dec.DisallowUnknownFields()
+
+	var req userRequest
+	if err := dec.Decode(&req); err != nil {
+		return User{}, decodeError(err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return User{}, errors.New("request body must contain a single JSON object")
+	}
+
+	user, fields := v.requestUser(req, pathID)
+	if len(fields) > 0 {
+		return User{}, &ValidationError{Fields: fields}
+	}
+	return user, nil
+}
+
+// validateUser checks the fields of user against the API rules. An empty
+// email is left for the caller to reject, since v1 users have none.
+func validateUser(user User) []FieldError {
+	var fields []FieldError
+
+	name := user.Name
+	switch {
+	case strings.TrimSpace(name) == "":
+		fields = append(fields, FieldError{Field: "name", Message: "is required"})
+	case utf8.RuneCountInString(name) > maxNameLength:
+		fields = append(fields, FieldError{Field: "name", Message: fmt.Sprintf("must be at most %d characters", maxNameLength)})
+	case name != strings.TrimSpace(name):
+		fields = append(fields, FieldError{Field: "name", Message: "must not start or end with whitespace"})
+	case strings.IndexFunc(name, invalidNameRune) >= 0:
+		fields = append(fields, FieldError{Field: "name", Message: "may only contain letters, spaces, hyphens, apostrophes and periods"})
+	}
+
+	if email := user.Email; email != "" {
+		if len(email) > maxEmailLength {
+			fields = append(fields, FieldError{Field: "email", Message: fmt.Sprintf("must be at most %d characters", maxEmailLength)})
+		} else if addr, err := mail.ParseAddress(email); err != nil || addr.Address != email {
+			fields = append(fields, FieldError{Field: "email", Message: "must be a valid email address"})
+		}
+	}
+
+	return fields
+}
+
+func invalidNameRune(r rune) bool {
+	if unicode.IsLetter(r) || unicode.IsMark(r) {
+		return false
+	}
+	switch r {
+	case ' ', '-', '\'', '.':
+		return false
+	}
+	return true
+}
+
+// decodeError turns the field-level json decoding failures into a
+// ValidationError and leaves syntax errors as they are.
+func decodeError(err error) error {
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return &ValidationError{Fields: []FieldError{{
+			Field:   typeErr.Field,
+			Message: "must be of type " + jsonTypeName(typeErr.Type.Kind().String()),
+		}}}
+	}
+
+	if field, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		if unquoted, uerr := strconv.Unquote(field); uerr == nil {
+			field = unquoted
+		}
+		return &ValidationError{Fields: []FieldError{{Field: field, Message: "unknown field"}}}
+	}
+
+	return err
+}
+
+func jsonTypeName(kind string) string {
+	switch {
+	case kind == "string":
+		return "string"
+	case strings.HasPrefix(kind, "int"), strings.HasPrefix(kind, "uint"), strings.HasPrefix(kind, "float"):
+		return "number"
+	}
+	return kind
+}
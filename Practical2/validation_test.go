@@ -0,0 +1,101 @@
+// validation_test.go
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestCreateUserHandler_Validation(t *testing.T) {
+	testCases := []struct {
+		name       string
+		payload    string
+		wantStatus int
+		wantFields []FieldError
+	}{
+		{"Valid name", `{"name": "Mary-Jane O'Neil Jr."}`, http.StatusCreated, nil},
+		{"Empty name", `{"name": ""}`, http.StatusUnprocessableEntity, []FieldError{{"name", "is required"}}},
+		{"Missing name", `{}`, http.StatusUnprocessableEntity, []FieldError{{"name", "is required"}}},
+		{"Padded name", `{"name": " Bob "}`, http.StatusUnprocessableEntity, []FieldError{{"name", "must not start or end with whitespace"}}},
+		{"Digits in name", `{"name": "R2D2"}`, http.StatusUnprocessableEntity, []FieldError{{"name", "may only contain letters, spaces, hyphens, apostrophes and periods"}}},
+		{"Client-supplied id", `{"id": 7, "name": "Bob"}`, http.StatusUnprocessableEntity, []FieldError{{"id", "must not be set by the client"}}},
+		{"Unknown field", `{"name": "Bob", "admin": true}`, http.StatusUnprocessableEntity, []FieldError{{"admin", "unknown field"}}},
+		{"Wrong type", `{"name": 42}`, http.StatusUnprocessableEntity, []FieldError{{"name", "must be of type string"}}},
+		{"Trailing data", `{"name": "Bob"} {}`, http.StatusBadRequest, nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resetState()
+
+			req, err := http.NewRequest("POST", "/users", bytes.NewBufferString(tc.payload))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+			router := chi.NewRouter()
+			router.Post("/users", createUserHandler)
+			router.ServeHTTP(rr, req)
+
+			if status := rr.Code; status != tc.wantStatus {
+				t.Fatalf("handler returned wrong status code: got %v want %v", status, tc.wantStatus)
+			}
+
+			if tc.wantFields == nil {
+				return
+			}
+
+			var problem Problem
+			if err := json.NewDecoder(rr.Body).Decode(&problem); err != nil {
+				t.Fatal(err)
+			}
+			if len(problem.Errors) != len(tc.wantFields) {
+				t.Fatalf("handler returned unexpected fields: got %v want %v", problem.Errors, tc.wantFields)
+			}
+			for i, f := range problem.Errors {
+				if f != tc.wantFields[i] {
+					t.Errorf("handler returned unexpected field error: got %v want %v", f, tc.wantFields[i])
+				}
+			}
+		})
+	}
+}
+
+func TestUpdateUserHandler_Validation(t *testing.T) {
+	resetState()
+	setUser(User{ID: 1, Name: "Original Name"})
+
+	testCases := []struct {
+		name       string
+		payload    string
+		wantStatus int
+	}{
+		{"Matching id is allowed", `{"id": 1, "name": "New Name"}`, http.StatusOK},
+		{"Mismatched id", `{"id": 2, "name": "New Name"}`, http.StatusUnprocessableEntity},
+		{"Empty name", `{"name": ""}`, http.StatusUnprocessableEntity},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := http.NewRequest("PUT", "/users/1", bytes.NewBufferString(tc.payload))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rr := httptest.NewRecorder()
+			router := chi.NewRouter()
+			router.Put("/users/{id}", updateUserHandler)
+			router.ServeHTTP(rr, req)
+
+			if status := rr.Code; status != tc.wantStatus {
+				t.Errorf("handler returned wrong status code: got %v want %v", status, tc.wantStatus)
+			}
+		})
+	}
+}
@@ -0,0 +1,204 @@
+// versions.go
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// apiVersion is a version of the REST API, mounted under "/" + name. All
+// versions share the handlers and the store; they differ in how users are
+// represented, which the adapters below translate to and from User.
+type apiVersion struct {
+	name string
+	// emails is set for versions whose users have an email address and
+	// creation and update times.
+	emails bool
+	// deprecated is when the version was deprecated and sunset when it
+	// will be removed; both are zero while the version is current.
+	deprecated time.Time
+	sunset     time.Time
+}
+
+// v1Deprecated is when v2 was released and v1 deprecated. It is a fixed
+// fact of the API's history, sent in v1's Deprecation header, unlike the
+// sunset, which operators may move and so comes from -v1-sunset.
+var v1Deprecated = time.Date(2026, time.October, 17, 0, 0, 0, 0, time.UTC)
+
+var (
+	// apiV1 is the original API, whose users only have an ID and a name.
+	// main sets its sunset from the configuration.
+	apiV1 = &apiVersion{name: "v1", deprecated: v1Deprecated}
+	// apiV2 adds email addresses and timestamps to users.
+	apiV2 = &apiVersion{name: "v2", emails: true}
+)
+
+type apiVersionKey struct{}
+
+// versionFrom returns the API version of a request. Requests that did not
+// come through a version's routes are served as v1, which is what the
+// handlers spoke before the API was versioned.
+func versionFrom(ctx context.Context) *apiVersion {
+	if v, ok := ctx.Value(apiVersionKey{}).(*apiVersion); ok {
+		return v
+	}
+	return apiV1
+}
+
+// versionNamed returns the version with the given name, or v1 for names
+// that are empty or unknown.
+func versionNamed(name string) *apiVersion {
+	if name == apiV2.name {
+		return apiV2
+	}
+	return apiV1
+}
+
+// middleware tags requests with v. Responses of a deprecated version carry
+// the Deprecation header of RFC 9745 and, once a date is set, the Sunset
+// header of RFC 8594.
+func (v *apiVersion) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		v.announceDeprecation(w)
+		ctx := context.WithValue(r.Context(), apiVersionKey{}, v)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func (v *apiVersion) announceDeprecation(w http.ResponseWriter) {
+	if v.deprecated.IsZero() {
+		return
+	}
+	w.Header().Set("Deprecation", "@"+strconv.FormatInt(v.deprecated.Unix(), 10))
+	if !v.sunset.IsZero() {
+		w.Header().Set("Sunset", v.sunset.UTC().Format(http.TimeFormat))
+	}
+}
+
+// redirectToV1 handles the user and webhook paths from before versioning,
+// which are v1's paths without the prefix. 308 keeps the method and body,
+// so clients that follow redirects keep working until v1 is removed.
+func redirectToV1(w http.ResponseWriter, r *http.Request) {
+	apiV1.announceDeprecation(w)
+	target := "/" + apiV1.name + r.URL.EscapedPath()
+	if r.URL.RawQuery != "" {
+		target += "?" + r.URL.RawQuery
+	}
+	http.Redirect(w, r, target, http.StatusPermanentRedirect)
+}
+
+// userV1 is a user as v1 shows it.
+type userV1 struct {
+	ID        int        `json:"id"`
+	Name      string     `json:"name"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+// userV2 is a user as v2 shows it. Users created through v1 have no email
+// until one is set, and users from before v2 may lack timestamps.
+type userV2 struct {
+	ID        int        `json:"id"`
+	Name      string     `json:"name"`
+	Email     string     `json:"email,omitempty"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+// user is the response adapter of v: it converts a stored user to the
+// representation v sends.
+func (v *apiVersion) user(user User) any {
+	if !v.emails {
+		return userV1{ID: user.ID, Name: user.Name, DeletedAt: user.DeletedAt}
+	}
+	return userV2{
+		ID:        user.ID,
+		Name:      user.Name,
+		Email:     user.Email,
+		CreatedAt: optionalTime(user.CreatedAt),
+		UpdatedAt: optionalTime(user.UpdatedAt),
+		DeletedAt: user.DeletedAt,
+	}
+}
+
+// users applies the response adapter to a list of users.
+func (v *apiVersion) users(users []User) []any {
+	out := make([]any, len(users))
+	for i, user := range users {
+		out[i] = v.user(user)
+	}
+	return out
+}
+
+// csvHeader and csvRecord are the response adapter for CSV lists.
+func (v *apiVersion) csvHeader() []string {
+	if !v.emails {
+		return []string{"id", "name"}
+	}
+	return []string{"id", "name", "email", "created_at", "updated_at", "deleted_at"}
+}
+
+func (v *apiVersion) csvRecord(user User) []string {
+	record := []string{strconv.Itoa(user.ID), user.Name}
+	if !v.emails {
+		return record
+	}
+	deletedAt := ""
+	if user.DeletedAt != nil {
+		deletedAt = formatTime(*user.DeletedAt)
+	}
+	return append(record, user.Email, formatTime(user.CreatedAt), formatTime(user.UpdatedAt), deletedAt)
+}
+
+// requestUser is the request adapter of v: it validates the body of a
+// create, when pathID is 0, or of an update of the user with that ID.
+// v2 requires an email on every write, so a PUT without one or a merge
+// patch that removes it is rejected rather than silently keeping the
+// stored email; v1 updates, which cannot see the email, keep it.
+func (v *apiVersion) requestUser(req userRequest, pathID int) (User, []FieldError) {
+	user := User{ID: pathID, Name: req.Name}
+	if v.emails && req.Email != nil {
+		user.Email = *req.Email
+	}
+
+	var fields []FieldError
+	if req.ID != nil && *req.ID != pathID {
+		fields = append(fields, FieldError{Field: "id", Message: "must not be set by the client"})
+	}
+	fields = append(fields, validateUser(user)...)
+	switch {
+	case !v.emails && req.Email != nil:
+		fields = append(fields, FieldError{Field: "email", Message: "unknown field"})
+	case v.emails && req.Email != nil && *req.Email == "":
+		fields = append(fields, FieldError{Field: "email", Message: "must not be empty"})
+	case v.emails && req.Email == nil:
+		fields = append(fields, FieldError{Field: "email", Message: "is required"})
+	}
+	return user, fields
+}
+
+// patchDocument returns the document a PATCH through v applies to: the
+// fields of user that requests of v can write.
+func (v *apiVersion) patchDocument(user User) (any, error) {
+	req := userRequest{ID: &user.ID, Name: user.Name}
+	if v.emails && user.Email != "" {
+		req.Email = &user.Email
+	}
+	return toDocument(req)
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339Nano)
+}
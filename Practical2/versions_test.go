@@ -0,0 +1,205 @@
+// versions_test.go
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUserVersions(t *testing.T) {
+	resetState()
+
+	rr := serve(t, "POST", "/v2/users", `{"name": "Alice", "email": "alice@example.com"}`, nil)
+	if status := rr.Code; status != http.StatusCreated {
+		t.Fatalf("handler returned wrong status code: got %v want %v (%s)", status, http.StatusCreated, rr.Body)
+	}
+	var created map[string]any
+	json.Unmarshal(rr.Body.Bytes(), &created)
+	if created["email"] != "alice@example.com" || created["created_at"] == nil || created["updated_at"] == nil {
+		t.Errorf("v2 user lacks email or timestamps: %s", rr.Body)
+	}
+
+	t.Run("v1 hides the email and timestamps", func(t *testing.T) {
+		rr := serve(t, "GET", "/v1/users/1", "", nil)
+		expected := `{"id":1,"name":"Alice"}`
+		if got := strings.TrimSpace(rr.Body.String()); got != expected {
+			t.Errorf("handler returned unexpected body: got %v want %v", got, expected)
+		}
+	})
+
+	t.Run("v1 rejects an email", func(t *testing.T) {
+		rr := serve(t, "POST", "/v1/users", `{"name": "Bob", "email": "bob@example.com"}`, nil)
+		if status := rr.Code; status != http.StatusUnprocessableEntity {
+			t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusUnprocessableEntity)
+		}
+	})
+
+	t.Run("v1 updates keep the email", func(t *testing.T) {
+		if rr := serve(t, "PUT", "/v1/users/1", `{"name": "Alicia"}`, nil); rr.Code != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+		}
+		if user := peekUser(1); user.Name != "Alicia" || user.Email != "alice@example.com" {
+			t.Errorf("wrong user stored: %+v", user)
+		}
+	})
+
+	t.Run("v2 patches the email", func(t *testing.T) {
+		rr := serve(t, "PATCH", "/v2/users/1", `{"email": "alicia@example.com"}`, map[string]string{"Content-Type": "application/merge-patch+json"})
+		if status := rr.Code; status != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v (%s)", status, http.StatusOK, rr.Body)
+		}
+		if user := peekUser(1); user.Email != "alicia@example.com" || !user.UpdatedAt.After(user.CreatedAt) {
+			t.Errorf("wrong user stored: %+v", user)
+		}
+	})
+
+	invalid := []struct {
+		name    string
+		method  string
+		url     string
+		payload string
+		field   string
+	}{
+		{"Missing email", "POST", "/v2/users", `{"name": "Bob"}`, "email"},
+		{"Empty email", "PUT", "/v2/users/1", `{"name": "Alicia", "email": ""}`, "email"},
+		{"PUT without email", "PUT", "/v2/users/1", `{"name": "Alicia"}`, "email"},
+		{"Invalid email", "POST", "/v2/users", `{"name": "Bob", "email": "Bob <bob@example.com>"}`, "email"},
+		{"Email in a v1 batch", "POST", "/v1/users:batch", `{"operations": [{"op": "create", "user": {"name": "Bob", "email": "bob@example.com"}}]}`, ""},
+	}
+	for _, tc := range invalid {
+		t.Run(tc.name, func(t *testing.T) {
+			rr := serve(t, tc.method, tc.url, tc.payload, nil)
+			if status := rr.Code; status != http.StatusUnprocessableEntity {
+				t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusUnprocessableEntity)
+			}
+			if tc.field != "" && !strings.Contains(rr.Body.String(), `"field":"`+tc.field+`"`) {
+				t.Errorf("problem does not name the field %v: %s", tc.field, rr.Body)
+			}
+		})
+	}
+
+	t.Run("Merge patch cannot remove the email", func(t *testing.T) {
+		rr := serve(t, "PATCH", "/v2/users/1", `{"email": null}`, map[string]string{"Content-Type": "application/merge-patch+json"})
+		if status := rr.Code; status != http.StatusUnprocessableEntity {
+			t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusUnprocessableEntity)
+		}
+		if user := peekUser(1); user.Email != "alicia@example.com" {
+			t.Errorf("rejected patch changed the email: got %q", user.Email)
+		}
+	})
+}
+
+func TestVersionDeprecation(t *testing.T) {
+	resetState()
+	apiV1.sunset = time.Date(2027, time.April, 17, 0, 0, 0, 0, time.UTC)
+	defer func() { apiV1.sunset = time.Time{} }()
+
+	rr := serve(t, "GET", "/v1/users", "", nil)
+	if got := rr.Header().Get("Deprecation"); got != "@1792195200" {
+		t.Errorf("wrong Deprecation header: got %v want %v", got, "@1792195200")
+	}
+	if got := rr.Header().Get("Sunset"); got != "Sat, 17 Apr 2027 00:00:00 GMT" {
+		t.Errorf("wrong Sunset header: got %v want %v", got, "Sat, 17 Apr 2027 00:00:00 GMT")
+	}
+
+	rr = serve(t, "GET", "/v2/users", "", nil)
+	if rr.Header().Get("Deprecation") != "" || rr.Header().Get("Sunset") != "" {
+		t.Errorf("v2 is announced as deprecated: %v", rr.Header())
+	}
+}
+
+func TestUnversionedRedirects(t *testing.T) {
+	resetState()
+
+	testCases := []struct {
+		method   string
+		url      string
+		location string
+	}{
+		{"GET", "/users", "/v1/users"},
+		{"GET", "/users?limit=1&sort=-name", "/v1/users?limit=1&sort=-name"},
+		{"POST", "/users", "/v1/users"},
+		{"PUT", "/users/1", "/v1/users/1"},
+		{"POST", "/users/1:restore", "/v1/users/1:restore"},
+		{"POST", "/users:batch", "/v1/users:batch"},
+		{"GET", "/users/events", "/v1/users/events"},
+		{"GET", "/webhooks/1/deliveries", "/v1/webhooks/1/deliveries"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.method+" "+tc.url, func(t *testing.T) {
+			rr := serve(t, tc.method, tc.url, "", nil)
+			if status := rr.Code; status != http.StatusPermanentRedirect {
+				t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusPermanentRedirect)
+			}
+			if got := rr.Header().Get("Location"); got != tc.location {
+				t.Errorf("wrong Location: got %v want %v", got, tc.location)
+			}
+			if rr.Header().Get("Deprecation") == "" {
+				t.Errorf("redirect does not announce the deprecation")
+			}
+		})
+	}
+}
+
+func TestUserVersionFormats(t *testing.T) {
+	resetState()
+
+	rr := serve(t, "POST", "/v2/users", "name,email\nAlice,alice@example.com\n", map[string]string{"Content-Type": "text/csv"})
+	if status := rr.Code; status != http.StatusCreated {
+		t.Fatalf("handler returned wrong status code: got %v want %v (%s)", status, http.StatusCreated, rr.Body)
+	}
+
+	rr = serve(t, "GET", "/v2/users", "", map[string]string{"Accept": "text/csv"})
+	lines := strings.Split(strings.TrimSpace(rr.Body.String()), "\n")
+	if len(lines) != 2 || lines[0] != "id,name,email,created_at,updated_at,deleted_at" || !strings.HasPrefix(lines[1], "1,Alice,alice@example.com,") {
+		t.Errorf("wrong v2 CSV:\n%s", rr.Body)
+	}
+
+	rr = serve(t, "GET", "/v1/users", "", map[string]string{"Accept": "text/csv"})
+	if expected := "id,name\n1,Alice\n"; rr.Body.String() != expected {
+		t.Errorf("wrong v1 CSV: got %q want %q", rr.Body.String(), expected)
+	}
+
+	// Only v2 imports have an email column
+	rr = serve(t, "POST", "/v1/users", "name,email\nBob,bob@example.com\n", map[string]string{"Content-Type": "text/csv"})
+	if status := rr.Code; status != http.StatusUnprocessableEntity {
+		t.Errorf("handler returned wrong status code: got %v want %v", status, http.StatusUnprocessableEntity)
+	}
+}
+
+func TestWebhookVersions(t *testing.T) {
+	resetState()
+	rec, srv := newReceiver(t)
+	startDispatcher(t, 3)
+
+	rr := serve(t, "POST", "/v2/webhooks", `{"url": "`+srv.URL+`", "events": ["user.created"]}`, nil)
+	if status := rr.Code; status != http.StatusCreated {
+		t.Fatalf("handler returned wrong status code: got %v want %v (%s)", status, http.StatusCreated, rr.Body)
+	}
+	if got := rr.Header().Get("Location"); got != "/v2/webhooks/1" {
+		t.Errorf("wrong Location: got %v want %v", got, "/v2/webhooks/1")
+	}
+
+	serve(t, "POST", "/v1/users", `{"name": "Alice"}`, nil)
+	serve(t, "PUT", "/v2/users/1", `{"name": "Alice", "email": "alice@example.com"}`, nil)
+	serve(t, "POST", "/v2/users", `{"name": "Bob", "email": "bob@example.com"}`, nil)
+	eventually(t, "two deliveries", func() bool { return rec.count() == 2 })
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	for _, body := range rec.bodies {
+		var payload struct {
+			Data userV2 `json:"data"`
+		}
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Fatal(err)
+		}
+		if payload.Data.CreatedAt == nil || (payload.Data.ID == 2) != (payload.Data.Email == "bob@example.com") {
+			t.Errorf("payload does not have the v2 user: %s", body)
+		}
+	}
+}
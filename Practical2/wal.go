@@ -0,0 +1,521 @@
+// wal.go
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WAL sync policies. With always, every write is fsynced before it is
+// acknowledged; with interval, a crash may lose the writes of the last
+// interval; with never, syncing is left to the operating system.
+const (
+	walSyncAlways   = "always"
+	walSyncInterval = "interval"
+	walSyncNever    = "never"
+)
+
+// Operations recorded in the WAL.
+const (
+	walCreate  = "create"
+	walUpdate  = "update"
+	walDelete  = "delete"
+	walRestore = "restore"
+	walPurge   = "purge"
+)
+
+const (
+	snapshotFile = "snapshot.json"
+	walPrefix    = "wal-"
+	walSuffix    = ".log"
+	// walHeaderSize is the length and CRC-32C that precede each record.
+	walHeaderSize = 8
+)
+
+// ErrWALCorrupt is returned when a WAL record other than the last one of
+// the last segment is damaged. A damaged last record is the normal result
+// of a crash during a write and is dropped instead; earlier segments were
+// synced whole when they were rotated, so damage there is real corruption.
+var ErrWALCorrupt = errors.New("WAL is corrupt")
+
+var walCRC = crc32.MakeTable(crc32.Castagnoli)
+
+// storedUser is a user as written to the WAL and snapshots, which, unlike
+// the API, keep the version.
+type storedUser struct {
+	User
+	Version int `json:"version"`
+}
+
+// walChange is one change in a WAL record. A record holds every change of
+// one write, so a batch is recovered whole or not at all.
+type walChange struct {
+	Op   string     `json:"op"`
+	User storedUser `json:"user"`
+}
+
+// snapshot is the content of snapshot.json. Segment is the first WAL
+// segment with changes made after the snapshot.
+type snapshot struct {
+	Segment uint64       `json:"segment"`
+	NextID  int          `json:"next_id"`
+	Users   []storedUser `json:"users"`
+}
+
+// WAL appends change records to numbered segment files in a directory.
+// Each record is a 4-byte length, a CRC-32C of the payload and the
+// payload, a JSON array of changes.
+type WAL struct {
+	dir    string
+	policy string
+
+	mu      sync.Mutex
+	file    *os.File
+	segment uint64
+	// size is the length of the intact records in file.
+	size  int64
+	dirty bool
+	// broken is set once a failed append could not be undone; later
+	// appends fail with it.
+	broken  error
+	done    chan struct{}
+	stopped chan struct{}
+	closed  sync.Once
+}
+
+// openWAL opens segment for appending, creating it if needed. With the
+// interval policy, a goroutine syncs the file every interval until Close.
+func openWAL(dir string, segment uint64, policy string, interval time.Duration) (*WAL, error) {
+	switch policy {
+	case walSyncAlways, walSyncInterval, walSyncNever:
+	default:
+		return nil, fmt.Errorf("unknown WAL sync policy %q", policy)
+	}
+
+	w := &WAL{dir: dir, policy: policy, done: make(chan struct{}), stopped: make(chan struct{})}
+	if err := w.open(segment); err != nil {
+		return nil, err
+	}
+
+	if policy == walSyncInterval {
+		go w.syncEvery(interval)
+	} else {
+		close(w.stopped)
+	}
+	return w, nil
+}
+
+func (w *WAL) open(segment uint64) error {
+	f, err := os.OpenFile(segmentPath(w.dir, segment), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if err := syncDir(w.dir); err != nil {
+		f.Close()
+		return err
+	}
+	w.file, w.segment, w.size = f, segment, info.Size()
+	return nil
+}
+
+// Append writes one record holding changes.
+func (w *WAL) Append(changes []walChange) error {
+	payload, err := json.Marshal(changes)
+	if err != nil {
+		return err
+	}
+	record := make([]byte, walHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(payload, walCRC))
+	copy(record[walHeaderSize:], payload)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.broken != nil {
+		return w.broken
+	}
+	if err := w.write(record); err != nil {
+		w.undo(err)
+		return err
+	}
+	w.size += int64(len(record))
+	return nil
+}
+
+func (w *WAL) write(record []byte) error {
+	if _, err := w.file.Write(record); err != nil {
+		return fmt.Errorf("failed to write WAL: %w", err)
+	}
+	if w.policy == walSyncAlways {
+		if err := w.file.Sync(); err != nil {
+			return fmt.Errorf("failed to sync WAL: %w", err)
+		}
+		return nil
+	}
+	w.dirty = true
+	return nil
+}
+
+// undo cuts a record whose append failed off the segment. Some of it may
+// have reached the file, and left there it would either come back on
+// replay although the write was rejected, or, followed by later records,
+// make the WAL unreadable. If it cannot be cut off, the WAL stops taking
+// writes.
+func (w *WAL) undo(cause error) {
+	err := w.file.Truncate(w.size)
+	if err == nil && w.policy == walSyncAlways {
+		err = w.file.Sync()
+	}
+	if err != nil {
+		w.broken = fmt.Errorf("WAL stopped after a failed append: %w", errors.Join(cause, err))
+		logger.Error("WAL stopped taking writes", slog.Any("error", w.broken))
+	}
+}
+
+// rotate syncs and closes the current segment and starts the next one,
+// returning its number.
+func (w *WAL) rotate() (uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.file.Sync(); err != nil {
+		return 0, fmt.Errorf("failed to sync WAL: %w", err)
+	}
+	if err := w.file.Close(); err != nil {
+		return 0, err
+	}
+	w.dirty = false
+	if err := w.open(w.segment + 1); err != nil {
+		return 0, err
+	}
+	return w.segment, nil
+}
+
+func (w *WAL) syncEvery(interval time.Duration) {
+	defer close(w.stopped)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-w.done:
+			return
+		}
+
+		w.mu.Lock()
+		if w.dirty {
+			if err := w.file.Sync(); err != nil {
+				logger.Error("could not sync WAL", slog.Any("error", err))
+			} else {
+				w.dirty = false
+			}
+		}
+		w.mu.Unlock()
+	}
+}
+
+// Close syncs and closes the WAL. Later calls do nothing.
+func (w *WAL) Close() error {
+	var err error
+	w.closed.Do(func() {
+		close(w.done)
+		<-w.stopped
+
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		err = errors.Join(w.file.Sync(), w.file.Close())
+	})
+	return err
+}
+
+// OpenMemoryStore returns a memory store kept in dir. It loads the latest
+// snapshot, replays the WAL written after it and logs every later change
+// with the given sync policy. A final WAL record cut short by a crash is
+// dropped.
+func OpenMemoryStore(dir, policy string, syncInterval time.Duration) (*MemoryStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	s := NewMemoryStore()
+	snap, err := readSnapshot(dir)
+	if err != nil {
+		return nil, err
+	}
+	s.nextID = max(snap.NextID, 1)
+	for _, u := range snap.Users {
+		s.shard(u.ID).users[u.ID] = u.user()
+	}
+
+	last, err := replayWAL(dir, snap.Segment, s.apply)
+	if err != nil {
+		return nil, err
+	}
+
+	s.wal, err = openWAL(dir, last, policy, syncInterval)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// apply replays one recovered change. It runs before the store is shared,
+// so it needs no locks.
+func (s *MemoryStore) apply(change walChange) {
+	users := s.shard(change.User.ID).users
+	if change.Op == walPurge {
+		delete(users, change.User.ID)
+		return
+	}
+	users[change.User.ID] = change.User.user()
+	s.nextID = max(s.nextID, change.User.ID+1)
+}
+
+// Snapshot writes the current users to the snapshot file and removes the
+// WAL segments it replaces. Writes are blocked only while the users are
+// copied.
+func (s *MemoryStore) Snapshot() error {
+	if s.wal == nil {
+		return nil
+	}
+	s.snapMu.Lock()
+	defer s.snapMu.Unlock()
+
+	// Holding mu keeps writers out, so the shards need no locks
+	s.mu.Lock()
+	snap := snapshot{NextID: s.nextID}
+	for i := range s.shards {
+		for _, user := range s.shards[i].users {
+			snap.Users = append(snap.Users, storedUser{User: user, Version: user.Version})
+		}
+	}
+	segment, err := s.wal.rotate()
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(snap.Users, func(i, j int) bool { return snap.Users[i].ID < snap.Users[j].ID })
+	snap.Segment = segment
+	if err := writeSnapshot(s.wal.dir, snap); err != nil {
+		return err
+	}
+	return removeSegmentsBefore(s.wal.dir, segment)
+}
+
+// Close syncs and closes the WAL, if there is one.
+func (s *MemoryStore) Close() error {
+	if s.wal == nil {
+		return nil
+	}
+	return s.wal.Close()
+}
+
+// runSnapshots snapshots s every interval until ctx is done.
+func runSnapshots(ctx context.Context, s *MemoryStore, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		if err := s.Snapshot(); err != nil {
+			logger.Error("could not write snapshot", slog.Any("error", err))
+		}
+	}
+}
+
+func (u storedUser) user() User {
+	user := u.User
+	user.Version = u.Version
+	return user
+}
+
+func readSnapshot(dir string) (snapshot, error) {
+	data, err := os.ReadFile(filepath.Join(dir, snapshotFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return snapshot{Segment: 1, NextID: 1}, nil
+	}
+	if err != nil {
+		return snapshot{}, err
+	}
+	var snap snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return snapshot{}, fmt.Errorf("invalid snapshot: %w", err)
+	}
+	return snap, nil
+}
+
+// writeSnapshot replaces the snapshot file atomically.
+func writeSnapshot(dir string, snap snapshot) error {
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, snapshotFile+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(dir, snapshotFile)); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// replayWAL passes the changes in segments from onwards to apply, in
+// order, and returns the number of the last segment. A damaged record at
+// the end of the last segment is cut off so appends continue after the
+// last good one; one at the end of an earlier segment is ErrWALCorrupt.
+func replayWAL(dir string, from uint64, apply func(walChange)) (uint64, error) {
+	segments, err := listSegments(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	last := from
+	for i, segment := range segments {
+		if segment < from {
+			continue
+		}
+		last = segment
+
+		path := segmentPath(dir, segment)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return 0, err
+		}
+		good, err := replaySegment(data, apply)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %w", filepath.Base(path), err)
+		}
+		if good < len(data) {
+			if i != len(segments)-1 {
+				return 0, fmt.Errorf("%s: %w: bad record at offset %d of a rotated segment", filepath.Base(path), ErrWALCorrupt, good)
+			}
+			logger.Warn("dropping incomplete WAL record",
+				slog.String("segment", filepath.Base(path)),
+				slog.Int("offset", good),
+			)
+			if err := os.Truncate(path, int64(good)); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return last, nil
+}
+
+// replaySegment applies the records in data and returns the length of the
+// intact prefix. Only the last record may be incomplete or fail its
+// checksum; damage earlier in the segment is ErrWALCorrupt.
+func replaySegment(data []byte, apply func(walChange)) (int, error) {
+	off := 0
+	for off < len(data) {
+		if len(data)-off < walHeaderSize {
+			return off, nil
+		}
+		n := int(binary.BigEndian.Uint32(data[off : off+4]))
+		sum := binary.BigEndian.Uint32(data[off+4 : off+8])
+		end := off + walHeaderSize + n
+		if n > len(data) || end > len(data) {
+			return off, nil
+		}
+
+		payload := data[off+walHeaderSize : end]
+		var changes []walChange
+		if crc32.Checksum(payload, walCRC) != sum || json.Unmarshal(payload, &changes) != nil {
+			if end == len(data) {
+				return off, nil
+			}
+			return off, fmt.Errorf("%w: bad record at offset %d", ErrWALCorrupt, off)
+		}
+		for _, change := range changes {
+			apply(change)
+		}
+		off = end
+	}
+	return off, nil
+}
+
+func segmentPath(dir string, segment uint64) string {
+	return filepath.Join(dir, fmt.Sprintf("%s%016d%s", walPrefix, segment, walSuffix))
+}
+
+// listSegments returns the segment numbers in dir in ascending order.
+func listSegments(dir string) ([]uint64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []uint64
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, walPrefix) || !strings.HasSuffix(name, walSuffix) {
+			continue
+		}
+		n, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, walPrefix), walSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, n)
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+func removeSegmentsBefore(dir string, segment uint64) error {
+	segments, err := listSegments(dir)
+	if err != nil {
+		return err
+	}
+	for _, n := range segments {
+		if n < segment {
+			if err := os.Remove(segmentPath(dir, n)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// syncDir makes file creations and renames in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
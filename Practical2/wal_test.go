@@ -0,0 +1,261 @@
+// wal_test.go
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// openStore opens a persistent store in dir and closes it after the test.
+func openStore(t *testing.T, dir, policy string) *MemoryStore {
+	t.Helper()
+
+	s, err := OpenMemoryStore(dir, policy, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// reopen closes s and opens its directory again.
+func reopen(t *testing.T, s *MemoryStore, dir string) *MemoryStore {
+	t.Helper()
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return openStore(t, dir, walSyncAlways)
+}
+
+// checkUsers fails unless s holds exactly want, deleted users included.
+func checkUsers(t *testing.T, s *MemoryStore, want map[int]User) {
+	t.Helper()
+
+	users, _ := s.ListWithDeleted()
+	if len(users) != len(want) {
+		t.Fatalf("wrong users recovered: got %v want %v", users, want)
+	}
+	for _, user := range users {
+		w := want[user.ID]
+		if user.Name != w.Name || user.Version != w.Version || (user.DeletedAt == nil) != (w.DeletedAt == nil) {
+			t.Errorf("user %d: got %+v want %+v", user.ID, user, w)
+		}
+	}
+}
+
+func TestWALRecovery(t *testing.T) {
+	for _, policy := range []string{walSyncAlways, walSyncInterval, walSyncNever} {
+		t.Run(policy, func(t *testing.T) {
+			dir := t.TempDir()
+			s := openStore(t, dir, policy)
+
+			alice, _ := s.Create(User{Name: "Alice"})
+			bob, _ := s.Create(User{Name: "Bob"})
+			carol, _ := s.Create(User{Name: "Carol"})
+			s.Update(alice.ID, User{Name: "Alicia"}, 0)
+			s.Delete(bob.ID, 0)
+			s.Delete(carol.ID, 0)
+			s.Restore(carol.ID)
+			s.Create(User{Name: "Dave"})
+			s.now = func() time.Time { return time.Now().Add(-48 * time.Hour) }
+			s.Delete(4, 0)
+			s.Purge(time.Now().Add(-24 * time.Hour))
+
+			s = reopen(t, s, dir)
+			deleted := time.Now()
+			checkUsers(t, s, map[int]User{
+				1: {Name: "Alicia", Version: 2},
+				2: {Name: "Bob", Version: 2, DeletedAt: &deleted},
+				3: {Name: "Carol", Version: 3},
+			})
+
+			// IDs continue after the purged user
+			if user, _ := s.Create(User{Name: "Erin"}); user.ID != 5 {
+				t.Errorf("wrong ID after recovery: got %v want %v", user.ID, 5)
+			}
+		})
+	}
+}
+
+func TestWALBatch(t *testing.T) {
+	dir := t.TempDir()
+	s := openStore(t, dir, walSyncAlways)
+	s.Create(User{Name: "Alice"})
+
+	// A failed atomic batch leaves nothing behind, a best-effort one keeps
+	// what succeeded
+	s.Batch([]BatchOp{
+		{Op: BatchCreate, User: User{Name: "Bob"}},
+		{Op: BatchDelete, ID: 99},
+	}, true)
+	s.Batch([]BatchOp{
+		{Op: BatchUpdate, ID: 1, User: User{Name: "Alicia"}},
+		{Op: BatchDelete, ID: 99},
+		{Op: BatchCreate, User: User{Name: "Carol"}},
+	}, false)
+
+	s = reopen(t, s, dir)
+	checkUsers(t, s, map[int]User{
+		1: {Name: "Alicia", Version: 2},
+		2: {Name: "Carol", Version: 1},
+	})
+}
+
+func TestWALSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	s := openStore(t, dir, walSyncAlways)
+	s.Create(User{Name: "Alice"})
+	s.Create(User{Name: "Bob"})
+	s.Delete(2, 0)
+	s.Purge(time.Now().Add(time.Hour))
+
+	if err := s.Snapshot(); err != nil {
+		t.Fatal(err)
+	}
+	s.Update(1, User{Name: "Alicia"}, 0)
+
+	segments, _ := listSegments(dir)
+	if len(segments) != 1 || segments[0] != 2 {
+		t.Errorf("old segments were not removed: %v", segments)
+	}
+
+	s = reopen(t, s, dir)
+	checkUsers(t, s, map[int]User{1: {Name: "Alicia", Version: 2}})
+	if user, _ := s.Create(User{Name: "Carol"}); user.ID != 3 {
+		t.Errorf("wrong ID after recovery: got %v want %v", user.ID, 3)
+	}
+}
+
+func TestWALTruncatedRecord(t *testing.T) {
+	dir := t.TempDir()
+	s := openStore(t, dir, walSyncAlways)
+	s.Create(User{Name: "Alice"})
+	s.Create(User{Name: "Bob"})
+	s.Close()
+
+	// Cut the last record short, as a crash in the middle of a write would
+	path := segmentPath(dir, 1)
+	info, _ := os.Stat(path)
+	if err := os.Truncate(path, info.Size()-5); err != nil {
+		t.Fatal(err)
+	}
+
+	s = openStore(t, dir, walSyncAlways)
+	checkUsers(t, s, map[int]User{1: {Name: "Alice", Version: 1}})
+
+	// Appends continue after the last intact record
+	if user, _ := s.Create(User{Name: "Carol"}); user.ID != 2 {
+		t.Errorf("wrong ID after recovery: got %v want %v", user.ID, 2)
+	}
+	s = reopen(t, s, dir)
+	checkUsers(t, s, map[int]User{
+		1: {Name: "Alice", Version: 1},
+		2: {Name: "Carol", Version: 1},
+	})
+}
+
+func TestWALCorruptRecord(t *testing.T) {
+	dir := t.TempDir()
+	s := openStore(t, dir, walSyncAlways)
+	s.Create(User{Name: "Alice"})
+	s.Create(User{Name: "Bob"})
+	s.Close()
+
+	// Damage the first record, which is followed by another
+	path := segmentPath(dir, 1)
+	data, _ := os.ReadFile(path)
+	data[walHeaderSize+2] ^= 0xff
+	os.WriteFile(path, data, 0o644)
+
+	if _, err := OpenMemoryStore(dir, walSyncAlways, time.Second); !errors.Is(err, ErrWALCorrupt) {
+		t.Errorf("wrong error: got %v want %v", err, ErrWALCorrupt)
+	}
+}
+
+func TestWALWriteFailure(t *testing.T) {
+	dir := t.TempDir()
+	s := openStore(t, dir, walSyncAlways)
+	s.Create(User{Name: "Alice"})
+
+	// A write that cannot be logged is not applied
+	s.wal.file.Close()
+	if _, err := s.Create(User{Name: "Bob"}); err == nil {
+		t.Fatal("expected an error")
+	}
+	if _, err := s.Update(1, User{Name: "Alicia"}, 0); err == nil {
+		t.Fatal("expected an error")
+	}
+	checkUsers(t, s, map[int]User{1: {Name: "Alice", Version: 1}})
+	if s.nextID != 2 {
+		t.Errorf("wrong next ID: got %v want %v", s.nextID, 2)
+	}
+
+	// The failed record could not be cut off, so the WAL takes no more
+	// writes, even once the file is usable again
+	f, err := os.OpenFile(segmentPath(dir, 1), os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.wal.file = f
+	if _, err := s.Create(User{Name: "Carol"}); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	s = reopen(t, s, dir)
+	checkUsers(t, s, map[int]User{1: {Name: "Alice", Version: 1}})
+	if _, err := s.Create(User{Name: "Carol"}); err != nil {
+		t.Errorf("write after restart failed: %v", err)
+	}
+}
+
+func TestWALFailedAppendIsCutOff(t *testing.T) {
+	dir := t.TempDir()
+	s := openStore(t, dir, walSyncAlways)
+	s.Create(User{Name: "Alice"})
+
+	// Part of a record reached the file before its append failed
+	s.wal.file.Write([]byte("partial record"))
+	s.wal.undo(errors.New("disk full"))
+	if s.wal.broken != nil {
+		t.Fatalf("WAL stopped: %v", s.wal.broken)
+	}
+
+	// Later records follow the last intact one, so the WAL stays readable
+	s.Create(User{Name: "Bob"})
+	s = reopen(t, s, dir)
+	checkUsers(t, s, map[int]User{
+		1: {Name: "Alice", Version: 1},
+		2: {Name: "Bob", Version: 1},
+	})
+}
+
+func TestWALCorruptRotatedSegment(t *testing.T) {
+	dir := t.TempDir()
+	s := openStore(t, dir, walSyncAlways)
+	s.Create(User{Name: "Alice"})
+	s.wal.rotate()
+	s.Create(User{Name: "Bob"})
+	s.Close()
+
+	// Cut the only record of the first segment short. Only the last
+	// segment can end in a partial write, so this is corruption.
+	path := segmentPath(dir, 1)
+	info, _ := os.Stat(path)
+	if err := os.Truncate(path, info.Size()-5); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := OpenMemoryStore(dir, walSyncAlways, time.Second); !errors.Is(err, ErrWALCorrupt) {
+		t.Errorf("wrong error: got %v want %v", err, ErrWALCorrupt)
+	}
+}
+
+func TestOpenMemoryStore_InvalidPolicy(t *testing.T) {
+	if _, err := OpenMemoryStore(filepath.Join(t.TempDir(), "data"), "sometimes", time.Second); err == nil {
+		t.Error("expected an error")
+	}
+}
@@ -0,0 +1,462 @@
+// webhooks.go
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Event types that webhooks can subscribe to.
+const (
+	WebhookUserCreated  = "user.created"
+	WebhookUserUpdated  = "user.updated"
+	WebhookUserDeleted  = "user.deleted"
+	WebhookUserRestored = "user.restored"
+)
+
+var webhookEventTypes = map[string]string{
+	EventCreated:  WebhookUserCreated,
+	EventUpdated:  WebhookUserUpdated,
+	EventDeleted:  WebhookUserDeleted,
+	EventRestored: WebhookUserRestored,
+}
+
+// Limits on what the webhook store keeps.
+const (
+	maxDeliveryLog  = 100
+	maxDeadLetters  = 1000
+	minSecretLength = 16
+)
+
+// ErrWebhookNotFound is returned for webhook IDs that do not exist.
+var ErrWebhookNotFound = errors.New("webhook not found")
+
+// webhookStore holds the webhook subscriptions and their delivery history.
+var webhookStore = NewWebhookStore()
+
+// Webhook is a subscription to user events. An empty Events list receives
+// every event type. Deliveries are signed with Secret, which is only
+// returned when the webhook is created. APIVersion is the version the
+// webhook was last written through, whose user representation its
+// payloads use.
+type Webhook struct {
+	ID         int       `json:"id"`
+	URL        string    `json:"url"`
+	Events     []string  `json:"events"`
+	Active     bool      `json:"active"`
+	Secret     string    `json:"secret,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	APIVersion string    `json:"-"`
+}
+
+// wants reports whether the webhook receives events of the given type.
+func (h Webhook) wants(eventType string) bool {
+	return h.Active && (len(h.Events) == 0 || slices.Contains(h.Events, eventType))
+}
+
+// Delivery is one attempt to deliver an event to a webhook.
+type Delivery struct {
+	DeliveryID string    `json:"delivery_id"`
+	WebhookID  int       `json:"webhook_id"`
+	EventID    uint64    `json:"event_id"`
+	Event      string    `json:"event"`
+	Attempt    int       `json:"attempt"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	DurationMS int64     `json:"duration_ms"`
+	At         time.Time `json:"at"`
+}
+
+// DeadLetter is an event that could not be delivered to a webhook.
+type DeadLetter struct {
+	DeliveryID string          `json:"delivery_id"`
+	WebhookID  int             `json:"webhook_id"`
+	EventID    uint64          `json:"event_id"`
+	Event      string          `json:"event"`
+	Payload    json.RawMessage `json:"payload"`
+	Attempts   int             `json:"attempts"`
+	LastError  string          `json:"last_error"`
+	FailedAt   time.Time       `json:"failed_at"`
+}
+
+// WebhookStore keeps webhooks, the most recent deliveries to each one and
+// the dead-letter list in memory.
+type WebhookStore struct {
+	mu          sync.Mutex
+	hooks       map[int]Webhook
+	nextID      int
+	deliveries  map[int][]Delivery
+	deadLetters []DeadLetter
+}
+
+// NewWebhookStore returns an empty store.
+func NewWebhookStore() *WebhookStore {
+	return &WebhookStore{
+		hooks:      make(map[int]Webhook),
+		nextID:     1,
+		deliveries: make(map[int][]Delivery),
+	}
+}
+
+// List returns every webhook in ID order.
+func (s *WebhookStore) List() []Webhook {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hooks := make([]Webhook, 0, len(s.hooks))
+	for _, h := range s.hooks {
+		hooks = append(hooks, h)
+	}
+	slices.SortFunc(hooks, func(a, b Webhook) int { return a.ID - b.ID })
+	return hooks
+}
+
+// Get returns the webhook with the given ID.
+func (s *WebhookStore) Get(id int) (Webhook, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h, ok := s.hooks[id]
+	if !ok {
+		return Webhook{}, ErrWebhookNotFound
+	}
+	return h, nil
+}
+
+// Create assigns the next ID to h and stores it.
+func (s *WebhookStore) Create(h Webhook) Webhook {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h.ID = s.nextID
+	s.nextID++
+	s.hooks[h.ID] = h
+	return h
+}
+
+// Update replaces a webhook, keeping its secret when h has none.
+func (s *WebhookStore) Update(id int, h Webhook) (Webhook, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, ok := s.hooks[id]
+	if !ok {
+		return Webhook{}, ErrWebhookNotFound
+	}
+	h.ID = id
+	h.CreatedAt = current.CreatedAt
+	if h.Secret == "" {
+		h.Secret = current.Secret
+	}
+	s.hooks[id] = h
+	return h, nil
+}
+
+// Delete removes a webhook and its delivery log.
+func (s *WebhookStore) Delete(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.hooks[id]; !ok {
+		return ErrWebhookNotFound
+	}
+	delete(s.hooks, id)
+	delete(s.deliveries, id)
+	return nil
+}
+
+// subscribers returns the webhooks that receive eventType.
+func (s *WebhookStore) subscribers(eventType string) []Webhook {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var hooks []Webhook
+	for _, h := range s.hooks {
+		if h.wants(eventType) {
+			hooks = append(hooks, h)
+		}
+	}
+	return hooks
+}
+
+// logDelivery records an attempt, keeping the last maxDeliveryLog per
+// webhook.
+func (s *WebhookStore) logDelivery(d Delivery) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.hooks[d.WebhookID]; !ok {
+		return
+	}
+	log := append(s.deliveries[d.WebhookID], d)
+	if len(log) > maxDeliveryLog {
+		log = log[len(log)-maxDeliveryLog:]
+	}
+	s.deliveries[d.WebhookID] = log
+}
+
+// Deliveries returns the logged attempts for a webhook, newest first.
+func (s *WebhookStore) Deliveries(id int) ([]Delivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.hooks[id]; !ok {
+		return nil, ErrWebhookNotFound
+	}
+	log := slices.Clone(s.deliveries[id])
+	slices.Reverse(log)
+	return log, nil
+}
+
+// addDeadLetter records an undeliverable event, dropping the oldest once
+// there are maxDeadLetters.
+func (s *WebhookStore) addDeadLetter(dl DeadLetter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.deadLetters = append(s.deadLetters, dl)
+	if len(s.deadLetters) > maxDeadLetters {
+		s.deadLetters = s.deadLetters[len(s.deadLetters)-maxDeadLetters:]
+	}
+}
+
+// DeadLetters returns the undeliverable events, newest first.
+func (s *WebhookStore) DeadLetters() []DeadLetter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	letters := slices.Clone(s.deadLetters)
+	slices.Reverse(letters)
+	return letters
+}
+
+type webhookRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	Active *bool    `json:"active"`
+	Secret string   `json:"secret"`
+}
+
+// decodeWebhook reads and validates a webhook from the request body.
+func decodeWebhook(r *http.Request) (Webhook, error) {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+
+	var req webhookRequest
+	if err := dec.Decode(&req); err != nil {
+		return Webhook{}, decodeError(err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return Webhook{}, errors.New("request body must contain a single JSON object")
+	}
+
+	var fields []FieldError
+	if u, err := url.Parse(req.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		fields = append(fields, FieldError{Field: "url", Message: "must be an absolute http or https URL"})
+	} else if !allowPrivateWebhooks && internalHost(u.Hostname()) {
+		fields = append(fields, FieldError{Field: "url", Message: "must not point to a loopback, private or link-local address"})
+	}
+	for i, event := range req.Events {
+		if event != WebhookUserCreated && event != WebhookUserUpdated && event != WebhookUserDeleted && event != WebhookUserRestored {
+			fields = append(fields, FieldError{
+				Field:   "events." + strconv.Itoa(i),
+				Message: "must be user.created, user.updated, user.deleted or user.restored",
+			})
+		}
+	}
+	if req.Secret != "" && len(req.Secret) < minSecretLength {
+		fields = append(fields, FieldError{
+			Field:   "secret",
+			Message: "must be at least " + strconv.Itoa(minSecretLength) + " characters",
+		})
+	}
+	if len(fields) > 0 {
+		return Webhook{}, &ValidationError{Fields: fields}
+	}
+
+	h := Webhook{URL: req.URL, Events: req.Events, Active: true, Secret: req.Secret}
+	if h.Events == nil {
+		h.Events = []string{}
+	}
+	if req.Active != nil {
+		h.Active = *req.Active
+	}
+	return h, nil
+}
+
+// allowPrivateWebhooks accepts webhook URLs with internal addresses. main
+// sets it from the configuration, which the dispatcher is also given.
+var allowPrivateWebhooks bool
+
+// sharedAddressSpace is the carrier-grade NAT range, which netip does not
+// count as private.
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// internalHost reports whether host names a machine webhooks must not
+// reach. Only localhost and IP literals are known here; names that resolve
+// to internal addresses are refused when the dispatcher dials them.
+func internalHost(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+	ip, err := netip.ParseAddr(host)
+	return err == nil && internalAddr(ip)
+}
+
+// internalAddr reports whether ip is loopback, private, link-local (which
+// includes cloud metadata endpoints such as 169.254.169.254), unspecified
+// or multicast.
+func internalAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsUnspecified() || ip.IsMulticast() || sharedAddressSpace.Contains(ip)
+}
+
+func writeWebhookError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, ErrWebhookNotFound) {
+		writeProblem(w, r, Problem{
+			Type:   problemWebhookNotFound,
+			Title:  "Webhook not found",
+			Status: http.StatusNotFound,
+		})
+		return
+	}
+	writeInternalError(w, r, err)
+}
+
+func writeWebhookJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// webhookID parses the {id} URL parameter.
+func webhookID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		writeProblem(w, r, Problem{
+			Type:   problemInvalidWebhookID,
+			Title:  "Invalid webhook ID",
+			Status: http.StatusBadRequest,
+			Detail: "The webhook ID must be an integer.",
+		})
+		return 0, false
+	}
+	return id, true
+}
+
+// listWebhooksHandler handles GET /webhooks.
+func listWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	hooks := webhookStore.List()
+	for i := range hooks {
+		hooks[i].Secret = ""
+	}
+	writeWebhookJSON(w, http.StatusOK, hooks)
+}
+
+// createWebhookHandler handles POST /webhooks. A secret is generated when
+// the request has none; the response is the only one that includes it.
+func createWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	h, err := decodeWebhook(r)
+	if err != nil {
+		writeDecodeError(w, r, err)
+		return
+	}
+	if h.Secret == "" {
+		h.Secret = newRequestID()
+	}
+	h.CreatedAt = time.Now().UTC()
+	h.APIVersion = versionFrom(r.Context()).name
+	h = webhookStore.Create(h)
+
+	w.Header().Set("Location", "/"+h.APIVersion+"/webhooks/"+strconv.Itoa(h.ID))
+	writeWebhookJSON(w, http.StatusCreated, h)
+}
+
+// getWebhookHandler handles GET /webhooks/{id}.
+func getWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := webhookID(w, r)
+	if !ok {
+		return
+	}
+	h, err := webhookStore.Get(id)
+	if err != nil {
+		writeWebhookError(w, r, err)
+		return
+	}
+	h.Secret = ""
+	writeWebhookJSON(w, http.StatusOK, h)
+}
+
+// updateWebhookHandler handles PUT /webhooks/{id}. The secret is only
+// rotated when the body contains one.
+func updateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := webhookID(w, r)
+	if !ok {
+		return
+	}
+	h, err := decodeWebhook(r)
+	if err != nil {
+		writeDecodeError(w, r, err)
+		return
+	}
+	h.APIVersion = versionFrom(r.Context()).name
+	h, err = webhookStore.Update(id, h)
+	if err != nil {
+		writeWebhookError(w, r, err)
+		return
+	}
+	h.Secret = ""
+	writeWebhookJSON(w, http.StatusOK, h)
+}
+
+// deleteWebhookHandler handles DELETE /webhooks/{id}.
+func deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := webhookID(w, r)
+	if !ok {
+		return
+	}
+	if err := webhookStore.Delete(id); err != nil {
+		writeWebhookError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// webhookDeliveriesHandler handles GET /webhooks/{id}/deliveries.
+func webhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := webhookID(w, r)
+	if !ok {
+		return
+	}
+	log, err := webhookStore.Deliveries(id)
+	if err != nil {
+		writeWebhookError(w, r, err)
+		return
+	}
+	if log == nil {
+		log = []Delivery{}
+	}
+	writeWebhookJSON(w, http.StatusOK, log)
+}
+
+// deadLettersHandler handles GET /webhooks/dead-letters.
+func deadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	letters := webhookStore.DeadLetters()
+	if letters == nil {
+		letters = []DeadLetter{}
+	}
+	writeWebhookJSON(w, http.StatusOK, letters)
+}
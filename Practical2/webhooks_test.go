@@ -0,0 +1,410 @@
+// webhooks_test.go
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testSecret = "0123456789abcdef"
+
+// receiver is a webhook endpoint that records deliveries and answers with
+// the next status in its script, then 200.
+type receiver struct {
+	mu       sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func newReceiver(t *testing.T, statuses ...int) (*receiver, *httptest.Server) {
+	t.Helper()
+
+	allowPrivateWebhooks = true
+	t.Cleanup(func() { allowPrivateWebhooks = false })
+
+	rec := &receiver{statuses: statuses}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		rec.mu.Lock()
+		rec.requests = append(rec.requests, r)
+		rec.bodies = append(rec.bodies, body)
+		status := http.StatusOK
+		if len(rec.statuses) > 0 {
+			status, rec.statuses = rec.statuses[0], rec.statuses[1:]
+		}
+		rec.mu.Unlock()
+
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return rec, srv
+}
+
+func (rec *receiver) count() int {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return len(rec.requests)
+}
+
+// startDispatcher runs a dispatcher over the test state until the test ends.
+func startDispatcher(t *testing.T, maxAttempts int) {
+	t.Helper()
+
+	runDispatcher(t, NewDispatcher(webhookStore, userEvents, maxAttempts, time.Millisecond, time.Second, webhookWorkers, true))
+}
+
+// runDispatcher runs d until the test ends.
+func runDispatcher(t *testing.T, d *Dispatcher) {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		d.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+// eventually fails the test if cond does not hold within a few seconds.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func createWebhook(t *testing.T, body string) Webhook {
+	t.Helper()
+
+	rr := serve(t, "POST", "/v1/webhooks", body, nil)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("handler returned wrong status code: got %v want %v (%s)", rr.Code, http.StatusCreated, rr.Body)
+	}
+	var h Webhook
+	if err := json.NewDecoder(rr.Body).Decode(&h); err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestWebhookCRUD(t *testing.T) {
+	resetState()
+
+	created := createWebhook(t, `{"url": "https://example.com/hook", "events": ["user.created"]}`)
+	if created.ID != 1 || !created.Active || len(created.Secret) < minSecretLength {
+		t.Fatalf("wrong created webhook: %+v", created)
+	}
+
+	t.Run("get hides the secret", func(t *testing.T) {
+		rr := serve(t, "GET", "/v1/webhooks/1", "", nil)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+		}
+		if strings.Contains(rr.Body.String(), created.Secret) || strings.Contains(rr.Body.String(), `"secret"`) {
+			t.Errorf("response exposes the secret: %s", rr.Body)
+		}
+	})
+
+	t.Run("update keeps the secret", func(t *testing.T) {
+		rr := serve(t, "PUT", "/v1/webhooks/1", `{"url": "https://example.com/v2", "active": false}`, nil)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("handler returned wrong status code: got %v want %v (%s)", rr.Code, http.StatusOK, rr.Body)
+		}
+		h, _ := webhookStore.Get(1)
+		if h.URL != "https://example.com/v2" || h.Active || h.Secret != created.Secret {
+			t.Errorf("wrong updated webhook: %+v", h)
+		}
+	})
+
+	t.Run("list", func(t *testing.T) {
+		createWebhook(t, `{"url": "https://example.org/hook", "secret": "`+testSecret+`"}`)
+		rr := serve(t, "GET", "/v1/webhooks", "", nil)
+		var hooks []Webhook
+		if err := json.NewDecoder(rr.Body).Decode(&hooks); err != nil {
+			t.Fatal(err)
+		}
+		if len(hooks) != 2 || hooks[0].ID != 1 || hooks[1].ID != 2 {
+			t.Errorf("wrong webhooks: %+v", hooks)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		if rr := serve(t, "DELETE", "/v1/webhooks/1", "", nil); rr.Code != http.StatusNoContent {
+			t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusNoContent)
+		}
+		if rr := serve(t, "GET", "/v1/webhooks/1", "", nil); rr.Code != http.StatusNotFound {
+			t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusNotFound)
+		}
+	})
+
+	invalid := []struct {
+		name  string
+		body  string
+		field string
+	}{
+		{"relative URL", `{"url": "/hook"}`, "url"},
+		{"unsupported scheme", `{"url": "ftp://example.com"}`, "url"},
+		{"loopback URL", `{"url": "http://127.0.0.1:8080/hook"}`, "url"},
+		{"IPv6 loopback URL", `{"url": "http://[::1]/hook"}`, "url"},
+		{"localhost URL", `{"url": "http://localhost/hook"}`, "url"},
+		{"metadata URL", `{"url": "http://169.254.169.254/latest/meta-data"}`, "url"},
+		{"private URL", `{"url": "https://10.0.0.5/hook"}`, "url"},
+		{"mapped private URL", `{"url": "https://[::ffff:192.168.1.1]/hook"}`, "url"},
+		{"unknown event", `{"url": "https://example.com", "events": ["user.renamed"]}`, "events.0"},
+		{"short secret", `{"url": "https://example.com", "secret": "short"}`, "secret"},
+		{"unknown field", `{"url": "https://example.com", "method": "PUT"}`, "method"},
+	}
+	for _, tt := range invalid {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := serve(t, "POST", "/v1/webhooks", tt.body, nil)
+			if rr.Code != http.StatusUnprocessableEntity {
+				t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusUnprocessableEntity)
+			}
+			var p Problem
+			json.NewDecoder(rr.Body).Decode(&p)
+			if len(p.Errors) != 1 || p.Errors[0].Field != tt.field {
+				t.Errorf("wrong field errors: got %+v want field %v", p.Errors, tt.field)
+			}
+		})
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	resetState()
+	rec, srv := newReceiver(t)
+	createWebhook(t, `{"url": "`+srv.URL+`", "events": ["user.created", "user.deleted"], "secret": "`+testSecret+`"}`)
+	startDispatcher(t, 3)
+
+	serve(t, "POST", "/v1/users", `{"name": "Alice"}`, nil)
+	serve(t, "PUT", "/v1/users/1", `{"name": "Alicia"}`, nil)
+	serve(t, "DELETE", "/v1/users/1", "", nil)
+	eventually(t, "two deliveries", func() bool { return rec.count() == 2 })
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	var types []string
+	for i, req := range rec.requests {
+		body := rec.bodies[i]
+		signature := SignWebhook(testSecret, req.Header.Get(webhookTimestampHeader), body)
+		if got := req.Header.Get(webhookSignatureHeader); got != signature {
+			t.Errorf("wrong signature: got %v want %v", got, signature)
+		}
+
+		var payload WebhookPayload
+		if err := json.Unmarshal(body, &payload); err != nil {
+			t.Fatal(err)
+		}
+		data, _ := payload.Data.(map[string]any)
+		if data["id"] != 1.0 || payload.Type != req.Header.Get(webhookEventHeader) {
+			t.Errorf("wrong payload: %s", body)
+		}
+		types = append(types, payload.Type)
+	}
+	// Deliveries run concurrently, so they may arrive in either order
+	if !(strings.Contains(strings.Join(types, " "), WebhookUserCreated) && strings.Contains(strings.Join(types, " "), WebhookUserDeleted)) {
+		t.Errorf("wrong event types delivered: %v", types)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	resetState()
+	rec, srv := newReceiver(t, http.StatusInternalServerError, http.StatusServiceUnavailable)
+	createWebhook(t, `{"url": "`+srv.URL+`"}`)
+	startDispatcher(t, 3)
+
+	serve(t, "POST", "/v1/users", `{"name": "Alice"}`, nil)
+	eventually(t, "three attempts", func() bool { return rec.count() == 3 })
+	eventually(t, "the delivery log", func() bool {
+		log, _ := webhookStore.Deliveries(1)
+		return len(log) == 3
+	})
+
+	rr := serve(t, "GET", "/v1/webhooks/1/deliveries", "", nil)
+	var log []Delivery
+	if err := json.NewDecoder(rr.Body).Decode(&log); err != nil {
+		t.Fatal(err)
+	}
+	wantStatus := []int{200, 503, 500}
+	for i, d := range log {
+		if d.Attempt != 3-i || d.StatusCode != wantStatus[i] {
+			t.Errorf("wrong delivery %d: got attempt %d status %d want attempt %d status %d", i, d.Attempt, d.StatusCode, 3-i, wantStatus[i])
+		}
+		if d.DeliveryID != log[0].DeliveryID {
+			t.Errorf("attempts have different delivery IDs: %v and %v", d.DeliveryID, log[0].DeliveryID)
+		}
+	}
+	if letters := webhookStore.DeadLetters(); len(letters) != 0 {
+		t.Errorf("delivered event was dead-lettered: %+v", letters)
+	}
+
+	rec.mu.Lock()
+	first, last := rec.requests[0], rec.requests[2]
+	rec.mu.Unlock()
+	if first.Header.Get(webhookDeliveryHeader) != last.Header.Get(webhookDeliveryHeader) {
+		t.Error("retries were sent with a new delivery ID")
+	}
+}
+
+func TestWebhookDeadLetters(t *testing.T) {
+	resetState()
+	_, failing := newReceiver(t, 500, 500, 500)
+	_, rejecting := newReceiver(t, http.StatusGone)
+	createWebhook(t, `{"url": "`+failing.URL+`"}`)
+	createWebhook(t, `{"url": "`+rejecting.URL+`"}`)
+	startDispatcher(t, 3)
+
+	serve(t, "POST", "/v1/users", `{"name": "Alice"}`, nil)
+	eventually(t, "two dead letters", func() bool { return len(webhookStore.DeadLetters()) == 2 })
+
+	rr := serve(t, "GET", "/v1/webhooks/dead-letters", "", nil)
+	var letters []DeadLetter
+	if err := json.NewDecoder(rr.Body).Decode(&letters); err != nil {
+		t.Fatal(err)
+	}
+	attempts := map[int]int{}
+	for _, dl := range letters {
+		attempts[dl.WebhookID] = dl.Attempts
+		var payload WebhookPayload
+		err := json.Unmarshal(dl.Payload, &payload)
+		if data, _ := payload.Data.(map[string]any); err != nil || data["name"] != "Alice" {
+			t.Errorf("wrong dead-letter payload: %s", dl.Payload)
+		}
+	}
+	// A failing receiver uses up the attempts; a rejecting one is not retried
+	if attempts[1] != 3 || attempts[2] != 1 {
+		t.Errorf("wrong attempts before dead-lettering: got %v", attempts)
+	}
+}
+
+func TestWebhookRetriesFreeWorkers(t *testing.T) {
+	resetState()
+	_, failing := newReceiver(t, 500)
+	rec, srv := newReceiver(t)
+	createWebhook(t, `{"url": "`+failing.URL+`"}`)
+	createWebhook(t, `{"url": "`+srv.URL+`"}`)
+
+	// One worker, and a retry that would keep it for an hour
+	runDispatcher(t, NewDispatcher(webhookStore, userEvents, 2, time.Hour, time.Second, 1, true))
+
+	serve(t, "POST", "/v1/users", `{"name": "Alice"}`, nil)
+	serve(t, "POST", "/v1/users", `{"name": "Bob"}`, nil)
+	eventually(t, "both events at the healthy receiver", func() bool { return rec.count() == 2 })
+}
+
+func TestWebhookSkippedEvents(t *testing.T) {
+	resetState()
+	userEvents = NewEventFeed(2)
+	rec, srv := newReceiver(t)
+	createWebhook(t, `{"url": "`+srv.URL+`", "events": ["user.created"]}`)
+	createWebhook(t, `{"url": "`+srv.URL+`", "active": false}`)
+
+	// The feed only keeps the last two of five events by the time the
+	// dispatcher reads it
+	d := NewDispatcher(webhookStore, userEvents, 1, time.Millisecond, time.Second, webhookWorkers, true)
+	for _, name := range []string{"A", "B", "C", "D", "E"} {
+		serve(t, "POST", "/v1/users", `{"name": "`+name+`"}`, nil)
+	}
+	runDispatcher(t, d)
+	eventually(t, "the buffered events", func() bool { return rec.count() == 2 })
+
+	letters := webhookStore.DeadLetters()
+	if len(letters) != 3 {
+		t.Fatalf("wrong number of dead letters: got %d want 3: %+v", len(letters), letters)
+	}
+	for i, dl := range letters {
+		if dl.WebhookID != 1 || dl.EventID != uint64(3-i) || dl.LastError == "" {
+			t.Errorf("wrong dead letter %d: %+v", i, dl)
+		}
+	}
+}
+
+func TestWebhookInactive(t *testing.T) {
+	resetState()
+	rec, srv := newReceiver(t)
+	createWebhook(t, `{"url": "`+srv.URL+`", "active": false}`)
+	active, activeSrv := newReceiver(t)
+	createWebhook(t, `{"url": "`+activeSrv.URL+`", "events": ["user.deleted"]}`)
+	startDispatcher(t, 1)
+
+	serve(t, "POST", "/v1/users", `{"name": "Alice"}`, nil)
+	serve(t, "DELETE", "/v1/users/1", "", nil)
+	eventually(t, "the delete delivery", func() bool { return active.count() == 1 })
+
+	if rec.count() != 0 {
+		t.Errorf("inactive webhook received %d deliveries", rec.count())
+	}
+}
+
+func TestWebhookInternalAddresses(t *testing.T) {
+	resetState()
+	rec, srv := newReceiver(t)
+	createWebhook(t, `{"url": "`+srv.URL+`"}`)
+	runDispatcher(t, NewDispatcher(webhookStore, userEvents, 1, time.Millisecond, time.Second, 1, false))
+
+	serve(t, "POST", "/v1/users", `{"name": "Alice"}`, nil)
+	eventually(t, "a dead letter", func() bool { return len(webhookStore.DeadLetters()) == 1 })
+
+	if rec.count() != 0 {
+		t.Errorf("receiver on loopback got %d deliveries", rec.count())
+	}
+	if dl := webhookStore.DeadLetters()[0]; !strings.Contains(dl.LastError, errInternalAddress.Error()) {
+		t.Errorf("wrong dead-letter error: %v", dl.LastError)
+	}
+}
+
+func TestWebhookRedirects(t *testing.T) {
+	resetState()
+	target, targetSrv := newReceiver(t)
+	redirect := httptest.NewServer(http.RedirectHandler(targetSrv.URL, http.StatusFound))
+	t.Cleanup(redirect.Close)
+	createWebhook(t, `{"url": "`+redirect.URL+`"}`)
+	startDispatcher(t, 1)
+
+	serve(t, "POST", "/v1/users", `{"name": "Alice"}`, nil)
+	eventually(t, "a dead letter", func() bool { return len(webhookStore.DeadLetters()) == 1 })
+
+	if target.count() != 0 {
+		t.Errorf("redirect was followed %d times", target.count())
+	}
+	if log, _ := webhookStore.Deliveries(1); len(log) != 1 || log[0].StatusCode != http.StatusFound {
+		t.Errorf("wrong delivery log: %+v", log)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	d := NewDispatcher(NewWebhookStore(), NewEventFeed(1), 20, time.Second, time.Second, 1, false)
+
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{4, 8 * time.Second},
+		{15, maxWebhookBackoff},
+	}
+	for _, tt := range tests {
+		if got := d.retryDelay(tt.attempt); got != tt.want {
+			t.Errorf("retryDelay(%d) = %v, want %v", tt.attempt, got, tt.want)
+		}
+	}
+}